@@ -88,7 +88,7 @@ func (bh *BinaryHandler) checkPos(offset uint32) error {
 		return ErrOverflow
 	}
 	if dataLen > len(bh.data) {
-		return fmt.Errorf("binary handler overflow, pos: %d offset: %d", bh.pos, offset)
+		return fmt.Errorf("%w, pos: %d offset: %d", ErrOverflow, bh.pos, offset)
 	}
 	return nil
 }
@@ -128,7 +128,7 @@ func (bh *BinaryHandler) WriteBytesStartAt(pos int, byteItem []byte) error {
 		return ErrOverflow
 	}
 	if dataLen > len(bh.data) {
-		return fmt.Errorf("binary handler overflow, pos: %d offset: %d", pos, offset)
+		return fmt.Errorf("%w, pos: %d offset: %d", ErrOverflow, pos, offset)
 	}
 	copy(bh.data[pos:], byteItem)
 	return nil
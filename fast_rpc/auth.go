@@ -0,0 +1,172 @@
+package fast_rpc
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"github.com/pineal-niwan/busybox/util"
+	"math"
+	"net"
+	"time"
+)
+
+const (
+	//HMAC认证的随机挑战长度
+	hmacChallengeSize = 32
+	//HMAC认证结果 -- 通过
+	hmacStatusOK = 0
+	//HMAC认证结果 -- 拒绝
+	hmacStatusRejected = 1
+)
+
+//服务端认证 -- 连接建立后(TLS握手之后)、读取任何消息之前进行
+type Authenticator interface {
+	//完成认证握手,返回对端身份; 返回错误时连接被关闭
+	Authenticate(ctx context.Context, conn net.Conn) (string, error)
+}
+
+//客户端认证 -- 每次建立连接(包括重连)后进行
+type ClientAuthenticator interface {
+	//完成认证握手,返回错误时连接被关闭
+	Handshake(ctx context.Context, conn net.Conn) error
+}
+
+//预共享密钥的HMAC认证
+//服务端发送随机挑战,客户端返回密钥编号与HMAC-SHA256(密钥, 挑战+密钥编号),服务端验证后返回一个字节的结果
+//
+//  服务端 -> 客户端: challenge[32]
+//  客户端 -> 服务端: keyIDLen uint16(小端) | keyID | mac[32]
+//  服务端 -> 客户端: status[1]
+type HMACAuthenticator struct {
+	//密钥编号 -> 密钥
+	keys map[string][]byte
+}
+
+//新建服务端HMAC认证 -- 认证通过后对端身份为密钥编号
+func NewHMACAuthenticator(keys map[string][]byte) (*HMACAuthenticator, error) {
+	if len(keys) == 0 {
+		return nil, ErrInvalidOption
+	}
+	copied := make(map[string][]byte, len(keys))
+	for keyID, key := range keys {
+		if keyID == "" || len(keyID) > math.MaxUint16 || len(key) == 0 {
+			return nil, ErrInvalidOption
+		}
+		copied[keyID] = append([]byte(nil), key...)
+	}
+	return &HMACAuthenticator{
+		keys: copied,
+	}, nil
+}
+
+func (auth *HMACAuthenticator) Authenticate(ctx context.Context, conn net.Conn) (string, error) {
+	err := setConnDeadline(ctx, conn)
+	if err != nil {
+		return "", err
+	}
+
+	challenge := make([]byte, hmacChallengeSize)
+	_, err = rand.Read(challenge)
+	if err != nil {
+		return "", err
+	}
+	err = util.NetSendBytes(conn, challenge)
+	if err != nil {
+		return "", err
+	}
+
+	var lenBuf [2]byte
+	err = util.NetReadBytes(conn, lenBuf[:])
+	if err != nil {
+		return "", err
+	}
+	keyIDLen := int(binary.LittleEndian.Uint16(lenBuf[:]))
+	if keyIDLen == 0 {
+		util.NetSendBytes(conn, []byte{hmacStatusRejected})
+		return "", ErrAuthFailed
+	}
+	buf := make([]byte, keyIDLen+sha256.Size)
+	err = util.NetReadBytes(conn, buf)
+	if err != nil {
+		return "", err
+	}
+	keyID := string(buf[:keyIDLen])
+	mac := buf[keyIDLen:]
+
+	key, ok := auth.keys[keyID]
+	if !ok || !hmac.Equal(mac, hmacSum(key, challenge, keyID)) {
+		util.NetSendBytes(conn, []byte{hmacStatusRejected})
+		return "", ErrAuthFailed
+	}
+	err = util.NetSendBytes(conn, []byte{hmacStatusOK})
+	if err != nil {
+		return "", err
+	}
+	return keyID, conn.SetDeadline(time.Time{})
+}
+
+//客户端HMAC认证
+type HMACClientAuthenticator struct {
+	//密钥编号
+	keyID string
+	//密钥
+	key []byte
+}
+
+func NewHMACClientAuthenticator(keyID string, key []byte) (*HMACClientAuthenticator, error) {
+	if keyID == "" || len(keyID) > math.MaxUint16 || len(key) == 0 {
+		return nil, ErrInvalidOption
+	}
+	return &HMACClientAuthenticator{
+		keyID: keyID,
+		key:   append([]byte(nil), key...),
+	}, nil
+}
+
+func (auth *HMACClientAuthenticator) Handshake(ctx context.Context, conn net.Conn) error {
+	err := setConnDeadline(ctx, conn)
+	if err != nil {
+		return err
+	}
+
+	challenge := make([]byte, hmacChallengeSize)
+	err = util.NetReadBytes(conn, challenge)
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, 2, 2+len(auth.keyID)+sha256.Size)
+	binary.LittleEndian.PutUint16(buf, uint16(len(auth.keyID)))
+	buf = append(buf, auth.keyID...)
+	buf = append(buf, hmacSum(auth.key, challenge, auth.keyID)...)
+	err = util.NetSendBytes(conn, buf)
+	if err != nil {
+		return err
+	}
+
+	var status [1]byte
+	err = util.NetReadBytes(conn, status[:])
+	if err != nil {
+		return err
+	}
+	if status[0] != hmacStatusOK {
+		return ErrAuthFailed
+	}
+	return conn.SetDeadline(time.Time{})
+}
+
+//HMAC-SHA256(key, challenge+keyID)
+func hmacSum(key, challenge []byte, keyID string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write(challenge)
+	h.Write([]byte(keyID))
+	return h.Sum(nil)
+}
+
+//按ctx的deadline设置连接的读写超时,没有deadline时不超时
+func setConnDeadline(ctx context.Context, conn net.Conn) error {
+	deadline, _ := ctx.Deadline()
+	return conn.SetDeadline(deadline)
+}
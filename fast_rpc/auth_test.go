@@ -0,0 +1,101 @@
+package fast_rpc
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestHMACAuthenticator(t *testing.T) {
+	auth, err := NewHMACAuthenticator(map[string][]byte{
+		"svc-a": []byte("secret-a"),
+	})
+	if err != nil {
+		t.Fatalf("new authenticator error:%+v", err)
+	}
+	option := testOption()
+	option.Authenticator = auth
+	option.HandshakeTimeout = time.Second
+	_, address := startTestService(t, option)
+
+	newCli := func(keyID, key string) *Cli {
+		cliAuth, err := NewHMACClientAuthenticator(keyID, []byte(key))
+		if err != nil {
+			t.Fatalf("new client authenticator error:%+v", err)
+		}
+		cliOption := testCliOption()
+		cliOption.Authenticator = cliAuth
+		cli, err := NewCli(context.Background(), address, 1, cliOption, testParseHash())
+		if err != nil {
+			t.Fatalf("new cli error:%+v", err)
+		}
+		t.Cleanup(func() {
+			cli.Close()
+		})
+		return cli
+	}
+
+	//认证通过后对端身份为密钥编号
+	cli := newCli("svc-a", "secret-a")
+	outMsg, err := cli.CallWithRetry(context.Background(), &testMsg{cmd: testCmdPeer}, 0)
+	if err != nil || outMsg.(*testMsg).Text != "svc-a" {
+		t.Errorf("call with valid key, msg:%+v err:%+v", outMsg, err)
+	}
+
+	//密钥错误或者密钥编号不存在时被拒绝
+	for _, c := range [][2]string{{"svc-a", "wrong"}, {"svc-b", "secret-a"}} {
+		_, err = newCli(c[0], c[1]).CallWithRetry(context.Background(), &testMsg{cmd: testCmdPeer}, 1)
+		if err != ErrAuthFailed {
+			t.Errorf("expect auth failed for %v, got %+v", c, err)
+		}
+	}
+
+	//没有认证的客户端发送的消息不会被处理
+	plainCli, err := NewCli(context.Background(), address, 1, testCliOption(), testParseHash())
+	if err != nil {
+		t.Fatalf("new cli error:%+v", err)
+	}
+	defer plainCli.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	_, err = plainCli.CallWithRetry(ctx, &testMsg{cmd: testCmdReq, Text: "x"}, 0)
+	if err == nil {
+		t.Errorf("expect call without authentication to fail")
+	}
+}
+
+func TestHandshakeTimeout(t *testing.T) {
+	auth, err := NewHMACAuthenticator(map[string][]byte{
+		"svc-a": []byte("secret-a"),
+	})
+	if err != nil {
+		t.Fatalf("new authenticator error:%+v", err)
+	}
+	option := testOption()
+	option.Authenticator = auth
+	if option.Validate() != ErrInvalidOption {
+		t.Errorf("expect invalid option without handshake timeout")
+	}
+	//没有设置握手超时时使用空闲超时
+	option.IdleTimeout = 50 * time.Millisecond
+	err = option.Validate()
+	if err != nil {
+		t.Fatalf("validate option error:%+v", err)
+	}
+	_, address := startTestService(t, option)
+
+	//连接后不发送任何数据,读完认证的挑战后连接被关闭
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatalf("dial error:%+v", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = io.Copy(ioutil.Discard, conn)
+	if err != nil {
+		t.Errorf("expect connection closed, got %+v", err)
+	}
+}
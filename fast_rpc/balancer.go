@@ -0,0 +1,562 @@
+package fast_rpc
+
+import (
+	"context"
+	"go.uber.org/zap"
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//负载均衡策略
+type BalancePolicy int
+
+const (
+	//轮询
+	PolicyRoundRobin BalancePolicy = iota
+	//选择未完成请求最少的服务地址
+	PolicyLeastOutstanding
+	//按key一致性哈希 -- key通过WithBalanceKey放入context,没有key时按轮询选择
+	PolicyConsistentHash
+)
+
+//服务地址解析 -- 返回当前所有的服务地址
+type Resolver interface {
+	Resolve(ctx context.Context) ([]string, error)
+}
+
+//固定的服务地址列表
+type StaticResolver []string
+
+func (r StaticResolver) Resolve(ctx context.Context) ([]string, error) {
+	return r, nil
+}
+
+//context中保存负载均衡key的key
+type balanceKeyKey struct{}
+
+//带上一致性哈希使用的key
+func WithBalanceKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, balanceKeyKey{}, key)
+}
+
+//从context中获取负载均衡key
+func balanceKeyFromContext(ctx context.Context) (string, bool) {
+	key, ok := ctx.Value(balanceKeyKey{}).(string)
+	return key, ok
+}
+
+//服务地址状态
+type EndpointStats struct {
+	//服务地址
+	Address string
+	//未完成的请求数
+	Outstanding int64
+	//是否已摘除
+	Ejected bool
+}
+
+//服务地址
+type endpoint struct {
+	//服务地址
+	address string
+	//客户端 -- 每个服务地址有自己的连接池
+	cli *Cli
+	//未完成的请求数
+	outstanding int64
+	//连续失败次数
+	failures int32
+	//是否已摘除,1表示摘除
+	ejected int32
+}
+
+func (ep *endpoint) isEjected() bool {
+	return atomic.LoadInt32(&ep.ejected) == 1
+}
+
+//是否可用 -- 未摘除并且没有熔断
+func (ep *endpoint) available() bool {
+	return !ep.isEjected() && ep.cli.breaker.getState() != BreakerOpen
+}
+
+//哈希环上的虚拟节点
+type ringNode struct {
+	hash uint32
+	ep   *endpoint
+}
+
+//服务地址集合 -- 更新时整体替换
+type endpointSet struct {
+	list []*endpoint
+	//一致性哈希环,按hash升序
+	ring []ringNode
+}
+
+func newEndpointSet(list []*endpoint, virtualNodes int) *endpointSet {
+	set := &endpointSet{
+		list: list,
+	}
+	if virtualNodes > 0 {
+		set.ring = make([]ringNode, 0, len(list)*virtualNodes)
+		for _, ep := range list {
+			for i := 0; i < virtualNodes; i++ {
+				set.ring = append(set.ring, ringNode{
+					hash: hashKey(ep.address + "#" + strconv.Itoa(i)),
+					ep:   ep,
+				})
+			}
+		}
+		sort.Slice(set.ring, func(i, j int) bool {
+			return set.ring[i].hash < set.ring[j].hash
+		})
+	}
+	return set
+}
+
+//负载均衡客户端
+//每个服务地址使用一个Cli(各自的连接池),调用时按策略选择服务地址,连接错误时换一个服务地址重试
+//连续失败达到门槛的服务地址被摘除,后台探测建立连接并返回心跳后恢复; 全部摘除时仍然在所有服务地址中选择
+type BalancedCli struct {
+	//参数
+	*CliOption
+	//负载均衡参数
+	balancerOption BalancerOption
+	//日志
+	logger *zap.Logger
+	//服务地址解析
+	resolver Resolver
+	//每个服务地址的连接池大小
+	poolSize int
+	//消息解析
+	msgParseHash map[uint32]MsgParseHandler
+	//当前的服务地址
+	set *endpointSet
+	//轮询计数
+	next uint32
+	//关闭通知
+	exit chan struct{}
+	//是否关闭
+	closed bool
+	//锁
+	sync.RWMutex
+}
+
+func NewBalancedCli(
+	ctx context.Context,
+	resolver Resolver,
+	poolSize int,
+	option *CliOption,
+	balancerOption *BalancerOption,
+	msgParseHash map[uint32]MsgParseHandler) (*BalancedCli, error) {
+	if resolver == nil || balancerOption == nil {
+		return nil, ErrInvalidOption
+	}
+	err := balancerOption.Validate()
+	if err != nil {
+		return nil, err
+	}
+	logger, err := option.newLogger()
+	if err != nil {
+		return nil, err
+	}
+
+	b := &BalancedCli{
+		CliOption:      option,
+		balancerOption: *balancerOption,
+		logger:         logger,
+		resolver:       resolver,
+		poolSize:       poolSize,
+		msgParseHash:   msgParseHash,
+		set:            newEndpointSet(nil, 0),
+		exit:           make(chan struct{}),
+	}
+	addresses, err := resolver.Resolve(ctx)
+	if err != nil {
+		return nil, err
+	}
+	err = b.update(ctx, addresses)
+	if err != nil {
+		b.Close()
+		return nil, err
+	}
+
+	if balancerOption.ResolveInterval > 0 {
+		go b.resolveLoop()
+	}
+	if balancerOption.EjectThreshold > 0 {
+		go b.probeLoop()
+	}
+	return b, nil
+}
+
+//关闭客户端 -- 关闭所有服务地址的连接池
+func (b *BalancedCli) Close() error {
+	b.Lock()
+	if b.closed {
+		b.Unlock()
+		return nil
+	}
+	b.closed = true
+	close(b.exit)
+	set := b.set
+	b.Unlock()
+
+	var lastErr error
+	for _, ep := range set.list {
+		err := ep.cli.Close()
+		if err != nil {
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+//获取所有服务地址的状态
+func (b *BalancedCli) Endpoints() []EndpointStats {
+	b.RLock()
+	set := b.set
+	b.RUnlock()
+
+	stats := make([]EndpointStats, 0, len(set.list))
+	for _, ep := range set.list {
+		stats = append(stats, EndpointStats{
+			Address:     ep.address,
+			Outstanding: atomic.LoadInt64(&ep.outstanding),
+			Ejected:     ep.isEjected(),
+		})
+	}
+	return stats
+}
+
+//多次调用 -- 经过拦截器后调用
+func (b *BalancedCli) CallWithRetry(ctx context.Context, inMsg IMsg, retryTimes int) (outMsg IMsg, err error) {
+	//单向消息不会有返回,不能调用
+	if isOneWayMsg(inMsg) {
+		return nil, ErrOneWayCall
+	}
+	if b.Metrics != nil {
+		start := time.Now()
+		defer func() {
+			b.Metrics.observeCall(inMsg, err, time.Since(start))
+		}()
+	}
+	invoker := func(ctx context.Context, inMsg IMsg) (IMsg, error) {
+		return b.callWithRetry(ctx, inMsg, retryTimes)
+	}
+	if len(b.Interceptors) == 0 {
+		return invoker(ctx, inMsg)
+	}
+	return chainClientInterceptors(b.Interceptors, newCallHead(inMsg), invoker)(ctx, inMsg)
+}
+
+//发送单向消息 -- 经过拦截器后选择一个服务地址发送,不重试
+func (b *BalancedCli) Notify(ctx context.Context, inMsg IMsg) (err error) {
+	if b.Metrics != nil {
+		start := time.Now()
+		defer func() {
+			b.Metrics.observeCall(inMsg, err, time.Since(start))
+		}()
+	}
+	if len(b.Interceptors) == 0 {
+		return b.notify(ctx, inMsg)
+	}
+	_, err = chainClientInterceptors(b.Interceptors, newCallHead(inMsg),
+		func(ctx context.Context, inMsg IMsg) (IMsg, error) {
+			return nil, b.notify(ctx, inMsg)
+		})(ctx, inMsg)
+	return err
+}
+
+//选择一个服务地址发送单向消息
+func (b *BalancedCli) notify(ctx context.Context, inMsg IMsg) error {
+	ep, err := b.pick(ctx, nil)
+	if err != nil {
+		return err
+	}
+	atomic.AddInt64(&ep.outstanding, 1)
+	err = ep.cli.notify(ctx, inMsg)
+	atomic.AddInt64(&ep.outstanding, -1)
+	if err != nil && err != ErrCircuitOpen {
+		b.fail(ep)
+		return err
+	}
+	b.succeed(ep)
+	return err
+}
+
+//多次调用 -- 每次调用选择一个服务地址,连接错误时优先换没有调用过的服务地址重试
+func (b *BalancedCli) callWithRetry(ctx context.Context, inMsg IMsg, retryTimes int) (IMsg, error) {
+	var tried []*endpoint
+	var err error
+
+	b.RetryBudget.deposit()
+	for i := 0; i <= retryTimes; i++ {
+		if i > 0 {
+			//申请重试预算并退避等待
+			retry, retryErr := b.beforeRetry(ctx, inMsg, i-1)
+			if !retry {
+				if retryErr != nil {
+					err = retryErr
+				}
+				break
+			}
+		}
+		ep, pickErr := b.pick(ctx, tried)
+		if pickErr != nil {
+			if err == nil {
+				err = pickErr
+			}
+			return nil, err
+		}
+		tried = append(tried, ep)
+
+		atomic.AddInt64(&ep.outstanding, 1)
+		outMsg, connErr, callErr := ep.cli.callWithRetry(ctx, inMsg, 0)
+		atomic.AddInt64(&ep.outstanding, -1)
+		if !connErr {
+			//服务地址可用 -- 成功或者逻辑错误都不重试
+			b.succeed(ep)
+			return outMsg, callErr
+		}
+		if callErr != ErrCircuitOpen {
+			//熔断拒绝的调用没有经过服务地址,不计失败
+			b.fail(ep)
+		}
+		err = callErr
+	}
+	return nil, err
+}
+
+//选择服务地址
+//依次在 未调用过且可用的、可用的、所有的 服务地址中选择,可用指未摘除并且没有熔断
+func (b *BalancedCli) pick(ctx context.Context, tried []*endpoint) (*endpoint, error) {
+	b.RLock()
+	set := b.set
+	closed := b.closed
+	b.RUnlock()
+	if closed {
+		return nil, ErrCliClosed
+	}
+	if len(set.list) == 0 {
+		return nil, ErrNoEndpoint
+	}
+
+	filters := []func(ep *endpoint) bool{
+		func(ep *endpoint) bool {
+			return ep.available() && !containsEndpoint(tried, ep)
+		},
+		func(ep *endpoint) bool {
+			return ep.available()
+		},
+		func(ep *endpoint) bool {
+			return true
+		},
+	}
+	for _, filter := range filters {
+		ep := b.pickWithPolicy(ctx, set, filter)
+		if ep != nil {
+			return ep, nil
+		}
+	}
+	return nil, ErrNoEndpoint
+}
+
+//按策略在满足条件的服务地址中选择,没有时返回nil
+func (b *BalancedCli) pickWithPolicy(ctx context.Context, set *endpointSet, filter func(ep *endpoint) bool) *endpoint {
+	switch b.balancerOption.Policy {
+	case PolicyLeastOutstanding:
+		//从轮询位置开始找,未完成请求数相同时分散到不同的服务地址
+		var picked *endpoint
+		var min int64
+		start := int(atomic.AddUint32(&b.next, 1))
+		for i := range set.list {
+			ep := set.list[(start+i)%len(set.list)]
+			if !filter(ep) {
+				continue
+			}
+			outstanding := atomic.LoadInt64(&ep.outstanding)
+			if picked == nil || outstanding < min {
+				picked = ep
+				min = outstanding
+			}
+		}
+		return picked
+	case PolicyConsistentHash:
+		key, ok := balanceKeyFromContext(ctx)
+		if ok {
+			//顺时针找第一个满足条件的虚拟节点
+			h := hashKey(key)
+			start := sort.Search(len(set.ring), func(i int) bool {
+				return set.ring[i].hash >= h
+			})
+			for i := range set.ring {
+				ep := set.ring[(start+i)%len(set.ring)].ep
+				if filter(ep) {
+					return ep
+				}
+			}
+			return nil
+		}
+	}
+
+	//轮询
+	start := int(atomic.AddUint32(&b.next, 1))
+	for i := range set.list {
+		ep := set.list[(start+i)%len(set.list)]
+		if filter(ep) {
+			return ep
+		}
+	}
+	return nil
+}
+
+//调用成功 -- 清除失败次数,被摘除的服务地址恢复
+func (b *BalancedCli) succeed(ep *endpoint) {
+	atomic.StoreInt32(&ep.failures, 0)
+	if atomic.CompareAndSwapInt32(&ep.ejected, 1, 0) {
+		b.logger.Info("rpc endpoint recovered",
+			zap.String("address", ep.address))
+	}
+}
+
+//调用失败 -- 连续失败达到门槛时摘除
+func (b *BalancedCli) fail(ep *endpoint) {
+	failures := atomic.AddInt32(&ep.failures, 1)
+	threshold := b.balancerOption.EjectThreshold
+	if threshold > 0 && int(failures) >= threshold &&
+		atomic.CompareAndSwapInt32(&ep.ejected, 0, 1) {
+		b.logger.Warn("rpc endpoint ejected",
+			zap.String("address", ep.address),
+			zap.Int32("failures", failures))
+	}
+}
+
+//更新服务地址 -- 保留已有的,新建新增的,关闭去掉的
+func (b *BalancedCli) update(ctx context.Context, addresses []string) error {
+	b.RLock()
+	old := b.set
+	b.RUnlock()
+
+	oldHash := make(map[string]*endpoint, len(old.list))
+	for _, ep := range old.list {
+		oldHash[ep.address] = ep
+	}
+	newHash := make(map[string]*endpoint, len(addresses))
+	list := make([]*endpoint, 0, len(addresses))
+	for _, address := range addresses {
+		if _, ok := newHash[address]; ok {
+			continue
+		}
+		ep, ok := oldHash[address]
+		if !ok {
+			cli, err := newCli(ctx, address, b.poolSize, b.CliOption, b.msgParseHash, b.logger)
+			if err != nil {
+				closeEndpoints(list, oldHash)
+				return err
+			}
+			ep = &endpoint{
+				address: address,
+				cli:     cli,
+			}
+		}
+		newHash[address] = ep
+		list = append(list, ep)
+	}
+
+	virtualNodes := 0
+	if b.balancerOption.Policy == PolicyConsistentHash {
+		virtualNodes = b.balancerOption.VirtualNodes
+	}
+	set := newEndpointSet(list, virtualNodes)
+
+	b.Lock()
+	if b.closed {
+		b.Unlock()
+		closeEndpoints(list, oldHash)
+		return ErrCliClosed
+	}
+	b.set = set
+	b.Unlock()
+
+	//使用中的连接归还时被关闭
+	closeEndpoints(old.list, newHash)
+	return nil
+}
+
+//定时重新解析服务地址,解析失败时保留原有的服务地址
+func (b *BalancedCli) resolveLoop() {
+	ticker := time.NewTicker(b.balancerOption.ResolveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-b.exit:
+			return
+		case <-ticker.C:
+			ctx, cancel := context.WithTimeout(context.Background(), b.balancerOption.ResolveInterval)
+			addresses, err := b.resolver.Resolve(ctx)
+			if err == nil {
+				err = b.update(ctx, addresses)
+			}
+			cancel()
+			if err != nil && err != ErrCliClosed {
+				b.logger.Warn("rpc resolve endpoints error",
+					zap.Error(err))
+			}
+		}
+	}
+}
+
+//定时探测被摘除的服务地址
+func (b *BalancedCli) probeLoop() {
+	ticker := time.NewTicker(b.balancerOption.ProbeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-b.exit:
+			return
+		case <-ticker.C:
+			b.RLock()
+			set := b.set
+			b.RUnlock()
+			for _, ep := range set.list {
+				if ep.isEjected() && b.probeEndpoint(ep) {
+					b.succeed(ep)
+				}
+			}
+		}
+	}
+}
+
+//探测服务地址 -- 能建立连接并返回心跳表示可用
+func (b *BalancedCli) probeEndpoint(ep *endpoint) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), b.balancerOption.ProbeTimeout)
+	defer cancel()
+	return ep.cli.probe(ctx) == nil
+}
+
+//关闭不在keep中的服务地址
+func closeEndpoints(list []*endpoint, keep map[string]*endpoint) {
+	for _, ep := range list {
+		if keep[ep.address] != ep {
+			ep.cli.Close()
+		}
+	}
+}
+
+func containsEndpoint(list []*endpoint, ep *endpoint) bool {
+	for _, e := range list {
+		if e == ep {
+			return true
+		}
+	}
+	return false
+}
+
+func hashKey(key string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return h.Sum32()
+}
@@ -0,0 +1,162 @@
+package fast_rpc
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+//启动一个统计请求数的测试服务
+func startCountedService(t *testing.T, count *int32) (*Service, string) {
+	option := testOption()
+	option.Interceptors = []ServerInterceptor{
+		func(ctx context.Context, head MsgHead, inMsg IMsg, handler MsgHandlerWithContext) (IMsg, error) {
+			atomic.AddInt32(count, 1)
+			return handler(ctx, inMsg)
+		},
+	}
+	return startTestService(t, option)
+}
+
+func testBalancerOption(policy BalancePolicy) *BalancerOption {
+	return &BalancerOption{
+		Policy:         policy,
+		EjectThreshold: 1,
+		ProbeInterval:  time.Hour,
+		ProbeTimeout:   time.Second,
+		VirtualNodes:   50,
+	}
+}
+
+func TestBalancedCliRoundRobin(t *testing.T) {
+	var count1, count2 int32
+	service1, address1 := startCountedService(t, &count1)
+	_, address2 := startCountedService(t, &count2)
+
+	cli, err := NewBalancedCli(context.Background(), StaticResolver{address1, address2}, 2,
+		testCliOption(), testBalancerOption(PolicyRoundRobin), testParseHash())
+	if err != nil {
+		t.Fatalf("new balanced cli error:%+v", err)
+	}
+	defer cli.Close()
+
+	for i := 0; i < 10; i++ {
+		_, err = cli.CallWithRetry(context.Background(), &testMsg{cmd: testCmdReq, Text: "x"}, 1)
+		if err != nil {
+			t.Fatalf("call error:%+v", err)
+		}
+	}
+	if atomic.LoadInt32(&count1) != 5 || atomic.LoadInt32(&count2) != 5 {
+		t.Errorf("expect 5/5 requests, got %d/%d", count1, count2)
+	}
+
+	//一个服务停止后调用换到另一个服务,停止的服务被摘除
+	err = service1.Shutdown(context.Background())
+	if err != nil {
+		t.Fatalf("shutdown error:%+v", err)
+	}
+	for i := 0; i < 10; i++ {
+		_, err = cli.CallWithRetry(context.Background(), &testMsg{cmd: testCmdReq, Text: "x"}, 1)
+		if err != nil {
+			t.Fatalf("call after service down error:%+v", err)
+		}
+	}
+	for _, stats := range cli.Endpoints() {
+		if stats.Ejected != (stats.Address == address1) {
+			t.Errorf("unexpected endpoint stats %+v", stats)
+		}
+	}
+}
+
+func TestBalancedCliConsistentHash(t *testing.T) {
+	var count1, count2 int32
+	_, address1 := startCountedService(t, &count1)
+	_, address2 := startCountedService(t, &count2)
+
+	cli, err := NewBalancedCli(context.Background(), StaticResolver{address1, address2}, 2,
+		testCliOption(), testBalancerOption(PolicyConsistentHash), testParseHash())
+	if err != nil {
+		t.Fatalf("new balanced cli error:%+v", err)
+	}
+	defer cli.Close()
+
+	//同一个key总是落到同一个服务
+	for k := 0; k < 10; k++ {
+		before1, before2 := atomic.LoadInt32(&count1), atomic.LoadInt32(&count2)
+		ctx := WithBalanceKey(context.Background(), fmt.Sprintf("user-%d", k))
+		for i := 0; i < 5; i++ {
+			_, err = cli.CallWithRetry(ctx, &testMsg{cmd: testCmdReq, Text: "x"}, 1)
+			if err != nil {
+				t.Fatalf("call error:%+v", err)
+			}
+		}
+		delta1 := atomic.LoadInt32(&count1) - before1
+		delta2 := atomic.LoadInt32(&count2) - before2
+		if !(delta1 == 5 && delta2 == 0) && !(delta1 == 0 && delta2 == 5) {
+			t.Errorf("key %d spread across services %d/%d", k, delta1, delta2)
+		}
+	}
+}
+
+func TestBalancedCliProbe(t *testing.T) {
+	//只接收连接不回复的地址,能建立连接但不可用
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen error:%+v", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	//需要认证的服务
+	auth, err := NewHMACAuthenticator(map[string][]byte{
+		"svc-a": []byte("secret-a"),
+	})
+	if err != nil {
+		t.Fatalf("new authenticator error:%+v", err)
+	}
+	option := testOption()
+	option.Authenticator = auth
+	option.HandshakeTimeout = time.Second
+	_, address := startTestService(t, option)
+
+	for _, c := range []struct {
+		address string
+		key     string
+		alive   bool
+	}{
+		{ln.Addr().String(), "secret-a", false},
+		{address, "wrong", false},
+		{address, "secret-a", true},
+	} {
+		cliAuth, err := NewHMACClientAuthenticator("svc-a", []byte(c.key))
+		if err != nil {
+			t.Fatalf("new client authenticator error:%+v", err)
+		}
+		cliOption := testCliOption()
+		cliOption.Authenticator = cliAuth
+		balancerOption := testBalancerOption(PolicyRoundRobin)
+		balancerOption.ProbeTimeout = 100 * time.Millisecond
+		cli, err := NewBalancedCli(context.Background(), StaticResolver{c.address}, 1,
+			cliOption, balancerOption, testParseHash())
+		if err != nil {
+			t.Fatalf("new balanced cli error:%+v", err)
+		}
+		defer cli.Close()
+
+		//探测与调用一样完成认证并发送心跳
+		if alive := cli.probeEndpoint(cli.set.list[0]); alive != c.alive {
+			t.Errorf("probe %s with key %s, expect alive:%v", c.address, c.key, c.alive)
+		}
+	}
+}
@@ -0,0 +1,258 @@
+package fast_rpc
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+//熔断状态
+type BreakerState int
+
+const (
+	//正常放行
+	BreakerClosed BreakerState = iota
+	//熔断 -- 直接拒绝调用
+	BreakerOpen
+	//半开 -- 放行一个探测调用,成功后恢复,失败后重新熔断
+	BreakerHalfOpen
+)
+
+func (state BreakerState) String() string {
+	switch state {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	default:
+		return "unknown"
+	}
+}
+
+//熔断器 -- 每个服务地址一个,连接错误(needResetConn)计为失败,逻辑错误计为成功
+//为nil时总是放行
+type circuitBreaker struct {
+	option BreakerOption
+	state  BreakerState
+	//连续失败次数
+	failures int
+	//熔断开始的时间
+	openedAt time.Time
+	//半开状态下是否已经放行了探测调用
+	probing bool
+	sync.Mutex
+}
+
+func newCircuitBreaker(option *BreakerOption) *circuitBreaker {
+	if option == nil {
+		return nil
+	}
+	return &circuitBreaker{
+		option: *option,
+	}
+}
+
+//获取当前状态
+func (b *circuitBreaker) getState() BreakerState {
+	if b == nil {
+		return BreakerClosed
+	}
+	b.Lock()
+	defer b.Unlock()
+	b.refresh(time.Now())
+	return b.state
+}
+
+//熔断时间到后进入半开状态,调用方需要持有锁
+func (b *circuitBreaker) refresh(now time.Time) {
+	if b.state == BreakerOpen && now.Sub(b.openedAt) >= b.option.OpenTimeout {
+		b.state = BreakerHalfOpen
+		b.probing = false
+	}
+}
+
+//是否放行调用 -- 放行后必须调用success、failure或cancel之一
+func (b *circuitBreaker) allow() error {
+	if b == nil {
+		return nil
+	}
+	b.Lock()
+	defer b.Unlock()
+	b.refresh(time.Now())
+	switch b.state {
+	case BreakerOpen:
+		return ErrCircuitOpen
+	case BreakerHalfOpen:
+		if b.probing {
+			return ErrCircuitOpen
+		}
+		b.probing = true
+	}
+	return nil
+}
+
+//调用成功
+func (b *circuitBreaker) success() {
+	if b == nil {
+		return
+	}
+	b.Lock()
+	b.state = BreakerClosed
+	b.failures = 0
+	b.probing = false
+	b.Unlock()
+}
+
+//调用失败 -- 连续失败达到门槛或者探测失败时熔断
+func (b *circuitBreaker) failure() {
+	if b == nil {
+		return
+	}
+	b.Lock()
+	b.failures++
+	if b.state == BreakerHalfOpen || b.failures >= b.option.FailureThreshold {
+		b.state = BreakerOpen
+		b.openedAt = time.Now()
+		b.probing = false
+	}
+	b.Unlock()
+}
+
+//调用没有结果(如调用方取消) -- 释放半开状态的探测名额
+func (b *circuitBreaker) cancel() {
+	if b == nil {
+		return
+	}
+	b.Lock()
+	b.probing = false
+	b.Unlock()
+}
+
+//按调用结果更新熔断器 -- 调用超时算失败,调用方取消不算
+func (b *circuitBreaker) record(ctx context.Context, err error, needResetConn bool) {
+	switch {
+	case err == nil || !needResetConn:
+		b.success()
+	case ctx.Err() == context.Canceled:
+		b.cancel()
+	default:
+		b.failure()
+	}
+}
+
+//重试预算 -- 多个客户端共用,限制重试占调用的比例
+//每次调用存入ratio个令牌,每秒另外存入minPerSecond个令牌,最多保存maxTokens个; 每次重试取出一个令牌,没有令牌时不重试
+type RetryBudget struct {
+	ratio        float64
+	minPerSecond float64
+	maxTokens    float64
+	tokens       float64
+	//上次补充令牌的时间
+	last time.Time
+	sync.Mutex
+}
+
+func NewRetryBudget(ratio float64, minPerSecond float64, maxTokens int) (*RetryBudget, error) {
+	if ratio < 0 || minPerSecond < 0 || maxTokens <= 0 {
+		return nil, ErrInvalidOption
+	}
+	return &RetryBudget{
+		ratio:        ratio,
+		minPerSecond: minPerSecond,
+		maxTokens:    float64(maxTokens),
+		tokens:       float64(maxTokens),
+		last:         time.Now(),
+	}, nil
+}
+
+//补充令牌,调用方需要持有锁
+func (budget *RetryBudget) refill(delta float64) {
+	now := time.Now()
+	delta += now.Sub(budget.last).Seconds() * budget.minPerSecond
+	budget.last = now
+	budget.tokens += delta
+	if budget.tokens > budget.maxTokens {
+		budget.tokens = budget.maxTokens
+	}
+}
+
+//记录一次调用
+func (budget *RetryBudget) deposit() {
+	if budget == nil {
+		return
+	}
+	budget.Lock()
+	budget.refill(budget.ratio)
+	budget.Unlock()
+}
+
+//申请一次重试
+func (budget *RetryBudget) withdraw() bool {
+	if budget == nil {
+		return true
+	}
+	budget.Lock()
+	defer budget.Unlock()
+	budget.refill(0)
+	if budget.tokens < 1 {
+		return false
+	}
+	budget.tokens--
+	return true
+}
+
+//第n次(从0开始)重试前的退避时间 -- 按指数增长,不超过max(为0时不限制),在后一半中随机
+func backoffDuration(base, max time.Duration, n int) time.Duration {
+	if base <= 0 {
+		return 0
+	}
+	d := base
+	for i := 0; i < n; i++ {
+		if max > 0 && d >= max {
+			break
+		}
+		if d > math.MaxInt64/2 {
+			break
+		}
+		d *= 2
+	}
+	if max > 0 && d > max {
+		d = max
+	}
+	half := d / 2
+	return half + time.Duration(rand.Int63n(int64(d-half)+1))
+}
+
+//等待 -- ctx结束时提前返回ctx的错误
+func sleepContext(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+//第n次(从0开始)重试前的准备 -- 申请重试预算并退避等待
+//返回false表示不再重试: 预算用完时error为nil,调用方返回最后一次调用的错误; ctx结束时返回ctx的错误
+func (cliOption *CliOption) beforeRetry(ctx context.Context, inMsg IMsg, n int) (bool, error) {
+	if !cliOption.RetryBudget.withdraw() {
+		cliOption.Metrics.observeBudgetExhausted(inMsg)
+		return false, nil
+	}
+	err := sleepContext(ctx, backoffDuration(cliOption.RetreatTime, cliOption.RetreatMaxTime, n))
+	if err != nil {
+		return false, err
+	}
+	cliOption.Metrics.observeRetry(inMsg)
+	return true, nil
+}
@@ -0,0 +1,158 @@
+package fast_rpc
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	b := newCircuitBreaker(&BreakerOption{
+		FailureThreshold: 2,
+		OpenTimeout:      20 * time.Millisecond,
+	})
+
+	b.failure()
+	if b.allow() != nil {
+		t.Fatalf("expect closed after one failure")
+	}
+	b.failure()
+	if b.allow() != ErrCircuitOpen || b.getState() != BreakerOpen {
+		t.Fatalf("expect open after threshold, state:%v", b.getState())
+	}
+
+	//熔断时间到后只放行一个探测调用
+	time.Sleep(30 * time.Millisecond)
+	if b.allow() != nil {
+		t.Fatalf("expect probe allowed in half-open")
+	}
+	if b.allow() != ErrCircuitOpen {
+		t.Fatalf("expect only one probe in half-open")
+	}
+	//探测失败重新熔断
+	b.failure()
+	if b.getState() != BreakerOpen {
+		t.Fatalf("expect open after probe failure, state:%v", b.getState())
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	if b.allow() != nil {
+		t.Fatalf("expect probe allowed in half-open")
+	}
+	b.success()
+	if b.getState() != BreakerClosed {
+		t.Fatalf("expect closed after probe success, state:%v", b.getState())
+	}
+}
+
+func TestRetryBudget(t *testing.T) {
+	budget, err := NewRetryBudget(0.5, 0, 2)
+	if err != nil {
+		t.Fatalf("new retry budget error:%+v", err)
+	}
+	if !budget.withdraw() || !budget.withdraw() {
+		t.Fatalf("expect initial tokens")
+	}
+	if budget.withdraw() {
+		t.Fatalf("expect budget exhausted")
+	}
+	//两次调用存入一个令牌
+	budget.deposit()
+	budget.deposit()
+	if !budget.withdraw() || budget.withdraw() {
+		t.Fatalf("expect exactly one token after two deposits")
+	}
+}
+
+func TestBackoffDuration(t *testing.T) {
+	for n := 0; n < 10; n++ {
+		d := backoffDuration(10*time.Millisecond, 100*time.Millisecond, n)
+		expect := 10 * time.Millisecond << uint(n)
+		if expect > 100*time.Millisecond {
+			expect = 100 * time.Millisecond
+		}
+		if d < expect/2 || d > expect {
+			t.Errorf("backoff %d out of range: %v", n, d)
+		}
+	}
+}
+
+func TestCliBreakerOpen(t *testing.T) {
+	//先占用一个端口再关闭,保证没有服务
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen error:%+v", err)
+	}
+	address := ln.Addr().String()
+	ln.Close()
+
+	cliOption := testCliOption()
+	cliOption.Breaker = &BreakerOption{
+		FailureThreshold: 3,
+		OpenTimeout:      time.Hour,
+	}
+	cli, err := NewCli(context.Background(), address, 1, cliOption, testParseHash())
+	if err != nil {
+		t.Fatalf("new cli error:%+v", err)
+	}
+	defer cli.Close()
+
+	for i := 0; i < 3; i++ {
+		_, err = cli.CallWithRetry(context.Background(), &testMsg{cmd: testCmdReq, Text: "x"}, 0)
+		if err == nil || err == ErrCircuitOpen {
+			t.Fatalf("expect dial error, got %+v", err)
+		}
+	}
+	//连续失败后熔断,不再尝试连接
+	_, err = cli.CallWithRetry(context.Background(), &testMsg{cmd: testCmdReq, Text: "x"}, 3)
+	if err != ErrCircuitOpen || cli.BreakerState() != BreakerOpen {
+		t.Errorf("expect circuit open, got %+v state:%v", err, cli.BreakerState())
+	}
+}
+
+func TestMuxCliBreakerTimeout(t *testing.T) {
+	_, address := startTestService(t, testOption())
+
+	cliOption := testCliOption()
+	cliOption.Breaker = &BreakerOption{
+		FailureThreshold: 2,
+		OpenTimeout:      time.Hour,
+	}
+	cli, err := NewMuxCli(context.Background(), address, cliOption, testParseHash())
+	if err != nil {
+		t.Fatalf("new mux cli error:%+v", err)
+	}
+	defer cli.Close()
+
+	//调用超时与Cli一样算失败
+	for i := 0; i < 2; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		_, err = cli.Call(ctx, &testMsg{cmd: testCmdReq, Text: "sleep:100000000"})
+		cancel()
+		if err != context.DeadlineExceeded {
+			t.Fatalf("expect deadline exceeded, got %+v", err)
+		}
+	}
+	if cli.BreakerState() != BreakerOpen {
+		t.Errorf("expect circuit open after timeouts, state:%v", cli.BreakerState())
+	}
+
+	//调用方取消不算失败
+	cancelCli, err := NewMuxCli(context.Background(), address, cliOption, testParseHash())
+	if err != nil {
+		t.Fatalf("new mux cli error:%+v", err)
+	}
+	defer cancelCli.Close()
+	for i := 0; i < 2; i++ {
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(20*time.Millisecond, cancel)
+		_, err = cancelCli.Call(ctx, &testMsg{cmd: testCmdReq, Text: "sleep:100000000"})
+		if err != context.Canceled {
+			t.Fatalf("expect canceled, got %+v", err)
+		}
+	}
+	if cancelCli.BreakerState() != BreakerClosed {
+		t.Errorf("expect circuit closed after cancels, state:%v", cancelCli.BreakerState())
+	}
+}
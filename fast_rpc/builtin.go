@@ -0,0 +1,67 @@
+package fast_rpc
+
+import (
+	"github.com/pineal-niwan/busybox/binary"
+	"net"
+)
+
+//是否是框架处理的命令号
+func isBuiltinCmd(cmd uint16) bool {
+	return cmd == CmdPing || cmd == CmdDescribe
+}
+
+//是否是框架直接回复的请求 -- 流与单向消息不能使用框架的命令号
+func (s *Service) isBuiltin(head MsgHead) bool {
+	if head.Flags&(MsgFlagStream|MsgFlagOneWay) != 0 {
+		return false
+	}
+	if head.Cmd == CmdDescribe {
+		return !s.option.DisableDescribe
+	}
+	return head.Cmd == CmdPing
+}
+
+//解析框架的消息
+func parseBuiltinMsg(head MsgHead, buf []byte, option *binary.Option) (IMsg, error) {
+	var msg interface {
+		IMsg
+		Unmarshal(buf []byte, option *binary.Option) error
+	}
+	switch head.Cmd {
+	case CmdPing:
+		msg = &PingMsg{}
+	case CmdDescribe:
+		msg = &DescribeMsg{}
+	default:
+		return nil, WrapRPCError(ErrCodeNotFound, ErrBadMsgParser,
+			"bad msg parser cmd:%+v, version:%+v", head.Cmd, head.Version)
+	}
+	err := msg.Unmarshal(buf, option)
+	if err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+//回复框架的消息 -- 心跳原样返回,服务描述返回注册的消息
+//不经过拦截器、限流与指标
+func (s *Service) replyBuiltin(conn net.Conn, writer *connWriter, head MsgHead, inMsg IMsg, buf []byte) ([]byte, error) {
+	outMsg := inMsg
+	if head.Cmd == CmdDescribe {
+		outMsg = s.Describe()
+	}
+	data, out, err := s.marshalOutMsg(head, outMsg, 0, buf)
+	if err != nil {
+		//描述过长等错误时返回错误消息
+		outMsg = &ErrorMsg{RPCError: *toRPCError(err, ErrCodeInternal)}
+		data, out, err = s.marshalOutMsg(head, outMsg, 0, buf)
+	}
+	if err != nil {
+		return buf, err
+	}
+	if writer != nil {
+		s.queueFrame(writer, data, out)
+		return s.bufferPool.Get().([]byte), nil
+	}
+	return out, s.sendBytes(conn, data)
+}
@@ -2,44 +2,85 @@ package fast_rpc
 
 import (
 	"context"
-	"fmt"
 	"github.com/pineal-niwan/busybox/buffer"
 	"github.com/pineal-niwan/busybox/util"
 	"go.uber.org/zap"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+//RPC调用接口 -- 生成的API代码通过此接口调用
+type Caller interface {
+	//多次调用
+	CallWithRetry(ctx context.Context, inMsg IMsg, retryTimes int) (IMsg, error)
+}
+
+//单向消息接口 -- 生成的Notify函数通过此接口发送
+type Notifier interface {
+	//发送单向消息,不等待返回
+	Notify(ctx context.Context, inMsg IMsg) error
+}
+
+//单向消息 -- msg定义中设置了oneWay的消息由生成的代码实现,只能通过Notify发送
+type OneWayMsg interface {
+	//是否是单向消息
+	OneWay() bool
+}
+
+//是否是单向消息
+func isOneWayMsg(msg IMsg) bool {
+	oneWay, ok := msg.(OneWayMsg)
+	return ok && oneWay.OneWay()
+}
+
 type Cli struct {
 	//参数
 	*CliOption
 	//日志
 	logger *zap.Logger
+	//服务地址
+	address string
 	//连接池
 	connPool *util.NetPool
 	//缓冲池
 	bufferPool *sync.Pool
 	//消息解析
 	msgParseHash map[uint32]MsgParseHandler
+	//请求编号
+	seq uint32
+	//熔断器
+	breaker *circuitBreaker
+	//服务端能解压的算法 -- 从返回的v2消息头中得到
+	peerAccept uint32
 }
 
+//新建客户端 -- address可以是host:port或unix:///path/to.sock,格式见util.ParseAddress
 func NewCli(
 	ctx context.Context,
 	address string,
 	poolSize int,
 	option *CliOption,
 	msgParseHash map[uint32]MsgParseHandler) (*Cli, error) {
-	logger, err := zap.NewProduction()
+	logger, err := option.newLogger()
 	if err != nil {
 		return nil, err
 	}
-	netDialer := &net.Dialer{
-		KeepAlive: 5 * time.Minute, //5分钟
-	}
-	connPool, err := util.NewPool(ctx, poolSize, netDialer, address)
-	if err != nil {
-		return nil, err
+	return newCli(ctx, address, poolSize, option, msgParseHash, logger)
+}
+
+//新建客户端 -- 使用指定的日志
+func newCli(
+	ctx context.Context,
+	address string,
+	poolSize int,
+	option *CliOption,
+	msgParseHash map[uint32]MsgParseHandler,
+	logger *zap.Logger) (*Cli, error) {
+	var handshake util.HandshakeFunc
+	if option.Authenticator != nil {
+		handshake = option.Authenticator.Handshake
 	}
 
 	bufferPool := &sync.Pool{
@@ -51,24 +92,145 @@ func NewCli(
 	cli := &Cli{
 		CliOption:    option,
 		logger:       logger,
-		connPool:     connPool,
+		address:      address,
 		bufferPool:   bufferPool,
 		msgParseHash: msgParseHash,
+		breaker:      newCircuitBreaker(option.Breaker),
+	}
+
+	//连接池的心跳 -- 在后台检查时调用,连接池建立前cli已经初始化
+	var ping util.PingFunc
+	if option.PingInterval > 0 {
+		ping = cli.ping
+	}
+	//服务暂时不可用时连接池也能建立,连接在调用时按需建立
+	connPool, err := util.NewPoolWithOption(ctx, &util.PoolOption{
+		Dialer:              option.dialer(),
+		Address:             address,
+		TLSConfig:           option.TLSConfig,
+		Handshake:           handshake,
+		MinSize:             option.PoolMinSize,
+		MaxSize:             poolSize,
+		MaxLifetime:         option.PoolMaxLifetime,
+		MaxIdleTime:         option.PoolMaxIdleTime,
+		HealthCheckInterval: option.PoolHealthCheckInterval,
+		Ping:                ping,
+		PingInterval:        option.PingInterval,
+		PingTimeout:         option.PingTimeout,
+	})
+	if err != nil {
+		return nil, err
 	}
+	cli.connPool = connPool
 	return cli, nil
 }
 
+//熔断状态 -- 没有设置熔断参数时总是BreakerClosed
+func (cli *Cli) BreakerState() BreakerState {
+	return cli.breaker.getState()
+}
+
+//关闭客户端 -- 关闭连接池
+func (cli *Cli) Close() error {
+	return cli.connPool.Close()
+}
+
+//多次调用 -- 经过拦截器后调用
+func (cli *Cli) CallWithRetry(ctx context.Context, inMsg IMsg, retryTimes int) (outMsg IMsg, err error) {
+	//单向消息不会有返回,不能调用
+	if isOneWayMsg(inMsg) {
+		return nil, ErrOneWayCall
+	}
+	if cli.Metrics != nil {
+		start := time.Now()
+		defer func() {
+			cli.Metrics.observeCall(inMsg, err, time.Since(start))
+		}()
+	}
+	cli.RetryBudget.deposit()
+	invoker := func(ctx context.Context, inMsg IMsg) (IMsg, error) {
+		outMsg, _, err := cli.callWithRetry(ctx, inMsg, retryTimes)
+		return outMsg, err
+	}
+	if len(cli.Interceptors) == 0 {
+		return invoker(ctx, inMsg)
+	}
+	return chainClientInterceptors(cli.Interceptors, newCallHead(inMsg), invoker)(ctx, inMsg)
+}
+
+//发送单向消息 -- 服务端处理后不回复,只有发送失败时返回错误,不重试
+func (cli *Cli) Notify(ctx context.Context, inMsg IMsg) (err error) {
+	if cli.Metrics != nil {
+		start := time.Now()
+		defer func() {
+			cli.Metrics.observeCall(inMsg, err, time.Since(start))
+		}()
+	}
+	if len(cli.Interceptors) == 0 {
+		return cli.notify(ctx, inMsg)
+	}
+	//经过拦截器,没有返回的消息
+	_, err = chainClientInterceptors(cli.Interceptors, newCallHead(inMsg),
+		func(ctx context.Context, inMsg IMsg) (IMsg, error) {
+			return nil, cli.notify(ctx, inMsg)
+		})(ctx, inMsg)
+	return err
+}
+
+//发送单向消息
+func (cli *Cli) notify(ctx context.Context, inMsg IMsg) error {
+	//熔断中直接拒绝
+	err := cli.breaker.allow()
+	if err != nil {
+		cli.Metrics.observeBreakerReject(cli.address)
+		return err
+	}
+	conn, err := cli.connPool.Get(ctx)
+	if err != nil {
+		cli.breaker.record(ctx, err, true)
+		return err
+	}
+	buf := cli.bufferPool.Get().([]byte)
+
+	_, callRet := cli.sendWithConn(ctx, conn, inMsg, MsgFlagOneWay, buf)
+	cli.breaker.record(ctx, callRet.err, callRet.needResetConn)
+	//归还可复用的缓冲区
+	if len(callRet.buf) <= cli.BufferRecycleSize {
+		cli.bufferPool.Put(callRet.buf)
+	}
+	//归还连接,不可用的连接直接丢弃
+	if callRet.needResetConn {
+		conn.Discard()
+	} else {
+		conn.Close()
+	}
+	return callRet.err
+}
+
 //多次调用
-func (cli *Cli) CallWithRetry(ctx context.Context, inMsg IMsg, retryTimes int) (IMsg, error) {
+//返回值 (IMsg -- 返回的消息 bool -- 失败是否由连接引起 error -- 错误)
+func (cli *Cli) callWithRetry(ctx context.Context, inMsg IMsg, retryTimes int) (IMsg, bool, error) {
 	var conn *util.Conn
 	var callRet *_CallRet
 	var err error
+	//连接是否已不可用
+	var broken bool
+
+	//熔断中直接拒绝
+	err = cli.breaker.allow()
+	if err != nil {
+		cli.Metrics.observeBreakerReject(cli.address)
+		return nil, true, err
+	}
 
 	//先去连接池拿连接
+	waitStart := time.Now()
 	conn, err = cli.connPool.Get(ctx)
+	cli.Metrics.observePoolWait(cli.address, time.Since(waitStart))
 	if err != nil {
 		//拿不到连接，直接退出
-		return nil, err
+		cli.breaker.record(ctx, err, true)
+		return nil, ctx.Err() == nil, err
 	}
 
 	//拿到连接后才开始分配缓冲区
@@ -84,40 +246,64 @@ func (cli *Cli) CallWithRetry(ctx context.Context, inMsg IMsg, retryTimes int) (
 				zap.Error(panicErr.Err))
 			cli.logger.Error("client rpc panic stack:",
 				zap.String("stack", string(panicErr.Stack())))
+			//释放半开状态的探测名额
+			cli.breaker.cancel()
 		}
 		//归还可复用的缓冲区
 		if len(buf) <= cli.BufferRecycleSize {
 			cli.bufferPool.Put(buf)
 		}
-		//归还连接
-		conn.Close()
+		//归还连接,不可用的连接直接丢弃
+		if broken {
+			conn.Discard()
+		} else {
+			conn.Close()
+		}
 	}()
 
 	callRet = cli.callWithConn(ctx, conn, inMsg, buf)
+	cli.breaker.record(ctx, callRet.err, callRet.needResetConn)
 	if callRet.err == nil {
 		//一次调用就成功了
-		return callRet.msg, callRet.err
+		return callRet.msg, false, nil
 	}
 
 	if !callRet.needResetConn {
 		//逻辑错误 -- 重连也是枉然
-		return nil, callRet.err
+		return nil, false, callRet.err
 	}
+	//重试次数用完时返回最后一次调用的错误
+	err = callRet.err
 
+	broken = true
 	for i := 0; i < retryTimes; i++ {
-		if cli.RetreatTime > 0 {
-			//暂时等待
-			time.Sleep(cli.RetreatTime * time.Duration(i+1))
+		//申请重试预算并退避等待
+		retry, retryErr := cli.beforeRetry(ctx, inMsg, i)
+		if !retry {
+			if retryErr != nil {
+				err = retryErr
+			}
+			break
 		}
+		retryErr = cli.breaker.allow()
+		if retryErr != nil {
+			cli.Metrics.observeBreakerReject(cli.address)
+			err = retryErr
+			break
+		}
+		cli.Metrics.observeReconnect(cli.address)
 		err = conn.Renew(ctx)
 		if err != nil {
+			cli.breaker.record(ctx, err, true)
 			continue
 		}
 		//走到这里表明重连成功
 		//继续调用
 		callRet = cli.callWithConn(ctx, conn, inMsg, buf)
+		cli.breaker.record(ctx, callRet.err, callRet.needResetConn)
+		broken = callRet.needResetConn
 		if callRet.err == nil {
-			return callRet.msg, callRet.err
+			return callRet.msg, false, nil
 		} else {
 			//继续调用失败
 			if callRet.needResetConn {
@@ -125,15 +311,15 @@ func (cli *Cli) CallWithRetry(ctx context.Context, inMsg IMsg, retryTimes int) (
 				err = callRet.err
 				continue
 			} else {
-				return nil, callRet.err
+				return nil, false, callRet.err
 			}
 		}
 	}
 
 	if err != nil {
-		return nil, err
+		return nil, ctx.Err() == nil, err
 	} else {
-		return nil, ErrUnknown
+		return nil, true, ErrUnknown
 	}
 }
 
@@ -156,70 +342,102 @@ func (ret *_CallRet) set(msg IMsg, err error, needResetConn bool, buf []byte) *_
 	return ret
 }
 
-//调用RPC - 带conn
-//返回值 (IMsg -- 返回的消息 error-错误 bool-是否需要重置连接)
-func (cli *Cli) callWithConn(ctx context.Context, conn net.Conn, inMsg IMsg, buf []byte) *_CallRet {
-	var err error
-	var size int
-
+//序列化并发送请求 -- 返回请求编号
+func (cli *Cli) sendWithConn(ctx context.Context, conn net.Conn, inMsg IMsg, flags uint8, buf []byte) (uint32, *_CallRet) {
 	callRet := &_CallRet{}
 
 	/***********************序列化消息***************/
-	size, buf, err = inMsg.Marshal(buf, cli.Option)
+	size, buf, err := inMsg.Marshal(buf, cli.Option)
 	if err != nil {
-		callRet.msg = nil
-		callRet.err = err
-		return callRet.set(nil, err, false, buf)
+		return 0, callRet.set(nil, err, false, buf)
 	}
 
 	if size > cli.MaxMsgSize {
-		return callRet.set(
+		return 0, callRet.set(
 			nil,
-			fmt.Errorf("rpc client too long msg size:%+v", size),
+			WrapRPCError(ErrCodeOverflow, ErrMsgTooLarge, "rpc client too long msg size:%+v", size),
 			false,
 			buf)
 	}
+	//回填消息头,写入请求编号与剩余的超时时间
+	timeout, err := timeoutFromContext(ctx)
+	if err != nil {
+		return 0, callRet.set(nil, err, false, buf)
+	}
+	seq := atomic.AddUint32(&cli.seq, 1)
+	head := newMsgHead(inMsg, size, seq)
+	head.Timeout = timeout
+	head.Flags = flags
+	data, err := cli.encodeRequest(buf, size, head, uint8(atomic.LoadUint32(&cli.peerAccept)))
+	if err != nil {
+		return 0, callRet.set(nil, err, false, buf)
+	}
 
 	/***********************发送消息体***************/
 	deadline, ok := ctx.Deadline()
 	if ok {
 		err = conn.SetDeadline(deadline)
 		if err != nil {
-			return callRet.set(nil, err, true, buf)
+			return 0, callRet.set(nil, err, true, buf)
 		}
 	}
 
-	err = util.NetSendBytes(conn, buf[:size])
+	err = util.NetSendBytes(conn, data)
 	if err != nil {
-		return callRet.set(nil, err, true, buf)
+		return 0, callRet.set(nil, err, true, buf)
 	}
+	return seq, callRet.set(nil, nil, false, buf)
+}
 
-	/***********************接收消息头***************/
+//调用RPC - 带conn
+//返回值 (IMsg -- 返回的消息 error-错误 bool-是否需要重置连接)
+func (cli *Cli) callWithConn(ctx context.Context, conn net.Conn, inMsg IMsg, buf []byte) *_CallRet {
+	var err error
+	var size int
 	var head MsgHead
-	//接收消息头字节流
-	err = util.NetReadBytes(conn, buf[:MsgHeadSize])
-	if err != nil {
-		cli.logger.Error("rpc client receive head error",
-			zap.Error(err))
-		return callRet.set(nil, err, true, buf)
+
+	seq, callRet := cli.sendWithConn(ctx, conn, inMsg, 0, buf)
+	if callRet.err != nil {
+		return callRet
 	}
-	//解析消息头
-	head, err = UnmarshalMsgHead(buf, cli.Option)
+	buf = callRet.buf
+
+	/***********************接收消息头***************/
+	//接收并解析消息头
+	head, err = readMsgHead(conn, buf, cli.Option, cli.LegacyHead)
 	if err != nil {
-		cli.logger.Error("rpc client parse head error",
-			zap.Error(err))
+		//服务端关闭了空闲连接,调用方会得到错误并重试
+		if isPeerClosed(err) {
+			cli.logger.Debug("rpc client peer closed",
+				callFields(cli.address, inMsg, zap.Error(err))...)
+		} else {
+			cli.logger.Error("rpc client receive head error",
+				callFields(cli.address, inMsg, zap.Error(err))...)
+		}
 		return callRet.set(nil, err, true, buf)
 	}
+	//记录服务端能解压的算法
+	if head.HeadVer == MsgHeadFramed {
+		atomic.StoreUint32(&cli.peerAccept, uint32(head.Accept))
+	}
+	//返回的不是本次请求的消息,连接上的数据已经错乱 -- 旧版本消息头没有请求编号
+	if head.HeadVer == MsgHeadFramed && head.Seq != seq {
+		cli.logger.Error("rpc client seq mismatch",
+			callFields(cli.address, inMsg,
+				zap.Uint32("expect", seq),
+				zap.Uint32("seq", head.Seq))...)
+		return callRet.set(nil, ErrSeqMismatch, true, buf)
+	}
 
 	/***********************接收消息体***************/
 	//检查消息体大小
 	size = int(head.Size)
 	if size == 0 || size > cli.MaxMsgSize {
 		cli.logger.Error("client rpc size of outMsg error",
-			zap.Int("msgSize", size))
+			callFields(cli.address, inMsg, zap.Int("msgSize", size))...)
 		return callRet.set(
 			nil,
-			fmt.Errorf("msg size out of range :%+v", size),
+			WrapRPCError(ErrCodeOverflow, ErrMsgTooLarge, "msg size out of range :%+v", size),
 			true,
 			buf)
 	}
@@ -228,17 +446,23 @@ func (cli *Cli) callWithConn(ctx context.Context, conn net.Conn, inMsg IMsg, buf
 	//接收消息体内容字节流
 	err = util.NetReadBytes(conn, buf[MsgHeadSize:MsgHeadSize+size])
 	if err != nil {
-		cli.logger.Error("clint rpc receive content error",
-			zap.Error(err))
+		cli.logger.Error("client rpc receive content error",
+			callFields(cli.address, inMsg, zap.Error(err))...)
 		return callRet.set(nil, err, true, buf)
 	}
 
 	/***********************解析返回消息体*************/
-	//解析消息内容
-	outMsg, err := cli.ParseMsg(head, buf[MsgHeadSize:MsgHeadSize+size])
+	//解压并解析消息内容 -- 错误消息转化为RPCError,连接仍然可用,不重试
+	body, err := decodeBody(head, buf[MsgHeadSize:MsgHeadSize+size], cli.MaxMsgSize, cli.Compression.accept())
+	if err != nil {
+		cli.logger.Error("client decode content error",
+			callFields(cli.address, inMsg, zap.Error(err))...)
+		return callRet.set(nil, err, false, buf)
+	}
+	outMsg, err := cli.ParseMsg(head, body)
 	if err != nil {
 		cli.logger.Error("client parse content error",
-			zap.Error(err))
+			callFields(cli.address, inMsg, zap.Error(err))...)
 		return callRet.set(nil, err, false, buf)
 	}
 	return callRet.set(outMsg, nil, false, buf)
@@ -246,14 +470,5 @@ func (cli *Cli) callWithConn(ctx context.Context, conn net.Conn, inMsg IMsg, buf
 
 //解析消息
 func (cli *Cli) ParseMsg(head MsgHead, buf []byte) (IMsg, error) {
-	if cli.msgParseHash == nil {
-		return nil, ErrBadMsgParser
-	}
-
-	parseHandler, ok := cli.msgParseHash[head.GetCode()]
-	if !ok || parseHandler == nil {
-		err := fmt.Errorf("bad msg parser cmd:%+v, version:%+v", head.Cmd, head.Version)
-		return nil, err
-	}
-	return parseHandler(buf, cli.Option)
+	return parseReply(cli.msgParseHash, head, buf, cli.Option)
 }
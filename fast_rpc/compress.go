@@ -0,0 +1,204 @@
+package fast_rpc
+
+import (
+	"bytes"
+	"compress/flate"
+	"github.com/pineal-niwan/busybox/binary"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"sync"
+)
+
+const (
+	//不压缩
+	CodecNone = 0
+	//compress/flate
+	CodecFlate = 1
+
+	//压缩算法编号的最大值 -- Accept按位表示,最多8种
+	maxCodec = 8
+)
+
+//压缩算法
+type Codec interface {
+	//压缩src
+	Compress(src []byte) ([]byte, error)
+	//解压src,解压后超过maxSize时返回错误
+	Decompress(src []byte, maxSize int) ([]byte, error)
+}
+
+var (
+	codecLock sync.RWMutex
+	//编号 -> 压缩算法
+	codecHash = map[uint8]Codec{
+		CodecFlate: newFlateCodec(flate.DefaultCompression),
+	}
+)
+
+//注册压缩算法 -- 编号为1到8,已有的编号会被替换
+//需要在Service与Cli使用前注册,通信双方对同一编号要使用相同的算法
+func RegisterCodec(id uint8, codec Codec) error {
+	if id == CodecNone || id > maxCodec || codec == nil {
+		return ErrInvalidOption
+	}
+	codecLock.Lock()
+	codecHash[id] = codec
+	codecLock.Unlock()
+	return nil
+}
+
+func getCodec(id uint8) (Codec, bool) {
+	codecLock.RLock()
+	codec, ok := codecHash[id]
+	codecLock.RUnlock()
+	return codec, ok
+}
+
+//压缩算法编号对应Accept中的位
+func codecBit(id uint8) uint8 {
+	return 1 << (id - 1)
+}
+
+//flate压缩
+type flateCodec struct {
+	level      int
+	writerPool sync.Pool
+}
+
+func newFlateCodec(level int) *flateCodec {
+	return &flateCodec{
+		level: level,
+	}
+}
+
+func (c *flateCodec) Compress(src []byte) ([]byte, error) {
+	var out bytes.Buffer
+	w, ok := c.writerPool.Get().(*flate.Writer)
+	if ok {
+		w.Reset(&out)
+	} else {
+		var err error
+		w, err = flate.NewWriter(&out, c.level)
+		if err != nil {
+			return nil, err
+		}
+	}
+	_, err := w.Write(src)
+	if err == nil {
+		err = w.Close()
+	}
+	c.writerPool.Put(w)
+	if err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+func (c *flateCodec) Decompress(src []byte, maxSize int) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(src))
+	defer r.Close()
+	//多读一个字节用于判断是否超长
+	out, err := ioutil.ReadAll(io.LimitReader(r, int64(maxSize)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(out) > maxSize {
+		return nil, WrapRPCError(ErrCodeOverflow, ErrMsgTooLarge, "msg size out of range after decompress, max:%+v", maxSize)
+	}
+	return out, nil
+}
+
+//能解压的压缩算法,按位表示
+func (option *CompressOption) accept() uint8 {
+	if option == nil {
+		return 0
+	}
+	var mask uint8
+	for _, id := range option.Codecs {
+		if _, ok := getCodec(id); ok {
+			mask |= codecBit(id)
+		}
+	}
+	return mask
+}
+
+//选择发送时使用的压缩算法 -- 按自己的优先顺序选择对方能解压的,消息体小于门槛时不压缩
+func (option *CompressOption) pick(peerAccept uint8, bodySize int) uint8 {
+	if option == nil || bodySize < option.Threshold {
+		return CodecNone
+	}
+	for _, id := range option.Codecs {
+		if peerAccept&codecBit(id) != 0 {
+			return id
+		}
+	}
+	return CodecNone
+}
+
+//回填消息头并得到要发送的数据
+//codec不为CodecNone时压缩消息体,压缩后没有变小时按原样发送
+//消息头带有MsgFlagBodyCRC标志时计算最终发送的消息体的校验值
+func encodeFrame(buf []byte, size int, head MsgHead, codec uint8, option *binary.Option) ([]byte, error) {
+	data := buf[:size]
+	if codec != CodecNone && head.HeadVer == MsgHeadFramed {
+		c, ok := getCodec(codec)
+		if !ok {
+			return nil, ErrBadCodec
+		}
+		compressed, err := c.Compress(buf[MsgHeadSize:size])
+		if err != nil {
+			return nil, err
+		}
+		if len(compressed) < size-MsgHeadSize {
+			data = make([]byte, MsgHeadSize+len(compressed))
+			copy(data[MsgHeadSize:], compressed)
+			head.Size = uint32(len(compressed))
+			head.Flags |= MsgFlagCompressed
+			head.Codec = codec
+		}
+	}
+	if head.Flags&MsgFlagBodyCRC != 0 {
+		head.BodyCRC = crc32.ChecksumIEEE(data[MsgHeadSize:])
+	}
+	err := PutMsgHead(data, head, option)
+	if err != nil {
+		return nil, err
+	}
+	return data[headOffset(head):], nil
+}
+
+//回填请求的消息头并得到要发送的数据
+//兼容模式下使用旧版本消息头,不压缩也不校验消息体; 否则按服务端能解压的算法压缩
+func (cliOption *CliOption) encodeRequest(buf []byte, size int, head MsgHead, peerAccept uint8) ([]byte, error) {
+	var codec uint8
+	if cliOption.LegacyHead {
+		head.HeadVer = MsgHeadLegacy
+	} else {
+		head.Accept = cliOption.Compression.accept()
+		codec = cliOption.Compression.pick(peerAccept, size-MsgHeadSize)
+		if cliOption.BodyChecksum {
+			head.Flags |= MsgFlagBodyCRC
+		}
+	}
+	return encodeFrame(buf, size, head, codec, cliOption.Option)
+}
+
+//校验并得到解压后的消息体
+//accept为自己能解压的压缩算法,不在其中的压缩算法即使已经注册也不解压
+func decodeBody(head MsgHead, body []byte, maxSize int, accept uint8) ([]byte, error) {
+	if head.Flags&MsgFlagBodyCRC != 0 && crc32.ChecksumIEEE(body) != head.BodyCRC {
+		return nil, ErrBadBodyChecksum
+	}
+	if head.Flags&MsgFlagCompressed == 0 {
+		return body, nil
+	}
+	if head.Codec == CodecNone || head.Codec > maxCodec || accept&codecBit(head.Codec) == 0 {
+		return nil, ErrBadCodec
+	}
+	c, ok := getCodec(head.Codec)
+	if !ok {
+		return nil, ErrBadCodec
+	}
+	return c.Decompress(body, maxSize)
+}
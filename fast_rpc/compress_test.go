@@ -0,0 +1,128 @@
+package fast_rpc
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestEncodeFrame(t *testing.T) {
+	option := &CompressOption{Codecs: []uint8{CodecFlate}, Threshold: 64}
+	body := bytes.Repeat([]byte("compress me "), 100)
+	buf := make([]byte, MsgHeadSize+len(body))
+	copy(buf[MsgHeadSize:], body)
+	head := MsgHead{HeadVer: MsgHeadFramed, Cmd: testCmdReq, Size: uint32(len(body))}
+
+	data, err := encodeFrame(buf, len(buf), head, option.pick(option.accept(), len(body)), testBinOption)
+	if err != nil {
+		t.Fatalf("encode frame error:%+v", err)
+	}
+	if len(data) >= len(buf) {
+		t.Fatalf("expect compressed frame, size:%d raw:%d", len(data), len(buf))
+	}
+	outHead, err := UnmarshalMsgHead(data, testBinOption)
+	if err != nil {
+		t.Fatalf("unmarshal head error:%+v", err)
+	}
+	if outHead.Flags&MsgFlagCompressed == 0 || outHead.Codec != CodecFlate || int(outHead.Size) != len(data)-MsgHeadSize {
+		t.Fatalf("unexpected head:%+v", outHead)
+	}
+	out, err := decodeBody(outHead, data[MsgHeadSize:], len(body), codecBit(CodecFlate))
+	if err != nil || !bytes.Equal(out, body) {
+		t.Fatalf("decode body error:%+v", err)
+	}
+	//解压后超长时报错
+	_, err = decodeBody(outHead, data[MsgHeadSize:], len(body)-1, codecBit(CodecFlate))
+	if err == nil {
+		t.Errorf("expect decompress overflow error")
+	}
+
+	//旧版本消息头不压缩
+	small := MsgHead{HeadVer: MsgHeadLegacy, Cmd: testCmdReq, Size: 8}
+	data, err = encodeFrame(make([]byte, MsgHeadSize+8), MsgHeadSize+8, small, CodecFlate, testBinOption)
+	if err != nil || len(data) != MsgHeadLegacySize+8 {
+		t.Fatalf("encode small frame, size:%d err:%+v", len(data), err)
+	}
+}
+
+func TestCompressNegotiation(t *testing.T) {
+	compression := &CompressOption{Codecs: []uint8{CodecFlate}, Threshold: 64}
+	option := testOption()
+	option.Compression = compression
+	_, address := startTestService(t, option)
+
+	cliOption := testCliOption()
+	cliOption.Compression = compression
+	cli, err := NewCli(context.Background(), address, 1, cliOption, testParseHash())
+	if err != nil {
+		t.Fatalf("new cli error:%+v", err)
+	}
+	defer cli.Close()
+	muxCli, err := NewMuxCli(context.Background(), address, cliOption, testParseHash())
+	if err != nil {
+		t.Fatalf("new mux cli error:%+v", err)
+	}
+	defer muxCli.Close()
+	//没有设置压缩的客户端不受影响
+	plainCli, err := NewCli(context.Background(), address, 1, testCliOption(), testParseHash())
+	if err != nil {
+		t.Fatalf("new cli error:%+v", err)
+	}
+	defer plainCli.Close()
+
+	text := strings.Repeat("hello compression ", 200)
+	for i := 0; i < 3; i++ {
+		outMsg, err := cli.CallWithRetry(context.Background(), &testMsg{cmd: testCmdReq, Text: text}, 0)
+		if err != nil || outMsg.(*testMsg).Text != text {
+			t.Fatalf("cli call, err:%+v", err)
+		}
+		outMsg, err = muxCli.Call(context.Background(), &testMsg{cmd: testCmdReq, Text: text})
+		if err != nil || outMsg.(*testMsg).Text != text {
+			t.Fatalf("mux cli call, err:%+v", err)
+		}
+		outMsg, err = plainCli.CallWithRetry(context.Background(), &testMsg{cmd: testCmdReq, Text: text}, 0)
+		if err != nil || outMsg.(*testMsg).Text != text {
+			t.Fatalf("plain cli call, err:%+v", err)
+		}
+	}
+	if cli.peerAccept != uint32(codecBit(CodecFlate)) || muxCli.peerAccept != uint32(codecBit(CodecFlate)) {
+		t.Errorf("expect peer accept learned, cli:%d mux:%d", cli.peerAccept, muxCli.peerAccept)
+	}
+}
+
+func TestCompressRejected(t *testing.T) {
+	//没有设置压缩的服务不接收压缩的请求消息
+	_, address := startTestService(t, testOption())
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatalf("dial error:%+v", err)
+	}
+	defer conn.Close()
+
+	msg := &testMsg{cmd: testCmdReq, Text: strings.Repeat("compress me ", 100)}
+	size, buf, err := msg.Marshal(make([]byte, 256), testBinOption)
+	if err != nil {
+		t.Fatalf("marshal error:%+v", err)
+	}
+	data, err := encodeFrame(buf, size, newMsgHead(msg, size, 1), CodecFlate, testBinOption)
+	if err != nil {
+		t.Fatalf("encode frame error:%+v", err)
+	}
+	_, err = conn.Write(data)
+	if err != nil {
+		t.Fatalf("write error:%+v", err)
+	}
+	_, _, err = readTestFrame(t, conn)
+	if CodeOf(err) != ErrCodeBadRequest {
+		t.Errorf("expect bad request error, got %+v", err)
+	}
+
+	//连接仍然可用
+	writeTestFrame(t, conn, &testMsg{cmd: testCmdReq, Text: "plain"}, 2)
+	_, outMsg, err := readTestFrame(t, conn)
+	if err != nil || testFrameText(outMsg) != "plain" {
+		t.Errorf("plain call after rejected, msg:%+v err:%+v", outMsg, err)
+	}
+}
@@ -0,0 +1,100 @@
+package fast_rpc
+
+import (
+	"context"
+	"crypto/tls"
+	"math"
+	"net"
+	"time"
+)
+
+//context中保存请求信息的key
+type requestInfoKey struct{}
+
+//请求信息
+type requestInfo struct {
+	//请求消息头
+	head MsgHead
+	//对端信息
+	peer *Peer
+}
+
+//对端信息
+type Peer struct {
+	//对端地址
+	Addr net.Addr
+	//TLS连接状态 -- 不是TLS连接时为nil
+	TLSState *tls.ConnectionState
+	//认证得到的身份 -- 没有设置认证时为空
+	AuthIdentity string
+}
+
+//对端身份 -- 优先使用认证得到的身份,其次是验证通过的客户端证书的CommonName,都没有时返回空
+func (peer *Peer) Identity() string {
+	if peer.AuthIdentity != "" {
+		return peer.AuthIdentity
+	}
+	if peer.TLSState == nil || len(peer.TLSState.VerifiedChains) == 0 {
+		return ""
+	}
+	chain := peer.TLSState.VerifiedChains[0]
+	if len(chain) == 0 {
+		return ""
+	}
+	return chain[0].Subject.CommonName
+}
+
+//带上请求信息的context
+func withRequestInfo(ctx context.Context, head MsgHead, peer *Peer) context.Context {
+	return context.WithValue(ctx, requestInfoKey{}, &requestInfo{
+		head: head,
+		peer: peer,
+	})
+}
+
+//从context中获取请求的消息头
+func MsgHeadFromContext(ctx context.Context) (MsgHead, bool) {
+	info, ok := ctx.Value(requestInfoKey{}).(*requestInfo)
+	if !ok {
+		return MsgHead{}, false
+	}
+	return info.head, true
+}
+
+//从context中获取对端信息
+func PeerFromContext(ctx context.Context) (*Peer, bool) {
+	info, ok := ctx.Value(requestInfoKey{}).(*requestInfo)
+	if !ok || info.peer == nil {
+		return nil, false
+	}
+	return info.peer, true
+}
+
+//计算消息头中带的超时时间(毫秒)
+//ctx没有deadline时返回0,表示不超时; 已经超时时返回ctx的错误
+func timeoutFromContext(ctx context.Context) (uint32, error) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return 0, nil
+	}
+	remain := time.Until(deadline)
+	if remain <= 0 {
+		return 0, context.DeadlineExceeded
+	}
+	//不足1毫秒按1毫秒算
+	ms := (remain + time.Millisecond - 1) / time.Millisecond
+	if ms > math.MaxUint32 {
+		ms = math.MaxUint32
+	}
+	return uint32(ms), nil
+}
+
+//新建请求的context -- 消息头带了超时时间时,以收到消息头的时间开始计算deadline
+func newRequestContext(connCtx context.Context, head MsgHead, peer *Peer, recvTime time.Time) (context.Context, context.CancelFunc) {
+	ctx := withRequestInfo(connCtx, head, peer)
+	if head.Timeout == 0 {
+		return context.WithCancel(ctx)
+	}
+	deadline := recvTime.Add(time.Duration(head.Timeout) * time.Millisecond)
+	return context.WithDeadline(ctx, deadline)
+}
@@ -0,0 +1,241 @@
+package fast_rpc
+
+import (
+	"context"
+	"github.com/pineal-niwan/busybox/binary"
+	"sort"
+)
+
+const (
+	//有消息处理函数
+	MsgKindHandler = "handler"
+	//有流处理函数
+	MsgKindStream = "stream"
+	//只能解析,例如结果消息
+	MsgKindMsg = "msg"
+)
+
+//属性描述
+type FieldDesc struct {
+	//属性名
+	Name string
+	//属性类型 -- 与代码生成定义中的typeDefine相同
+	Type string
+	//注释
+	Comment string
+}
+
+//消息描述
+type MsgDesc struct {
+	//消息编号
+	Cmd uint16
+	//消息版本
+	Version uint16
+	//处理类型 -- MsgKindHandler、MsgKindStream或MsgKindMsg,注册描述时不需要设置
+	Kind string
+	//消息名称 -- 生成的代码提供描述时才有
+	Name string
+	//注释
+	Comment string
+	//属性列表
+	Fields []FieldDesc
+}
+
+//服务描述 -- 请求时为空,返回服务注册的消息,按cmd与version排序
+type DescribeMsg struct {
+	Msgs []MsgDesc
+}
+
+//获取命令行
+func (msg *DescribeMsg) GetCmd() uint16 {
+	return CmdDescribe
+}
+
+//获取版本号
+func (msg *DescribeMsg) GetVersion() uint16 {
+	return 0
+}
+
+//获取Code
+func (msg *DescribeMsg) GetCode() uint32 {
+	return uint32(CmdDescribe)
+}
+
+//序列化
+func (msg *DescribeMsg) Marshal(buf []byte, option *binary.Option) (int, []byte, error) {
+	writer, err := binary.NewWriteBinaryHandler(buf, option)
+	if err != nil {
+		return 0, nil, err
+	}
+	//先跳过消息头
+	err = writer.MovePos(uint32(MsgHeadSize))
+	if err != nil {
+		return 0, nil, err
+	}
+	//写消息内容
+	err = writer.WriteArrayLen(len(msg.Msgs))
+	if err != nil {
+		return 0, nil, err
+	}
+	for _, desc := range msg.Msgs {
+		err = writeMsgDesc(writer, desc)
+		if err != nil {
+			return 0, nil, err
+		}
+	}
+	size := writer.Len()
+	//消息头由框架回填
+	return size, writer.Data(), nil
+}
+
+//反序列化
+func (msg *DescribeMsg) Unmarshal(buf []byte, option *binary.Option) error {
+	reader, err := binary.NewReadBinaryHandler(buf, option)
+	if err != nil {
+		return err
+	}
+	size, err := reader.ReadArrayLen()
+	if err != nil {
+		return err
+	}
+	msg.Msgs = make([]MsgDesc, size)
+	for i := range msg.Msgs {
+		msg.Msgs[i], err = readMsgDesc(reader)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//序列化消息描述
+func writeMsgDesc(writer *binary.BinaryHandler, desc MsgDesc) error {
+	err := writer.WriteUint16(desc.Cmd)
+	if err != nil {
+		return err
+	}
+	err = writer.WriteUint16(desc.Version)
+	if err != nil {
+		return err
+	}
+	for _, s := range []string{desc.Kind, desc.Name, desc.Comment} {
+		err = writer.WriteString(s)
+		if err != nil {
+			return err
+		}
+	}
+	err = writer.WriteArrayLen(len(desc.Fields))
+	if err != nil {
+		return err
+	}
+	for _, field := range desc.Fields {
+		for _, s := range []string{field.Name, field.Type, field.Comment} {
+			err = writer.WriteString(s)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+//反序列化消息描述
+func readMsgDesc(reader *binary.BinaryHandler) (desc MsgDesc, err error) {
+	desc.Cmd, err = reader.ReadUint16()
+	if err != nil {
+		return
+	}
+	desc.Version, err = reader.ReadUint16()
+	if err != nil {
+		return
+	}
+	for _, s := range []*string{&desc.Kind, &desc.Name, &desc.Comment} {
+		*s, err = reader.ReadString()
+		if err != nil {
+			return
+		}
+	}
+	size, err := reader.ReadArrayLen()
+	if err != nil {
+		return
+	}
+	desc.Fields = make([]FieldDesc, size)
+	for i := range desc.Fields {
+		field := &desc.Fields[i]
+		for _, s := range []*string{&field.Name, &field.Type, &field.Comment} {
+			*s, err = reader.ReadString()
+			if err != nil {
+				return
+			}
+		}
+	}
+	return
+}
+
+//添加消息的描述 -- 生成的代码中的InitMsgSchemas
+func (s *Service) AddMsgSchemas(schemas []MsgDesc) {
+	for _, desc := range schemas {
+		s.schemaHash[uint32(desc.Cmd)|(uint32(desc.Version)<<16)] = desc
+	}
+}
+
+//服务描述 -- 注册了解析、处理函数或描述的消息
+func (s *Service) Describe() *DescribeMsg {
+	descHash := make(map[uint32]MsgDesc)
+	add := func(code uint32, kind string) {
+		desc, ok := descHash[code]
+		if !ok {
+			desc, ok = s.schemaHash[code]
+			if !ok {
+				desc = MsgDesc{Cmd: uint16(code), Version: uint16(code >> 16)}
+			}
+		}
+		//处理函数优先于只能解析
+		if desc.Kind == "" || desc.Kind == MsgKindMsg {
+			desc.Kind = kind
+		}
+		descHash[code] = desc
+	}
+	for code := range s.schemaHash {
+		add(code, MsgKindMsg)
+	}
+	for code := range s.msgParseHash {
+		add(code, MsgKindMsg)
+	}
+	for code, handler := range s.msgHandlerHash {
+		if handler != nil {
+			add(code, MsgKindHandler)
+		}
+	}
+	for code, handler := range s.streamHandlerHash {
+		if handler != nil {
+			add(code, MsgKindStream)
+		}
+	}
+
+	msg := &DescribeMsg{Msgs: make([]MsgDesc, 0, len(descHash))}
+	for _, desc := range descHash {
+		msg.Msgs = append(msg.Msgs, desc)
+	}
+	sort.Slice(msg.Msgs, func(i, j int) bool {
+		a, b := msg.Msgs[i], msg.Msgs[j]
+		if a.Cmd != b.Cmd {
+			return a.Cmd < b.Cmd
+		}
+		return a.Version < b.Version
+	})
+	return msg
+}
+
+//查询服务描述
+func Describe(ctx context.Context, cli Caller) (*DescribeMsg, error) {
+	outMsg, err := cli.CallWithRetry(ctx, &DescribeMsg{}, 0)
+	if err != nil {
+		return nil, err
+	}
+	msg, ok := outMsg.(*DescribeMsg)
+	if !ok {
+		return nil, ErrNotExpectMsg
+	}
+	return msg, nil
+}
@@ -0,0 +1,62 @@
+package fast_rpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestDescribe(t *testing.T) {
+	service, address := startTestService(t, testOption())
+	service.AddMsgSchemas([]MsgDesc{{
+		Cmd:     testCmdReq,
+		Name:    "Echo",
+		Comment: "回显",
+		Fields:  []FieldDesc{{Name: "Text", Type: "string", Comment: "文本"}},
+	}})
+
+	cli, err := NewCli(context.Background(), address, 1, testCliOption(), testParseHash())
+	if err != nil {
+		t.Fatalf("new cli error:%+v", err)
+	}
+	defer cli.Close()
+	muxCli, err := NewMuxCli(context.Background(), address, testCliOption(), testParseHash())
+	if err != nil {
+		t.Fatalf("new mux cli error:%+v", err)
+	}
+	defer muxCli.Close()
+
+	for _, caller := range []Caller{cli, muxCli} {
+		desc, err := Describe(context.Background(), caller)
+		if err != nil {
+			t.Fatalf("describe error:%+v", err)
+		}
+		var list []string
+		for _, msg := range desc.Msgs {
+			list = append(list, fmt.Sprintf("%d:%s:%s", msg.Cmd, msg.Kind, msg.Name))
+		}
+		expect := "1:handler:Echo,2:msg:,3:handler:,4:handler:,5:stream:,6:handler:"
+		if strings.Join(list, ",") != expect {
+			t.Errorf("unexpected describe:%v", list)
+		}
+		if fields := desc.Msgs[0].Fields; len(fields) != 1 || fields[0] != (FieldDesc{Name: "Text", Type: "string", Comment: "文本"}) {
+			t.Errorf("unexpected fields:%+v", fields)
+		}
+	}
+
+	//关闭服务描述后作为未知的消息
+	option := testOption()
+	option.DisableDescribe = true
+	_, address = startTestService(t, option)
+	hiddenCli, err := NewCli(context.Background(), address, 1, testCliOption(), testParseHash())
+	if err != nil {
+		t.Fatalf("new cli error:%+v", err)
+	}
+	defer hiddenCli.Close()
+	_, err = Describe(context.Background(), hiddenCli)
+	if !errors.Is(err, ErrCodeNotFound) {
+		t.Errorf("expect not found, got %+v", err)
+	}
+}
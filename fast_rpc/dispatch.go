@@ -0,0 +1,184 @@
+package fast_rpc
+
+import (
+	"context"
+	"github.com/pineal-niwan/busybox/util"
+	"go.uber.org/zap"
+	"net"
+	"sync"
+)
+
+//异步处理任务
+type asyncJob struct {
+	//请求的context
+	ctx context.Context
+	//处理完成后释放context
+	cancel context.CancelFunc
+	//请求消息头
+	head MsgHead
+	//请求消息
+	inMsg IMsg
+	//请求消息解析的错误
+	parseErr error
+	//所属连接的发送者
+	writer *connWriter
+	//处理完成后释放准入
+	release func()
+}
+
+//连接的发送者 -- 每个连接一个发送协程,按处理完成的顺序发送结果消息
+type connWriter struct {
+	conn net.Conn
+	//等待发送的结果消息
+	outChan chan outFrame
+	//还未处理完的任务
+	pending sync.WaitGroup
+	//发送协程退出通知
+	exit chan struct{}
+}
+
+//等待发送的结果消息
+type outFrame struct {
+	//要发送的数据
+	data []byte
+	//发送后回收的缓冲区
+	buf []byte
+}
+
+//启动处理协程
+func (s *Service) startWorkers() {
+	s.jobChan = make(chan *asyncJob, s.option.WorkerQueueSize)
+	for i := 0; i < s.option.WorkerNum; i++ {
+		go s.workerLoop()
+	}
+}
+
+//停止处理协程 -- 所有连接退出后调用
+func (s *Service) stopWorkers() {
+	s.Lock()
+	defer s.Unlock()
+	if s.jobChan != nil && !s.workersStopped {
+		s.workersStopped = true
+		close(s.jobChan)
+	}
+}
+
+//处理协程 -- 处理任务并将结果交给连接的发送协程
+func (s *Service) workerLoop() {
+	buf := s.bufferPool.Get().([]byte)
+	for job := range s.jobChan {
+		buf = s.handleJob(job, buf)
+		if buf == nil {
+			//缓冲区交给了发送协程,重新取一个
+			buf = s.bufferPool.Get().([]byte)
+		} else if len(buf) > s.option.BufferRecycleSize {
+			//缓冲区过大，resize
+			buf = make([]byte, s.option.BufferSize)
+		}
+	}
+}
+
+//处理任务
+//成功时缓冲区交由发送协程发送并归还,返回nil
+func (s *Service) handleJob(job *asyncJob, buf []byte) (retBuf []byte) {
+	var data []byte
+	var err error
+
+	retBuf = buf
+	defer func() {
+		panicErr := util.Recover(recover())
+		if panicErr != nil {
+			s.logPanic(panicErr)
+			job.writer.conn.Close()
+		}
+		job.cancel()
+		job.release()
+		job.writer.pending.Done()
+	}()
+
+	if job.head.Flags&MsgFlagOneWay != 0 {
+		//单向消息不回复
+		s.handleOneWay(job.ctx, job.head, job.inMsg, job.parseErr)
+		return buf
+	}
+	data, buf, err = s.handleMsgToBytes(job.ctx, job.head, job.inMsg, job.parseErr, buf)
+	if err != nil {
+		//出错关闭连接,读循环随之退出
+		job.writer.conn.Close()
+		return buf
+	}
+	s.queueFrame(job.writer, data, buf)
+	return nil
+}
+
+//将结果消息交给发送协程
+//发送队列满时说明对端没有读取,丢弃消息并关闭连接,不阻塞处理协程与读协程
+func (s *Service) queueFrame(writer *connWriter, data []byte, buf []byte) {
+	select {
+	case writer.outChan <- outFrame{data: data, buf: buf}:
+	default:
+		s.logger.Warn("service write queue full, close connection",
+			remoteField(writer.conn.RemoteAddr()))
+		writer.conn.Close()
+		if len(buf) <= s.option.BufferRecycleSize {
+			s.bufferPool.Put(buf)
+		}
+	}
+}
+
+//新建连接的发送者并启动发送协程
+func (s *Service) newConnWriter(conn net.Conn) *connWriter {
+	writer := &connWriter{
+		conn:    conn,
+		outChan: make(chan outFrame, s.option.writeQueueSize()),
+		exit:    make(chan struct{}),
+	}
+	go s.writeLoop(writer)
+	return writer
+}
+
+//提交任务 -- 队列满时阻塞,以限制读取速度
+func (s *Service) dispatch(ctx context.Context, cancel context.CancelFunc, writer *connWriter, head MsgHead, inMsg IMsg, parseErr error, release func()) {
+	writer.pending.Add(1)
+	s.jobChan <- &asyncJob{
+		ctx:      ctx,
+		cancel:   cancel,
+		head:     head,
+		inMsg:    inMsg,
+		parseErr: parseErr,
+		writer:   writer,
+		release:  release,
+	}
+}
+
+//关闭连接的发送者 -- 等待所有任务处理完成并发送后返回
+func (writer *connWriter) close() {
+	writer.pending.Wait()
+	close(writer.outChan)
+	<-writer.exit
+}
+
+//发送协程
+func (s *Service) writeLoop(writer *connWriter) {
+	var err error
+
+	defer close(writer.exit)
+	for frame := range writer.outChan {
+		if err == nil {
+			err = s.writeWithTimeout(writer.conn, frame.data)
+			if err != nil {
+				if !isTimeout(err) {
+					s.logger.Error("service send out msg error",
+						remoteField(writer.conn.RemoteAddr()),
+						zap.Error(err))
+				}
+				//关闭连接,读循环随之退出,剩余的消息只回收不发送
+				writer.conn.Close()
+			}
+		}
+		//归还缓存
+		if len(frame.buf) <= s.option.BufferRecycleSize {
+			s.bufferPool.Put(frame.buf)
+		}
+	}
+}
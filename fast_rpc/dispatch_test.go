@@ -0,0 +1,234 @@
+package fast_rpc
+
+import (
+	"context"
+	"fmt"
+	"github.com/pineal-niwan/busybox/util"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+//直接在连接上发送带请求编号的消息
+func writeTestFrame(t *testing.T, conn net.Conn, msg IMsg, seq uint32) {
+	t.Helper()
+	writeTestFrameWithTimeout(t, conn, msg, seq, 0)
+}
+
+//直接在连接上发送带请求编号与超时时间(毫秒)的消息
+func writeTestFrameWithTimeout(t *testing.T, conn net.Conn, msg IMsg, seq uint32, timeout uint32) {
+	t.Helper()
+	size, data, err := msg.Marshal(make([]byte, 256), testBinOption)
+	if err != nil {
+		t.Fatalf("marshal error:%+v", err)
+	}
+	head := newMsgHead(msg, size, seq)
+	head.Timeout = timeout
+	err = PutMsgHead(data, head, testBinOption)
+	if err != nil {
+		t.Fatalf("put head error:%+v", err)
+	}
+	_, err = conn.Write(data[:size])
+	if err != nil {
+		t.Fatalf("write error:%+v", err)
+	}
+}
+
+//直接从连接上读取一个返回消息 -- 错误消息以*RPCError返回
+func readTestFrame(t *testing.T, conn net.Conn) (MsgHead, IMsg, error) {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 256)
+	head, err := readMsgHead(conn, buf, testBinOption, false)
+	if err != nil {
+		t.Fatalf("read head error:%+v", err)
+	}
+	body := make([]byte, head.Size)
+	err = util.NetReadBytes(conn, body)
+	if err != nil {
+		t.Fatalf("read body error:%+v", err)
+	}
+	msg, err := parseReply(testParseHash(), head, body, testBinOption)
+	return head, msg, err
+}
+
+//只发送大的请求不读取返回消息,直到服务端关闭连接后发送出错
+func writeUntilClosed(t *testing.T, conn net.Conn) {
+	t.Helper()
+	conn.(*net.TCPConn).SetReadBuffer(4096)
+	conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	msg := &testMsg{cmd: testCmdReq, Text: strings.Repeat("x", 60000)}
+	size, data, err := msg.Marshal(make([]byte, 256), testBinOption)
+	if err != nil {
+		t.Fatalf("marshal error:%+v", err)
+	}
+	for seq := uint32(1); ; seq++ {
+		err = PutMsgHead(data, newMsgHead(msg, size, seq), testBinOption)
+		if err != nil {
+			t.Fatalf("put head error:%+v", err)
+		}
+		_, err = conn.Write(data[:size])
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				t.Fatalf("expect connection closed by service, got %+v", err)
+			}
+			return
+		}
+	}
+}
+
+//返回消息的文本 -- 心跳返回"ping"
+func testFrameText(msg IMsg) string {
+	if m, ok := msg.(*testMsg); ok {
+		return m.Text
+	}
+	return "ping"
+}
+
+func TestAsyncDispatchOutOfOrder(t *testing.T) {
+	option := testOption()
+	option.AsyncDispatch = true
+	option.WorkerNum = 2
+	_, address := startTestService(t, option)
+
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatalf("dial error:%+v", err)
+	}
+	defer conn.Close()
+
+	//先发出的请求处理更慢,返回消息带回各自的请求编号
+	slow := fmt.Sprintf("sleep:%d", 100*time.Millisecond)
+	writeTestFrame(t, conn, &testMsg{cmd: testCmdReq, Text: slow}, 1)
+	writeTestFrame(t, conn, &testMsg{cmd: testCmdReq, Text: "fast"}, 2)
+	for _, expect := range []struct {
+		seq  uint32
+		text string
+	}{{2, "fast"}, {1, slow}} {
+		head, msg, err := readTestFrame(t, conn)
+		if err != nil {
+			t.Fatalf("read reply error:%+v", err)
+		}
+		if head.Seq != expect.seq || testFrameText(msg) != expect.text {
+			t.Errorf("expect seq:%d %s, got seq:%d %s", expect.seq, expect.text, head.Seq, testFrameText(msg))
+		}
+	}
+}
+
+func TestAsyncDispatchBackpressure(t *testing.T) {
+	//队列未满时心跳由读协程直接回复,队列满时读协程停止读取,心跳等到慢请求完成后才回复
+	for _, c := range []struct {
+		queueSize int
+		firstSeq  uint32
+	}{{8, 4}, {1, 1}} {
+		option := testOption()
+		option.AsyncDispatch = true
+		option.WorkerNum = 1
+		option.WorkerQueueSize = c.queueSize
+		_, address := startTestService(t, option)
+
+		conn, err := net.Dial("tcp", address)
+		if err != nil {
+			t.Fatalf("dial error:%+v", err)
+		}
+		defer conn.Close()
+
+		writeTestFrame(t, conn, &testMsg{cmd: testCmdReq, Text: fmt.Sprintf("sleep:%d", 200*time.Millisecond)}, 1)
+		writeTestFrame(t, conn, &testMsg{cmd: testCmdReq, Text: "a"}, 2)
+		writeTestFrame(t, conn, &testMsg{cmd: testCmdReq, Text: "b"}, 3)
+		writeTestFrame(t, conn, &PingMsg{}, 4)
+		seen := make(map[uint32]bool)
+		for i := 0; i < 4; i++ {
+			head, _, err := readTestFrame(t, conn)
+			if err != nil {
+				t.Fatalf("read reply error:%+v", err)
+			}
+			if i == 0 && head.Seq != c.firstSeq {
+				t.Errorf("queue size %d: expect first reply seq:%d, got seq:%d", c.queueSize, c.firstSeq, head.Seq)
+			}
+			seen[head.Seq] = true
+		}
+		if len(seen) != 4 {
+			t.Errorf("queue size %d: expect 4 distinct replies, got %+v", c.queueSize, seen)
+		}
+	}
+}
+
+func TestSequentialDispatchInOrder(t *testing.T) {
+	_, address := startTestService(t, testOption())
+
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatalf("dial error:%+v", err)
+	}
+	defer conn.Close()
+
+	//不开启异步处理时,慢请求之后的请求按顺序等待处理
+	texts := []string{fmt.Sprintf("sleep:%d", 100*time.Millisecond), "a", "b"}
+	for i, text := range texts {
+		writeTestFrame(t, conn, &testMsg{cmd: testCmdReq, Text: text}, uint32(i+1))
+	}
+	for i, text := range texts {
+		head, msg, err := readTestFrame(t, conn)
+		if err != nil {
+			t.Fatalf("read reply error:%+v", err)
+		}
+		if head.Seq != uint32(i+1) || testFrameText(msg) != text {
+			t.Errorf("expect seq:%d %s, got seq:%d %s", i+1, text, head.Seq, testFrameText(msg))
+		}
+	}
+}
+
+func TestAsyncDispatchClientNotReading(t *testing.T) {
+	option := testOption()
+	option.AsyncDispatch = true
+	option.WorkerNum = 1
+	option.WriteQueueSize = 1
+	_, address := startTestService(t, option)
+
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatalf("dial error:%+v", err)
+	}
+	defer conn.Close()
+
+	//客户端只发送不读取,发送队列满后服务端关闭连接
+	writeUntilClosed(t, conn)
+
+	//处理协程没有被占用,其他连接可以正常调用
+	cli, err := NewCli(context.Background(), address, 1, testCliOption(), testParseHash())
+	if err != nil {
+		t.Fatalf("new cli error:%+v", err)
+	}
+	defer cli.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	_, err = cli.CallWithRetry(ctx, &testMsg{cmd: testCmdReq, Text: "a"}, 0)
+	if err != nil {
+		t.Errorf("call error:%+v", err)
+	}
+}
+
+func TestAsyncDispatchCancelOnDisconnect(t *testing.T) {
+	option := testOption()
+	option.AsyncDispatch = true
+	option.WorkerNum = 1
+	_, address := startTestService(t, option)
+
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatalf("dial error:%+v", err)
+	}
+	defer conn.Close()
+
+	//异步分发时读协程继续读取,连接断开后正在处理的消息的ctx被取消
+	writeTestFrame(t, conn, &testMsg{cmd: testCmdCtx, Text: "wait"}, 1)
+	time.Sleep(50 * time.Millisecond)
+	conn.Close()
+	select {
+	case <-testContextCanceled:
+	case <-time.After(time.Second):
+		t.Errorf("expect handler ctx canceled after disconnect")
+	}
+}
@@ -0,0 +1,92 @@
+package fast_rpc
+
+import (
+	"github.com/pineal-niwan/busybox/binary"
+)
+
+const (
+	//框架保留的命令号起始值,业务消息不能使用此值及以上的命令号
+	ReservedCmdStart uint16 = 0xFFF0
+	//服务描述命令号
+	CmdDescribe uint16 = 0xFFFD
+	//心跳消息命令号
+	CmdPing uint16 = 0xFFFE
+	//错误消息命令号
+	CmdError uint16 = 0xFFFF
+)
+
+//错误消息 -- 服务端出错时代替结果消息返回,只传输错误码与错误信息
+type ErrorMsg struct {
+	RPCError
+}
+
+//获取命令行
+func (msg *ErrorMsg) GetCmd() uint16 {
+	return CmdError
+}
+
+//获取版本号
+func (msg *ErrorMsg) GetVersion() uint16 {
+	return 0
+}
+
+//获取Code
+func (msg *ErrorMsg) GetCode() uint32 {
+	return uint32(CmdError)
+}
+
+//序列化
+func (msg *ErrorMsg) Marshal(buf []byte, option *binary.Option) (int, []byte, error) {
+	writer, err := binary.NewWriteBinaryHandler(buf, option)
+	if err != nil {
+		return 0, nil, err
+	}
+	//先跳过消息头
+	err = writer.MovePos(uint32(MsgHeadSize))
+	if err != nil {
+		return 0, nil, err
+	}
+	//写消息内容
+	err = writer.WriteUint16(uint16(msg.Code))
+	if err != nil {
+		return 0, nil, err
+	}
+	err = writer.WriteString(msg.Message)
+	if err != nil {
+		return 0, nil, err
+	}
+	size := writer.Len()
+	//消息头由框架回填
+	return size, writer.Data(), nil
+}
+
+//反序列化
+func (msg *ErrorMsg) Unmarshal(buf []byte, option *binary.Option) error {
+	reader, err := binary.NewReadBinaryHandler(buf, option)
+	if err != nil {
+		return err
+	}
+	code, err := reader.ReadUint16()
+	if err != nil {
+		return err
+	}
+	msg.Code = ErrCode(code)
+	msg.Message, err = reader.ReadString()
+	return err
+}
+
+//解析返回消息 -- 错误消息转化为RPCError,心跳与服务描述由框架解析
+func parseReply(msgParseHash map[uint32]MsgParseHandler, head MsgHead, buf []byte, option *binary.Option) (IMsg, error) {
+	if isBuiltinCmd(head.Cmd) {
+		return parseBuiltinMsg(head, buf, option)
+	}
+	if head.Cmd != CmdError {
+		return parseMsgWithHash(msgParseHash, head, buf, option)
+	}
+	errMsg := &ErrorMsg{}
+	err := errMsg.Unmarshal(buf, option)
+	if err != nil {
+		return nil, err
+	}
+	return nil, &errMsg.RPCError
+}
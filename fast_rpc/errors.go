@@ -13,4 +13,32 @@ var (
 	ErrBadMsgHandler = errors.New("bad msg handler")
 	//接收的消息不是自己期望的
 	ErrNotExpectMsg = errors.New("not expect message")
+	//返回消息的请求编号与请求不一致
+	ErrSeqMismatch = errors.New("seq mismatch")
+	//消息处理返回了空的结果消息
+	ErrNilOutMsg = errors.New("nil out message")
+	//客户端已关闭
+	ErrCliClosed = errors.New("client closed")
+	//没有可用的服务地址
+	ErrNoEndpoint = errors.New("no available endpoint")
+	//熔断中,调用被拒绝
+	ErrCircuitOpen = errors.New("circuit breaker is open")
+	//连接认证失败
+	ErrAuthFailed = errors.New("authentication failed")
+	//不支持的压缩算法
+	ErrBadCodec = errors.New("bad codec")
+	//收到的数据不以魔数开头,不是fast_rpc的消息
+	ErrBadMagic = errors.New("bad msg magic, not a fast_rpc frame")
+	//消息头校验失败
+	ErrBadHeadChecksum = errors.New("msg head checksum mismatch")
+	//消息体校验失败
+	ErrBadBodyChecksum = errors.New("msg body checksum mismatch")
+	//流已关闭
+	ErrStreamClosed = errors.New("stream closed")
+	//流的接收队列已满,流被重置
+	ErrStreamReset = errors.New("stream reset, receive queue full")
+	//消息超过长度限制
+	ErrMsgTooLarge = errors.New("msg too large")
+	//单向消息只能通过Notify发送
+	ErrOneWayCall = errors.New("one-way msg can only be sent by notify")
 )
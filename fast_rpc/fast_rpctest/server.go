@@ -0,0 +1,165 @@
+//用于测试的fast_rpc服务 -- 服务与客户端在进程内通过net.Pipe通信,不占用端口
+package fast_rpctest
+
+import (
+	"context"
+	"github.com/pineal-niwan/busybox/binary"
+	"github.com/pineal-niwan/busybox/fast_rpc"
+	"github.com/pineal-niwan/busybox/util"
+	"go.uber.org/zap"
+	"testing"
+	"time"
+)
+
+const (
+	//测试服务的地址 -- 只用于显示与TLS校验
+	Address = "fast_rpctest"
+	//NewCli使用的连接池大小
+	CliPoolSize = 4
+)
+
+//测试服务
+type Server struct {
+	//服务 -- 启动前通过它添加处理函数
+	Service *fast_rpc.Service
+	//进程内的监听者,同时是客户端的连接器
+	Listener *util.PipeListener
+
+	msgParseHash map[uint32]fast_rpc.MsgParseHandler
+	//服务循环退出通知
+	exit    chan struct{}
+	started bool
+}
+
+//缺省的服务参数
+func DefaultOption() *fast_rpc.Option {
+	return &fast_rpc.Option{
+		Option:            defaultBinaryOption(),
+		AcceptDelay:       time.Millisecond,
+		AcceptMaxDelay:    time.Second,
+		AcceptMaxRetry:    3,
+		BufferSize:        1024,
+		MaxMsgSize:        4 * 1024 * 1024,
+		BufferRecycleSize: 64 * 1024,
+	}
+}
+
+//缺省的客户端参数
+func DefaultCliOption() *fast_rpc.CliOption {
+	return &fast_rpc.CliOption{
+		Option:            defaultBinaryOption(),
+		BufferSize:        1024,
+		MaxMsgSize:        4 * 1024 * 1024,
+		BufferRecycleSize: 64 * 1024,
+		RetreatTime:       time.Millisecond,
+	}
+}
+
+func defaultBinaryOption() *binary.Option {
+	return &binary.Option{
+		DataMaxLen:      4 * 1024 * 1024,
+		StringMaxLen:    1024 * 1024,
+		ArrayMaxLen:     64 * 1024,
+		ExtendExtraSize: 256,
+	}
+}
+
+//新建未启动的测试服务 -- option为nil时使用DefaultOption
+//添加处理函数后调用Start启动
+func NewUnstartedServer(option *fast_rpc.Option, msgParseHash map[uint32]fast_rpc.MsgParseHandler) (*Server, error) {
+	if option == nil {
+		option = DefaultOption()
+	}
+	err := option.Validate()
+	if err != nil {
+		return nil, err
+	}
+	ln := util.NewPipeListener(Address)
+	service := &fast_rpc.Service{}
+	service.Init(ln, zap.NewNop(), option, msgParseHash)
+	return &Server{
+		Service:      service,
+		Listener:     ln,
+		msgParseHash: msgParseHash,
+		exit:         make(chan struct{}, 1),
+	}, nil
+}
+
+//新建并启动测试服务 -- register中添加处理函数
+func NewServer(
+	option *fast_rpc.Option,
+	msgParseHash map[uint32]fast_rpc.MsgParseHandler,
+	register func(service *fast_rpc.Service)) (*Server, error) {
+
+	s, err := NewUnstartedServer(option, msgParseHash)
+	if err != nil {
+		return nil, err
+	}
+	if register != nil {
+		register(s.Service)
+	}
+	s.Start()
+	return s, nil
+}
+
+//启动服务循环
+func (s *Server) Start() {
+	if s.started {
+		return
+	}
+	s.started = true
+	go s.Service.LoopHandle(s.exit)
+}
+
+//关闭服务 -- 等待服务循环退出,已建立的连接由客户端关闭
+func (s *Server) Close() error {
+	err := s.Service.Close()
+	if s.started {
+		<-s.exit
+		s.started = false
+	}
+	return err
+}
+
+//连接测试服务的客户端参数 -- 复制option并设置连接器,option为nil时使用DefaultCliOption
+func (s *Server) CliOption(option *fast_rpc.CliOption) *fast_rpc.CliOption {
+	if option == nil {
+		option = DefaultCliOption()
+	}
+	cliOption := *option
+	cliOption.Dialer = s.Listener
+	return &cliOption
+}
+
+//新建连接测试服务的客户端
+func (s *Server) NewCli(ctx context.Context, option *fast_rpc.CliOption) (*fast_rpc.Cli, error) {
+	return fast_rpc.NewCli(ctx, Address, CliPoolSize, s.CliOption(option), s.msgParseHash)
+}
+
+//新建连接测试服务的多路复用客户端
+func (s *Server) NewMuxCli(ctx context.Context, option *fast_rpc.CliOption) (*fast_rpc.MuxCli, error) {
+	return fast_rpc.NewMuxCli(ctx, Address, s.CliOption(option), s.msgParseHash)
+}
+
+//启动测试服务并返回连接它的客户端 -- 使用缺省参数,测试结束时自动关闭
+func Start(
+	t testing.TB,
+	msgParseHash map[uint32]fast_rpc.MsgParseHandler,
+	register func(service *fast_rpc.Service)) (*Server, *fast_rpc.Cli) {
+
+	t.Helper()
+	s, err := NewServer(nil, msgParseHash, register)
+	if err != nil {
+		t.Fatalf("fast_rpctest start server error:%+v", err)
+	}
+	cli, err := s.NewCli(context.Background(), nil)
+	if err != nil {
+		s.Close()
+		t.Fatalf("fast_rpctest new cli error:%+v", err)
+	}
+	t.Cleanup(func() {
+		cli.Close()
+		s.Close()
+	})
+	return s, cli
+}
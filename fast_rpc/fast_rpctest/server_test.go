@@ -0,0 +1,112 @@
+package fast_rpctest
+
+import (
+	"context"
+	"github.com/pineal-niwan/busybox/binary"
+	"github.com/pineal-niwan/busybox/fast_rpc"
+	"testing"
+)
+
+const (
+	testCmdEcho = 1
+)
+
+//测试消息 -- 只有一个字符串字段
+type echoMsg struct {
+	Text string
+}
+
+func (msg *echoMsg) GetCmd() uint16 {
+	return testCmdEcho
+}
+
+func (msg *echoMsg) GetVersion() uint16 {
+	return 0
+}
+
+func (msg *echoMsg) GetCode() uint32 {
+	return testCmdEcho
+}
+
+func (msg *echoMsg) Marshal(buf []byte, option *binary.Option) (int, []byte, error) {
+	writer, err := binary.NewWriteBinaryHandler(buf, option)
+	if err != nil {
+		return 0, nil, err
+	}
+	err = writer.MovePos(uint32(fast_rpc.MsgHeadSize))
+	if err != nil {
+		return 0, nil, err
+	}
+	err = writer.WriteString(msg.Text)
+	if err != nil {
+		return 0, nil, err
+	}
+	size := writer.ResetPos(0)
+	err = fast_rpc.MarshalMsgHead(writer, fast_rpc.MsgHead{
+		Size: uint32(size - fast_rpc.MsgHeadSize),
+		Cmd:  testCmdEcho,
+	})
+	if err != nil {
+		return 0, nil, err
+	}
+	writer.ResetPos(size)
+	return size, writer.Data(), nil
+}
+
+func (msg *echoMsg) Unmarshal(buf []byte, option *binary.Option) error {
+	reader, err := binary.NewReadBinaryHandler(buf, option)
+	if err != nil {
+		return err
+	}
+	msg.Text, err = reader.ReadString()
+	return err
+}
+
+func testParseHash() map[uint32]fast_rpc.MsgParseHandler {
+	return map[uint32]fast_rpc.MsgParseHandler{
+		testCmdEcho: func(data []byte, option *binary.Option) (fast_rpc.IMsg, error) {
+			msg := &echoMsg{}
+			err := msg.Unmarshal(data, option)
+			return msg, err
+		},
+	}
+}
+
+func testRegister(service *fast_rpc.Service) {
+	service.AddMsgHandler(&echoMsg{}, func(inMsg fast_rpc.IMsg) (fast_rpc.IMsg, error) {
+		return inMsg, nil
+	})
+}
+
+func TestStart(t *testing.T) {
+	s, cli := Start(t, testParseHash(), testRegister)
+
+	outMsg, err := cli.CallWithRetry(context.Background(), &echoMsg{Text: "hello"}, 0)
+	if err != nil || outMsg.(*echoMsg).Text != "hello" {
+		t.Fatalf("call, msg:%+v err:%+v", outMsg, err)
+	}
+
+	muxCli, err := s.NewMuxCli(context.Background(), nil)
+	if err != nil {
+		t.Fatalf("new mux cli error:%+v", err)
+	}
+	defer muxCli.Close()
+	outMsg, err = muxCli.Call(context.Background(), &echoMsg{Text: "mux"})
+	if err != nil || outMsg.(*echoMsg).Text != "mux" {
+		t.Fatalf("mux call, msg:%+v err:%+v", outMsg, err)
+	}
+}
+
+func TestServerClosed(t *testing.T) {
+	s, err := NewServer(nil, testParseHash(), testRegister)
+	if err != nil {
+		t.Fatalf("new server error:%+v", err)
+	}
+	s.Close()
+
+	//服务关闭后不能再建立连接
+	_, err = s.NewMuxCli(context.Background(), nil)
+	if err == nil {
+		t.Errorf("expect dial closed server fail")
+	}
+}
@@ -0,0 +1,132 @@
+package fast_rpc
+
+import (
+	"context"
+	"github.com/pineal-niwan/busybox/util"
+	"go.uber.org/zap"
+	"time"
+)
+
+//服务端拦截器
+//head为请求的消息头,inMsg为解析后的请求消息,handler为后续的处理(下一个拦截器或消息处理函数)
+type ServerInterceptor func(ctx context.Context, head MsgHead, inMsg IMsg, handler MsgHandlerWithContext) (outMsg IMsg, err error)
+
+//客户端调用函数
+type Invoker func(ctx context.Context, inMsg IMsg) (outMsg IMsg, err error)
+
+//客户端拦截器
+//head为请求的消息头(只有Cmd与Version),inMsg为请求消息,invoker为后续的调用(下一个拦截器或实际的调用)
+type ClientInterceptor func(ctx context.Context, head MsgHead, inMsg IMsg, invoker Invoker) (outMsg IMsg, err error)
+
+//串联服务端拦截器 -- 排在前面的拦截器在外层
+func chainServerInterceptors(interceptors []ServerInterceptor, head MsgHead, handler MsgHandlerWithContext) MsgHandlerWithContext {
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		interceptor, next := interceptors[i], handler
+		handler = func(ctx context.Context, inMsg IMsg) (IMsg, error) {
+			return interceptor(ctx, head, inMsg, next)
+		}
+	}
+	return handler
+}
+
+//串联客户端拦截器 -- 排在前面的拦截器在外层
+func chainClientInterceptors(interceptors []ClientInterceptor, head MsgHead, invoker Invoker) Invoker {
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		interceptor, next := interceptors[i], invoker
+		invoker = func(ctx context.Context, inMsg IMsg) (IMsg, error) {
+			return interceptor(ctx, head, inMsg, next)
+		}
+	}
+	return invoker
+}
+
+//客户端请求的消息头
+func newCallHead(inMsg IMsg) MsgHead {
+	return MsgHead{
+		Cmd:     inMsg.GetCmd(),
+		Version: inMsg.GetVersion(),
+	}
+}
+
+//服务端访问日志
+func NewServerLogInterceptor(logger *zap.Logger) ServerInterceptor {
+	return func(ctx context.Context, head MsgHead, inMsg IMsg, handler MsgHandlerWithContext) (IMsg, error) {
+		start := time.Now()
+		outMsg, err := handler(ctx, inMsg)
+
+		fields := []zap.Field{
+			zap.Uint16("cmd", head.Cmd),
+			zap.Uint16("version", head.Version),
+			zap.Uint32("seq", head.Seq),
+			zap.Duration("latency", time.Since(start)),
+		}
+		peer, ok := PeerFromContext(ctx)
+		if ok && peer.Addr != nil {
+			fields = append(fields, zap.String("remote", peer.Addr.String()))
+		}
+		if err != nil {
+			logger.Error("rpc access", append(fields, zap.Error(err))...)
+		} else {
+			logger.Info("rpc access", fields...)
+		}
+		return outMsg, err
+	}
+}
+
+//服务端panic恢复 -- 消息处理panic时返回错误消息,连接继续可用
+func NewServerRecoveryInterceptor(logger *zap.Logger) ServerInterceptor {
+	return func(ctx context.Context, head MsgHead, inMsg IMsg, handler MsgHandlerWithContext) (outMsg IMsg, err error) {
+		defer func() {
+			panicErr := util.Recover(recover())
+			if panicErr != nil {
+				logger.Error("rpc handler panic",
+					zap.Uint16("cmd", head.Cmd),
+					zap.Uint16("version", head.Version),
+					zap.Error(panicErr.Err),
+					zap.String("stack", string(panicErr.Stack())))
+				outMsg = nil
+				err = NewRPCError(ErrCodeInternal, "handler panic: %+v", panicErr.Err)
+			}
+		}()
+		return handler(ctx, inMsg)
+	}
+}
+
+//客户端调用日志
+func NewClientLogInterceptor(logger *zap.Logger) ClientInterceptor {
+	return func(ctx context.Context, head MsgHead, inMsg IMsg, invoker Invoker) (IMsg, error) {
+		start := time.Now()
+		outMsg, err := invoker(ctx, inMsg)
+
+		fields := []zap.Field{
+			zap.Uint16("cmd", head.Cmd),
+			zap.Uint16("version", head.Version),
+			zap.Duration("latency", time.Since(start)),
+		}
+		if err != nil {
+			logger.Error("rpc call", append(fields, zap.Error(err))...)
+		} else {
+			logger.Info("rpc call", fields...)
+		}
+		return outMsg, err
+	}
+}
+
+//客户端panic恢复 -- 调用过程中panic时返回错误
+func NewClientRecoveryInterceptor(logger *zap.Logger) ClientInterceptor {
+	return func(ctx context.Context, head MsgHead, inMsg IMsg, invoker Invoker) (outMsg IMsg, err error) {
+		defer func() {
+			panicErr := util.Recover(recover())
+			if panicErr != nil {
+				logger.Error("rpc call panic",
+					zap.Uint16("cmd", head.Cmd),
+					zap.Uint16("version", head.Version),
+					zap.Error(panicErr.Err),
+					zap.String("stack", string(panicErr.Stack())))
+				outMsg = nil
+				err = NewRPCError(ErrCodeInternal, "rpc call panic: %+v", panicErr.Err)
+			}
+		}()
+		return invoker(ctx, inMsg)
+	}
+}
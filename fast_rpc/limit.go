@@ -0,0 +1,204 @@
+package fast_rpc
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//限流参数 -- 各项为0表示不限制
+//超过限制的请求返回ErrCodeResourceExhausted的错误消息,单向消息直接丢弃
+type LimitOption struct {
+	//最大并发连接数 -- 超过时连接上的请求都被拒绝,回复后断开连接
+	MaxConns int
+	//所有连接上同时处理的最大请求数,打开的流在结束前也占用一个
+	MaxInFlight int
+	//每个连接上同时处理的最大请求数
+	MaxConnInFlight int
+	//按命令号的令牌桶限速 -- 流只在打开时限速
+	CmdRates map[uint16]RateOption
+}
+
+func (option *LimitOption) Validate() error {
+	if option.MaxConns < 0 || option.MaxInFlight < 0 || option.MaxConnInFlight < 0 {
+		return ErrInvalidOption
+	}
+	for _, rate := range option.CmdRates {
+		if rate.Rate <= 0 || rate.Burst <= 0 {
+			return ErrInvalidOption
+		}
+	}
+	return nil
+}
+
+//令牌桶参数
+type RateOption struct {
+	//每秒补充的令牌数
+	Rate float64
+	//桶的容量 -- 允许的突发请求数
+	Burst int
+}
+
+//服务的当前负载
+type Load struct {
+	//连接数
+	Conns int64
+	//正在处理的请求数
+	InFlight int64
+	//累计拒绝的请求数
+	Rejected uint64
+	//累计因读写超时关闭的连接数
+	TimedOut uint64
+}
+
+//令牌桶 -- 每秒补充rate个令牌,最多保存burst个,每个请求取出一个
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	//上次补充令牌的时间
+	last time.Time
+	sync.Mutex
+}
+
+func newTokenBucket(option RateOption) *tokenBucket {
+	return &tokenBucket{
+		rate:   option.Rate,
+		burst:  float64(option.Burst),
+		tokens: float64(option.Burst),
+		last:   time.Now(),
+	}
+}
+
+//取出一个令牌 -- 没有令牌时返回false
+func (bucket *tokenBucket) take() bool {
+	bucket.Lock()
+	defer bucket.Unlock()
+	now := time.Now()
+	bucket.tokens += now.Sub(bucket.last).Seconds() * bucket.rate
+	bucket.last = now
+	if bucket.tokens > bucket.burst {
+		bucket.tokens = bucket.burst
+	}
+	if bucket.tokens < 1 {
+		return false
+	}
+	bucket.tokens--
+	return true
+}
+
+//限流器 -- 每个服务一个,没有设置限流参数时只统计负载
+type limiter struct {
+	option LimitOption
+	//按命令号的令牌桶 -- 初始化后只读
+	buckets map[uint16]*tokenBucket
+	metrics *ServiceMetrics
+
+	conns    int64
+	inFlight int64
+	rejected uint64
+	timedOut uint64
+}
+
+//连接的限流状态
+type connLimiter struct {
+	l *limiter
+	//超过了最大连接数
+	overConns bool
+	inFlight  int64
+}
+
+func newLimiter(option *LimitOption, metrics *ServiceMetrics) *limiter {
+	l := &limiter{
+		buckets: make(map[uint16]*tokenBucket),
+		metrics: metrics,
+	}
+	if option != nil {
+		l.option = *option
+		for cmd, rate := range option.CmdRates {
+			l.buckets[cmd] = newTokenBucket(rate)
+		}
+	}
+	return l
+}
+
+//当前负载
+func (l *limiter) load() Load {
+	return Load{
+		Conns:    atomic.LoadInt64(&l.conns),
+		InFlight: atomic.LoadInt64(&l.inFlight),
+		Rejected: atomic.LoadUint64(&l.rejected),
+		TimedOut: atomic.LoadUint64(&l.timedOut),
+	}
+}
+
+//登记连接 -- 超过最大连接数的连接也登记,直到断开
+func (l *limiter) openConn() *connLimiter {
+	n := atomic.AddInt64(&l.conns, 1)
+	l.metrics.addConns(1)
+	return &connLimiter{
+		l:         l,
+		overConns: l.option.MaxConns > 0 && n > int64(l.option.MaxConns),
+	}
+}
+
+//注销连接
+func (cl *connLimiter) close() {
+	atomic.AddInt64(&cl.l.conns, -1)
+	cl.l.metrics.addConns(-1)
+}
+
+//连接上是否有正在处理的请求
+func (cl *connLimiter) busy() bool {
+	return atomic.LoadInt64(&cl.inFlight) > 0
+}
+
+//请求准入 -- 通过时返回请求处理完成后调用的释放函数
+func (cl *connLimiter) admit(head MsgHead) (func(), error) {
+	l := cl.l
+	if cl.overConns {
+		return nil, l.reject(head, "conns", "too many connections, max:%+v", l.option.MaxConns)
+	}
+	bucket, ok := l.buckets[head.Cmd]
+	if ok && !bucket.take() {
+		return nil, l.reject(head, "rate", "rate limit exceeded cmd:%+v", head.Cmd)
+	}
+	n := atomic.AddInt64(&cl.inFlight, 1)
+	if l.option.MaxConnInFlight > 0 && n > int64(l.option.MaxConnInFlight) {
+		atomic.AddInt64(&cl.inFlight, -1)
+		return nil, l.reject(head, "conn_in_flight", "too many in-flight requests on connection, max:%+v", l.option.MaxConnInFlight)
+	}
+	n = atomic.AddInt64(&l.inFlight, 1)
+	if l.option.MaxInFlight > 0 && n > int64(l.option.MaxInFlight) {
+		atomic.AddInt64(&l.inFlight, -1)
+		atomic.AddInt64(&cl.inFlight, -1)
+		return nil, l.reject(head, "in_flight", "too many in-flight requests, max:%+v", l.option.MaxInFlight)
+	}
+	l.metrics.addInFlight(1)
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			atomic.AddInt64(&l.inFlight, -1)
+			atomic.AddInt64(&cl.inFlight, -1)
+			l.metrics.addInFlight(-1)
+		})
+	}, nil
+}
+
+//拒绝请求 -- 记录并返回资源耗尽的错误
+func (l *limiter) reject(head MsgHead, reason string, format string, args ...interface{}) error {
+	atomic.AddUint64(&l.rejected, 1)
+	l.metrics.observeRejected(head, reason)
+	return NewRPCError(ErrCodeResourceExhausted, format, args...)
+}
+
+//记录一次因超时关闭的连接
+func (l *limiter) timeout(stage string) {
+	atomic.AddUint64(&l.timedOut, 1)
+	l.metrics.observeTimeout(stage)
+}
+
+//服务的当前负载 -- 连接数、正在处理的请求数、累计拒绝的请求数与超时关闭的连接数
+func (s *Service) Load() Load {
+	return s.limiter.load()
+}
@@ -0,0 +1,98 @@
+package fast_rpc
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestLimitRate(t *testing.T) {
+	option := testOption()
+	option.Limits = &LimitOption{
+		CmdRates: map[uint16]RateOption{testCmdReq: {Rate: 0.001, Burst: 2}},
+	}
+	service, address := startTestService(t, option)
+	cli, err := NewCli(context.Background(), address, 1, testCliOption(), testParseHash())
+	if err != nil {
+		t.Fatalf("new cli error:%+v", err)
+	}
+	defer cli.Close()
+
+	for i := 0; i < 3; i++ {
+		_, err = cli.CallWithRetry(context.Background(), &testMsg{cmd: testCmdReq, Text: "hello"}, 0)
+		if i < 2 && err != nil {
+			t.Fatalf("call %d error:%+v", i, err)
+		}
+	}
+	if !errors.Is(err, ErrCodeResourceExhausted) {
+		t.Fatalf("expect resource exhausted, got %+v", err)
+	}
+	//被拒绝后连接仍然可用,其他命令不受限制
+	_, err = cli.CallWithRetry(context.Background(), &testMsg{cmd: testCmdCtx}, 0)
+	if err != nil {
+		t.Errorf("call other cmd error:%+v", err)
+	}
+	if load := service.Load(); load.Rejected != 1 || load.Conns != 1 {
+		t.Errorf("unexpected load:%+v", load)
+	}
+}
+
+func TestLimitInFlight(t *testing.T) {
+	option := testOption()
+	option.AsyncDispatch = true
+	option.WorkerNum = 4
+	option.Limits = &LimitOption{MaxConnInFlight: 1}
+	service, address := startTestService(t, option)
+	cli, err := NewMuxCli(context.Background(), address, testCliOption(), testParseHash())
+	if err != nil {
+		t.Fatalf("new mux cli error:%+v", err)
+	}
+	defer cli.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := cli.Call(context.Background(), &testMsg{cmd: testCmdReq, Text: "sleep:200000000"})
+		done <- err
+	}()
+	deadline := time.Now().Add(time.Second)
+	for service.Load().InFlight == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	_, err = cli.Call(context.Background(), &testMsg{cmd: testCmdReq, Text: "hello"})
+	if !errors.Is(err, ErrCodeResourceExhausted) {
+		t.Errorf("expect resource exhausted, got %+v", err)
+	}
+	if err = <-done; err != nil {
+		t.Errorf("first call error:%+v", err)
+	}
+	if load := service.Load(); load.InFlight != 0 || load.Rejected != 1 {
+		t.Errorf("unexpected load:%+v", load)
+	}
+}
+
+func TestLimitConns(t *testing.T) {
+	option := testOption()
+	option.Limits = &LimitOption{MaxConns: 1}
+	_, address := startTestService(t, option)
+	first, err := NewMuxCli(context.Background(), address, testCliOption(), testParseHash())
+	if err != nil {
+		t.Fatalf("new mux cli error:%+v", err)
+	}
+	defer first.Close()
+	second, err := NewMuxCli(context.Background(), address, testCliOption(), testParseHash())
+	if err != nil {
+		t.Fatalf("new mux cli error:%+v", err)
+	}
+	defer second.Close()
+
+	//超过连接数的连接收到资源耗尽的错误,而不是直接断开
+	_, err = second.Call(context.Background(), &testMsg{cmd: testCmdReq, Text: "hello"})
+	if !errors.Is(err, ErrCodeResourceExhausted) {
+		t.Errorf("expect resource exhausted, got %+v", err)
+	}
+	_, err = first.Call(context.Background(), &testMsg{cmd: testCmdReq, Text: "hello"})
+	if err != nil {
+		t.Errorf("first cli call error:%+v", err)
+	}
+}
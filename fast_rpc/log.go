@@ -0,0 +1,49 @@
+package fast_rpc
+
+import (
+	"context"
+	"errors"
+	"go.uber.org/zap"
+	"io"
+	"net"
+	"syscall"
+)
+
+//对端正常断开或连接已被本端关闭 -- 这是预期的事件,不作为错误记录
+func isPeerClosed(err error) bool {
+	return errors.Is(err, io.EOF) ||
+		errors.Is(err, net.ErrClosed) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.EPIPE)
+}
+
+//对端地址的日志字段
+func remoteField(addr net.Addr) zap.Field {
+	if addr == nil {
+		return zap.Skip()
+	}
+	return zap.String("remote", addr.String())
+}
+
+//服务端请求的日志字段 -- 对端地址、命令号与版本号
+func requestFields(ctx context.Context, head MsgHead, fields ...zap.Field) []zap.Field {
+	var addr net.Addr
+	peer, ok := PeerFromContext(ctx)
+	if ok {
+		addr = peer.Addr
+	}
+	return append([]zap.Field{
+		remoteField(addr),
+		zap.Uint16("cmd", head.Cmd),
+		zap.Uint16("version", head.Version),
+	}, fields...)
+}
+
+//客户端调用的日志字段 -- 服务地址、命令号与版本号
+func callFields(address string, inMsg IMsg, fields ...zap.Field) []zap.Field {
+	return append([]zap.Field{
+		zap.String("remote", address),
+		zap.Uint16("cmd", inMsg.GetCmd()),
+		zap.Uint16("version", inMsg.GetVersion()),
+	}, fields...)
+}
@@ -0,0 +1,121 @@
+package fast_rpc
+
+import (
+	"context"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestLogPeerClosed(t *testing.T) {
+	core, logs := observer.New(zapcore.DebugLevel)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen error:%+v", err)
+	}
+	service := &Service{}
+	service.Init(ln, zap.New(core), testOption(), testParseHash())
+	service.AddMsgHandler(&testMsg{cmd: testCmdReq}, testEchoHandler)
+	go service.LoopHandle(make(chan struct{}, 1))
+	defer service.Close()
+
+	//客户端使用传入的日志
+	cliOption := testCliOption()
+	cliOption.Logger = zap.NewNop()
+	cli, err := NewCli(context.Background(), ln.Addr().String(), 1, cliOption, testParseHash())
+	if err != nil {
+		t.Fatalf("new cli error:%+v", err)
+	}
+	if cli.logger != cliOption.Logger {
+		t.Errorf("expect cli use logger from option")
+	}
+	_, err = cli.CallWithRetry(context.Background(), &testMsg{cmd: testCmdReq, Text: "error:boom"}, 0)
+	if err == nil {
+		t.Fatalf("expect call error")
+	}
+	cli.Close()
+
+	//客户端断开只记录Debug日志,带有对端地址
+	deadline := time.Now().Add(time.Second)
+	for logs.FilterMessage("service connection closed").Len() == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	closed := logs.FilterMessage("service connection closed").All()
+	if len(closed) != 1 || closed[0].Level != zapcore.DebugLevel || closed[0].ContextMap()["remote"] == nil {
+		t.Errorf("expect one debug log for peer closed, got %+v", closed)
+	}
+	//处理出错的日志带有请求信息
+	handled := logs.FilterMessage("service handle msg error").All()
+	if len(handled) != 1 {
+		t.Fatalf("expect one handle error log, got %+v", handled)
+	}
+	for _, key := range []string{"remote", "cmd", "version", "latency"} {
+		if _, ok := handled[0].ContextMap()[key]; !ok {
+			t.Errorf("expect field %s in handle error log", key)
+		}
+	}
+	if n := logs.FilterMessage("service receive head error").Len(); n != 0 {
+		t.Errorf("expect no error log for peer closed, got %d", n)
+	}
+}
+
+func TestLogHandshakeError(t *testing.T) {
+	core, logs := observer.New(zapcore.DebugLevel)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen error:%+v", err)
+	}
+	auth, err := NewHMACAuthenticator(map[string][]byte{
+		"svc-a": []byte("secret-a"),
+	})
+	if err != nil {
+		t.Fatalf("new authenticator error:%+v", err)
+	}
+	option := testOption()
+	option.Authenticator = auth
+	option.HandshakeTimeout = time.Second
+	service := &Service{}
+	service.Init(ln, zap.New(core), option, testParseHash())
+	go service.LoopHandle(make(chan struct{}, 1))
+	defer service.Close()
+
+	waitLog := func(msg string) []observer.LoggedEntry {
+		deadline := time.Now().Add(time.Second)
+		for logs.FilterMessage(msg).Len() == 0 && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		return logs.FilterMessage(msg).All()
+	}
+
+	//握手期间断开只记录Debug日志
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("dial error:%+v", err)
+	}
+	conn.Close()
+	closed := waitLog("service connection closed during handshake")
+	if len(closed) != 1 || closed[0].Level != zapcore.DebugLevel {
+		t.Errorf("expect one debug log for peer closed, got %+v", closed)
+	}
+
+	//认证失败记录Error日志
+	cliAuth, err := NewHMACClientAuthenticator("svc-a", []byte("wrong"))
+	if err != nil {
+		t.Fatalf("new client authenticator error:%+v", err)
+	}
+	cliOption := testCliOption()
+	cliOption.Authenticator = cliAuth
+	cli, err := NewCli(context.Background(), ln.Addr().String(), 1, cliOption, testParseHash())
+	if err != nil {
+		t.Fatalf("new cli error:%+v", err)
+	}
+	defer cli.Close()
+	cli.CallWithRetry(context.Background(), &testMsg{cmd: testCmdReq, Text: "x"}, 0)
+	failed := waitLog("service handshake error")
+	if len(failed) != 1 || failed[0].Level != zapcore.ErrorLevel || failed[0].ContextMap()["remote"] == nil {
+		t.Errorf("expect one error log for auth failure, got %+v", failed)
+	}
+}
@@ -0,0 +1,229 @@
+package fast_rpc
+
+import (
+	"github.com/pineal-niwan/busybox/metrics"
+	"strconv"
+	"time"
+)
+
+//服务端指标
+type ServiceMetrics struct {
+	//请求数
+	requests *metrics.CounterVec
+	//错误数
+	errors *metrics.CounterVec
+	//处理延时
+	latency *metrics.HistogramVec
+	//因超过限制被拒绝的请求数
+	rejected *metrics.CounterVec
+	//当前连接数
+	conns *metrics.GaugeVec
+	//正在处理的请求数
+	inFlight *metrics.GaugeVec
+	//因读写超时关闭的连接数
+	timeouts *metrics.CounterVec
+}
+
+//新建服务端指标并注册到registry
+//同一进程中的多个Service可以共用一个ServiceMetrics
+func NewServiceMetrics(registry *metrics.Registry) *ServiceMetrics {
+	m := &ServiceMetrics{
+		requests: metrics.NewCounterVec(
+			"fast_rpc_server_requests_total",
+			"Total number of requests handled by the rpc service.",
+			"cmd", "version"),
+		errors: metrics.NewCounterVec(
+			"fast_rpc_server_errors_total",
+			"Total number of error responses sent by the rpc service.",
+			"cmd", "version", "code"),
+		latency: metrics.NewHistogramVec(
+			"fast_rpc_server_handle_seconds",
+			"Latency of request handling in the rpc service.",
+			nil,
+			"cmd", "version"),
+		rejected: metrics.NewCounterVec(
+			"fast_rpc_server_rejected_total",
+			"Total number of requests rejected by the rpc service limits.",
+			"cmd", "version", "reason"),
+		conns: metrics.NewGaugeVec(
+			"fast_rpc_server_connections",
+			"Current number of connections to the rpc service."),
+		inFlight: metrics.NewGaugeVec(
+			"fast_rpc_server_in_flight_requests",
+			"Current number of requests being handled by the rpc service."),
+		timeouts: metrics.NewCounterVec(
+			"fast_rpc_server_timeouts_total",
+			"Total number of connections closed by the rpc service on read or write timeout.",
+			"stage"),
+	}
+	registry.MustRegister(m.requests, m.errors, m.latency, m.rejected, m.conns, m.inFlight, m.timeouts)
+	return m
+}
+
+//记录一次被拒绝的请求
+func (m *ServiceMetrics) observeRejected(head MsgHead, reason string) {
+	if m == nil {
+		return
+	}
+	cmd, version := cmdLabels(head.Cmd, head.Version)
+	m.rejected.Inc(cmd, version, reason)
+}
+
+//连接数变化
+func (m *ServiceMetrics) addConns(delta float64) {
+	if m == nil {
+		return
+	}
+	m.conns.Add(delta)
+}
+
+//正在处理的请求数变化
+func (m *ServiceMetrics) addInFlight(delta float64) {
+	if m == nil {
+		return
+	}
+	m.inFlight.Add(delta)
+}
+
+//记录一次超时关闭的连接
+func (m *ServiceMetrics) observeTimeout(stage string) {
+	if m == nil {
+		return
+	}
+	m.timeouts.Inc(stage)
+}
+
+//记录一次请求
+func (m *ServiceMetrics) observe(head MsgHead, outMsg IMsg, d time.Duration) {
+	if m == nil {
+		return
+	}
+	cmd, version := cmdLabels(head.Cmd, head.Version)
+	m.requests.Inc(cmd, version)
+	m.latency.ObserveDuration(d, cmd, version)
+	errMsg, ok := outMsg.(*ErrorMsg)
+	if ok {
+		m.errors.Inc(cmd, version, errMsg.Code.String())
+	}
+}
+
+//客户端指标
+type CliMetrics struct {
+	//调用数
+	calls *metrics.CounterVec
+	//调用失败数
+	errors *metrics.CounterVec
+	//调用延时(包括重试)
+	latency *metrics.HistogramVec
+	//重试次数
+	retries *metrics.CounterVec
+	//从连接池获取连接的等待时间
+	poolWait *metrics.HistogramVec
+	//重新连接次数
+	reconnects *metrics.CounterVec
+	//重试预算用完而放弃重试的次数
+	budgetExhausted *metrics.CounterVec
+	//熔断拒绝的调用次数
+	breakerRejects *metrics.CounterVec
+}
+
+//新建客户端指标并注册到registry
+//同一进程中的多个Cli可以共用一个CliMetrics
+func NewCliMetrics(registry *metrics.Registry) *CliMetrics {
+	m := &CliMetrics{
+		calls: metrics.NewCounterVec(
+			"fast_rpc_client_calls_total",
+			"Total number of rpc calls.",
+			"cmd", "version"),
+		errors: metrics.NewCounterVec(
+			"fast_rpc_client_errors_total",
+			"Total number of failed rpc calls.",
+			"cmd", "version"),
+		latency: metrics.NewHistogramVec(
+			"fast_rpc_client_call_seconds",
+			"Latency of rpc calls including retries.",
+			nil,
+			"cmd", "version"),
+		retries: metrics.NewCounterVec(
+			"fast_rpc_client_retries_total",
+			"Total number of rpc call retries.",
+			"cmd", "version"),
+		poolWait: metrics.NewHistogramVec(
+			"fast_rpc_client_pool_wait_seconds",
+			"Time spent waiting for a pooled connection.",
+			nil,
+			"address"),
+		reconnects: metrics.NewCounterVec(
+			"fast_rpc_client_reconnects_total",
+			"Total number of reconnect attempts.",
+			"address"),
+		budgetExhausted: metrics.NewCounterVec(
+			"fast_rpc_client_retry_budget_exhausted_total",
+			"Total number of retries skipped because the retry budget was exhausted.",
+			"cmd", "version"),
+		breakerRejects: metrics.NewCounterVec(
+			"fast_rpc_client_breaker_rejects_total",
+			"Total number of calls rejected by an open circuit breaker.",
+			"address"),
+	}
+	registry.MustRegister(m.calls, m.errors, m.latency, m.retries, m.poolWait, m.reconnects,
+		m.budgetExhausted, m.breakerRejects)
+	return m
+}
+
+//记录一次调用
+func (m *CliMetrics) observeCall(inMsg IMsg, err error, d time.Duration) {
+	if m == nil {
+		return
+	}
+	cmd, version := cmdLabels(inMsg.GetCmd(), inMsg.GetVersion())
+	m.calls.Inc(cmd, version)
+	m.latency.ObserveDuration(d, cmd, version)
+	if err != nil {
+		m.errors.Inc(cmd, version)
+	}
+}
+
+//记录一次重试
+func (m *CliMetrics) observeRetry(inMsg IMsg) {
+	if m == nil {
+		return
+	}
+	m.retries.Inc(cmdLabels(inMsg.GetCmd(), inMsg.GetVersion()))
+}
+
+//记录获取连接的等待时间
+func (m *CliMetrics) observePoolWait(address string, d time.Duration) {
+	if m == nil {
+		return
+	}
+	m.poolWait.ObserveDuration(d, address)
+}
+
+//记录一次重新连接
+func (m *CliMetrics) observeReconnect(address string) {
+	if m == nil {
+		return
+	}
+	m.reconnects.Inc(address)
+}
+
+//记录一次因重试预算用完而放弃的重试
+func (m *CliMetrics) observeBudgetExhausted(inMsg IMsg) {
+	if m == nil {
+		return
+	}
+	m.budgetExhausted.Inc(cmdLabels(inMsg.GetCmd(), inMsg.GetVersion()))
+}
+
+//记录一次熔断拒绝
+func (m *CliMetrics) observeBreakerReject(address string) {
+	if m == nil {
+		return
+	}
+	m.breakerRejects.Inc(address)
+}
+
+func cmdLabels(cmd, version uint16) (string, string) {
+	return strconv.Itoa(int(cmd)), strconv.Itoa(int(version))
+}
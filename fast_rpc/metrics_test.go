@@ -0,0 +1,52 @@
+package fast_rpc
+
+import (
+	"bytes"
+	"context"
+	"github.com/pineal-niwan/busybox/metrics"
+	"strings"
+	"testing"
+)
+
+func TestServiceAndCliMetrics(t *testing.T) {
+	registry := metrics.NewRegistry()
+	option := testOption()
+	option.Metrics = NewServiceMetrics(registry)
+	_, address := startTestService(t, option)
+
+	cliOption := testCliOption()
+	cliOption.Metrics = NewCliMetrics(registry)
+	cli, err := NewCli(context.Background(), address, 1, cliOption, testParseHash())
+	if err != nil {
+		t.Fatalf("new cli error:%+v", err)
+	}
+	defer cli.Close()
+
+	//两次成功调用,一次处理出错
+	for _, text := range []string{"a", "b", "error:bad"} {
+		_, err = cli.CallWithRetry(context.Background(), &testMsg{cmd: testCmdReq, Text: text}, 0)
+		if (err != nil) != strings.HasPrefix(text, "error:") {
+			t.Fatalf("call %s error:%+v", text, err)
+		}
+	}
+
+	var buf bytes.Buffer
+	err = registry.WriteText(&buf)
+	if err != nil {
+		t.Fatalf("write text error:%+v", err)
+	}
+	for _, line := range []string{
+		`fast_rpc_server_requests_total{cmd="1",version="0"} 3`,
+		`fast_rpc_server_errors_total{cmd="1",version="0",code="internal"} 1`,
+		`fast_rpc_server_handle_seconds_count{cmd="1",version="0"} 3`,
+		`fast_rpc_server_handle_seconds_bucket{cmd="1",version="0",le="+Inf"} 3`,
+		`fast_rpc_server_connections 1`,
+		`fast_rpc_client_calls_total{cmd="1",version="0"} 3`,
+		`fast_rpc_client_errors_total{cmd="1",version="0"} 1`,
+		`fast_rpc_client_call_seconds_count{cmd="1",version="0"} 3`,
+	} {
+		if !strings.Contains(buf.String(), line+"\n") {
+			t.Errorf("expect line %s in:\n%s", line, buf.String())
+		}
+	}
+}
@@ -1,10 +1,47 @@
 package fast_rpc
 
-import "github.com/pineal-niwan/busybox/binary"
+import (
+	"github.com/pineal-niwan/busybox/binary"
+	"github.com/pineal-niwan/busybox/util"
+	"hash/crc32"
+	"net"
+)
 
 const (
-	//消息头长度
-	MsgHeadSize = 8
+	//消息头长度 -- 序列化时消息体从这个位置开始
+	MsgHeadSize = 32
+	//旧版本消息头长度 -- 只有Size、Cmd与Version,没有魔数与校验
+	MsgHeadLegacySize = 8
+
+	//旧版本消息头 -- 只在兼容模式下接收与发送
+	MsgHeadLegacy = 1
+	//带魔数与校验的消息头
+	MsgHeadFramed = 2
+
+	//消息头魔数 -- 作为旧版本消息头的消息体大小时超过maxMsgSizeLimit,两种消息头不会混淆
+	MsgMagic = 0xFA57C0DE
+	//协议版本 -- 紧跟在魔数之后
+	MsgProtoVersion = 1
+
+	//消息体大小的上限 -- 不能与魔数冲突
+	maxMsgSizeLimit = 0xF0000000
+	//消息头中参与校验的长度 -- 除最后的校验值以外的部分
+	msgHeadCheckSize = MsgHeadSize - 4
+
+	//标志 -- 消息体已压缩,压缩算法见Codec
+	MsgFlagCompressed = 1 << 0
+	//标志 -- 带有消息体的CRC32校验值
+	MsgFlagBodyCRC = 1 << 1
+	//标志 -- 流的消息,请求编号为流的编号
+	MsgFlagStream = 1 << 2
+	//标志 -- 打开流,Cmd与Version决定服务端的流处理函数
+	MsgFlagStreamOpen = 1 << 3
+	//标志 -- 发送方结束发送,服务端结束时消息体可以带错误消息
+	MsgFlagStreamEnd = 1 << 4
+	//标志 -- 客户端放弃流
+	MsgFlagStreamReset = 1 << 5
+	//标志 -- 单向消息,服务端处理后不回复
+	MsgFlagOneWay = 1 << 6
 )
 
 //消息接口
@@ -22,13 +59,29 @@ type IMsg interface {
 }
 
 //消息头
+//Magic(4) | ProtoVer(1) | Flags(1) | Codec(1) | Accept(1) | Size(4) | Cmd(2) | Version(2) | Seq(4) | Timeout(4) | BodyCRC(4) | HeadCRC(4)
+//HeadCRC为前28个字节的CRC32; 旧版本消息头为 Size(4) | Cmd(2) | Version(2)
 type MsgHead struct {
+	//消息头版本 -- 收到的消息头版本,回复时使用相同的版本
+	HeadVer uint8
+	//标志
+	Flags uint8
+	//消息体的压缩算法,0表示没有压缩
+	Codec uint8
+	//发送方能解压的压缩算法 -- 按位表示,第n位对应编号为n+1的压缩算法
+	Accept uint8
 	//消息体大小
 	Size uint32
 	//消息编号
 	Cmd uint16
 	//消息版本号
 	Version uint16
+	//请求编号 -- 返回消息带回请求的编号,用于多路复用时匹配调用
+	Seq uint32
+	//超时时间(毫秒) -- 请求消息带上客户端剩余的超时时间,0表示不超时
+	Timeout uint32
+	//消息体(压缩后)的CRC32 -- 设置了MsgFlagBodyCRC时有效
+	BodyCRC uint32
 }
 
 //消息头获取code
@@ -36,7 +89,18 @@ func (h MsgHead) GetCode() uint32 {
 	return uint32(h.Cmd) | (uint32(h.Version) << 16)
 }
 
-//反序列化消息头
+//是否以魔数开头
+func hasMsgMagic(buf []byte) bool {
+	return len(buf) >= 4 && uint32LE(buf) == MsgMagic
+}
+
+//按小端读取uint32 -- 与binary包的字节序一致
+func uint32LE(buf []byte) uint32 {
+	return uint32(buf[0]) | uint32(buf[1])<<8 | uint32(buf[2])<<16 | uint32(buf[3])<<24
+}
+
+//反序列化消息头 -- 不以魔数开头时按旧版本消息头解析
+//带魔数的消息头会检查协议版本与消息头校验值
 func UnmarshalMsgHead(buf []byte, option *binary.Option) (head MsgHead, err error) {
 	var reader *binary.BinaryHandler
 
@@ -45,20 +109,93 @@ func UnmarshalMsgHead(buf []byte, option *binary.Option) (head MsgHead, err erro
 		return
 	}
 
-	head.Size, err = reader.ReadUint32()
+	if !hasMsgMagic(buf) {
+		head.HeadVer = MsgHeadLegacy
+		return unmarshalMsgHeadLegacy(reader, head)
+	}
+	if len(buf) < MsgHeadSize {
+		err = binary.ErrOverflow
+		return
+	}
+	if crc32.ChecksumIEEE(buf[:msgHeadCheckSize]) != uint32LE(buf[msgHeadCheckSize:]) {
+		err = ErrBadHeadChecksum
+		return
+	}
+	if buf[4] != MsgProtoVersion {
+		err = NewRPCError(ErrCodeBadRequest, "unsupported protocol version:%+v", buf[4])
+		return
+	}
+	head.HeadVer = MsgHeadFramed
+	head.Flags = buf[5]
+	head.Codec = buf[6]
+	head.Accept = buf[7]
+	reader.ResetPos(8)
+	head, err = unmarshalMsgHeadLegacy(reader, head)
 	if err != nil {
 		return
 	}
-	head.Cmd, err = reader.ReadUint16()
+	head.Seq, err = reader.ReadUint32()
 	if err != nil {
 		return
 	}
-	head.Version, err = reader.ReadUint16()
+	head.Timeout, err = reader.ReadUint32()
+	if err != nil {
+		return
+	}
+	head.BodyCRC, err = reader.ReadUint32()
 	return
 }
 
-//序列化消息头
+//反序列化旧版本消息头的字段
+func unmarshalMsgHeadLegacy(reader *binary.BinaryHandler, head MsgHead) (MsgHead, error) {
+	var err error
+	head.Size, err = reader.ReadUint32()
+	if err != nil {
+		return head, err
+	}
+	head.Cmd, err = reader.ReadUint16()
+	if err != nil {
+		return head, err
+	}
+	head.Version, err = reader.ReadUint16()
+	return head, err
+}
+
+//序列化消息头 -- 写入MsgHeadSize个字节,HeadVer被忽略
 func MarshalMsgHead(writer *binary.BinaryHandler, head MsgHead) (err error) {
+	start := writer.Len()
+	err = writer.WriteUint32(MsgMagic)
+	if err != nil {
+		return
+	}
+	for _, b := range []byte{MsgProtoVersion, head.Flags, head.Codec, head.Accept} {
+		err = writer.WriteByte(b)
+		if err != nil {
+			return
+		}
+	}
+	err = marshalMsgHeadLegacy(writer, head)
+	if err != nil {
+		return
+	}
+	err = writer.WriteUint32(head.Seq)
+	if err != nil {
+		return
+	}
+	err = writer.WriteUint32(head.Timeout)
+	if err != nil {
+		return
+	}
+	err = writer.WriteUint32(head.BodyCRC)
+	if err != nil {
+		return
+	}
+	//消息头校验值
+	return writer.WriteUint32(crc32.ChecksumIEEE(writer.Data()[start:writer.Len()]))
+}
+
+//序列化旧版本消息头
+func marshalMsgHeadLegacy(writer *binary.BinaryHandler, head MsgHead) (err error) {
 	err = writer.WriteUint32(head.Size)
 	if err != nil {
 		return
@@ -70,3 +207,78 @@ func MarshalMsgHead(writer *binary.BinaryHandler, head MsgHead) (err error) {
 	err = writer.WriteUint16(head.Version)
 	return
 }
+
+//回填消息头
+//消息序列化后由框架重写buf开头的消息头,以写入请求编号等由框架维护的字段
+//旧版本消息头写在buf[MsgHeadSize-MsgHeadLegacySize:MsgHeadSize],发送时从headOffset开始
+func PutMsgHead(buf []byte, head MsgHead, option *binary.Option) error {
+	if len(buf) < MsgHeadSize {
+		return binary.ErrOverflow
+	}
+	writer, err := binary.NewWriteBinaryHandler(buf[headOffset(head):MsgHeadSize], option)
+	if err != nil {
+		return err
+	}
+	if head.HeadVer == MsgHeadLegacy {
+		return marshalMsgHeadLegacy(writer, head)
+	}
+	return MarshalMsgHead(writer, head)
+}
+
+//消息头在序列化缓冲区中的起始位置
+func headOffset(head MsgHead) int {
+	if head.HeadVer == MsgHeadLegacy {
+		return MsgHeadSize - MsgHeadLegacySize
+	}
+	return 0
+}
+
+//读取消息头 -- 先读取4个字节检查魔数,再读取剩余部分
+//legacy为true时接收旧版本消息头,否则不以魔数开头的数据直接返回ErrBadMagic
+//返回后消息体从buf[MsgHeadSize:]开始读取
+func readMsgHead(conn net.Conn, buf []byte, option *binary.Option, legacy bool) (MsgHead, error) {
+	if len(buf) < MsgHeadSize {
+		return MsgHead{}, binary.ErrOverflow
+	}
+	err := util.NetReadBytes(conn, buf[:4])
+	if err != nil {
+		return MsgHead{}, err
+	}
+	headSize := MsgHeadSize
+	if !hasMsgMagic(buf) {
+		if !legacy {
+			return MsgHead{}, ErrBadMagic
+		}
+		headSize = MsgHeadLegacySize
+	}
+	err = util.NetReadBytes(conn, buf[4:headSize])
+	if err != nil {
+		return MsgHead{}, err
+	}
+	return UnmarshalMsgHead(buf[:headSize], option)
+}
+
+//由序列化后的消息生成消息头
+func newMsgHead(msg IMsg, size int, seq uint32) MsgHead {
+	return MsgHead{
+		HeadVer: MsgHeadFramed,
+		Size:    uint32(size - MsgHeadSize),
+		Cmd:     msg.GetCmd(),
+		Version: msg.GetVersion(),
+		Seq:     seq,
+	}
+}
+
+//根据解析表解析消息
+func parseMsgWithHash(msgParseHash map[uint32]MsgParseHandler, head MsgHead, buf []byte, option *binary.Option) (IMsg, error) {
+	if msgParseHash == nil {
+		return nil, ErrBadMsgParser
+	}
+
+	parseHandler, ok := msgParseHash[head.GetCode()]
+	if !ok || parseHandler == nil {
+		return nil, WrapRPCError(ErrCodeNotFound, ErrBadMsgParser,
+			"bad msg parser cmd:%+v, version:%+v", head.Cmd, head.Version)
+	}
+	return parseHandler(buf, option)
+}
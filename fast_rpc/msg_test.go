@@ -0,0 +1,130 @@
+package fast_rpc
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestMsgHeadChecksum(t *testing.T) {
+	head := MsgHead{HeadVer: MsgHeadFramed, Flags: MsgFlagBodyCRC, Size: 4, Cmd: 7, Seq: 9, Timeout: 100, BodyCRC: 0x1234}
+	buf := make([]byte, MsgHeadSize)
+	err := PutMsgHead(buf, head, testBinOption)
+	if err != nil {
+		t.Fatalf("put head error:%+v", err)
+	}
+	outHead, err := UnmarshalMsgHead(buf, testBinOption)
+	if err != nil || outHead != head {
+		t.Fatalf("unmarshal head, head:%+v err:%+v", outHead, err)
+	}
+
+	//消息头任何一个字节被改动都能发现
+	buf[10] ^= 0x01
+	_, err = UnmarshalMsgHead(buf, testBinOption)
+	if err != ErrBadHeadChecksum {
+		t.Errorf("expect head checksum error, got %+v", err)
+	}
+
+	//消息体校验
+	_, err = decodeBody(head, []byte("abcd"), 1024, 0)
+	if err != ErrBadBodyChecksum {
+		t.Errorf("expect body checksum error, got %+v", err)
+	}
+}
+
+func TestServiceRejectGarbage(t *testing.T) {
+	_, address := startTestService(t, testOption())
+
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatalf("dial error:%+v", err)
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: x\r\n\r\n"))
+	if err != nil {
+		t.Fatalf("write error:%+v", err)
+	}
+	//不以魔数开头的数据被立即断开
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = conn.Read(make([]byte, 16))
+	if ne, ok := err.(net.Error); err == nil || (ok && ne.Timeout()) {
+		t.Errorf("expect connection closed, got %+v", err)
+	}
+}
+
+func TestLegacyHead(t *testing.T) {
+	option := testOption()
+	option.LegacyHead = true
+	option.AsyncDispatch = true
+	option.WorkerNum = 2
+	option.BodyChecksum = true
+	_, address := startTestService(t, option)
+
+	legacyOption := testCliOption()
+	legacyOption.LegacyHead = true
+	legacyCli, err := NewCli(context.Background(), address, 1, legacyOption, testParseHash())
+	if err != nil {
+		t.Fatalf("new cli error:%+v", err)
+	}
+	defer legacyCli.Close()
+	checksumOption := testCliOption()
+	checksumOption.BodyChecksum = true
+	cli, err := NewCli(context.Background(), address, 1, checksumOption, testParseHash())
+	if err != nil {
+		t.Fatalf("new cli error:%+v", err)
+	}
+	defer cli.Close()
+
+	//兼容模式下新旧消息头的客户端都能访问
+	for _, c := range []*Cli{legacyCli, cli} {
+		outMsg, err := c.CallWithRetry(context.Background(), &testMsg{cmd: testCmdReq, Text: "hello"}, 0)
+		if err != nil || outMsg.(*testMsg).Text != "hello" {
+			t.Errorf("call, msg:%+v err:%+v", outMsg, err)
+		}
+	}
+
+	//MuxCli不支持旧版本消息头
+	_, err = NewMuxCli(context.Background(), address, legacyOption, testParseHash())
+	if err != ErrInvalidOption {
+		t.Errorf("expect invalid option, got %+v", err)
+	}
+
+	//非兼容模式的服务拒绝旧版本消息头
+	_, strictAddress := startTestService(t, testOption())
+	strictCli, err := NewCli(context.Background(), strictAddress, 1, legacyOption, testParseHash())
+	if err != nil {
+		t.Fatalf("new cli error:%+v", err)
+	}
+	defer strictCli.Close()
+	_, err = strictCli.CallWithRetry(context.Background(), &testMsg{cmd: testCmdReq, Text: "hello"}, 0)
+	if err == nil {
+		t.Errorf("expect legacy head rejected")
+	}
+}
+
+func TestBufferSmallerThanHead(t *testing.T) {
+	//缓冲区放不下消息头时选项无效
+	option := testOption()
+	option.BufferSize = MsgHeadSize - 1
+	if option.Validate() != ErrInvalidOption {
+		t.Errorf("expect invalid service option")
+	}
+	cliOption := testCliOption()
+	cliOption.BufferSize = MsgHeadSize - 1
+	if cliOption.Validate() != ErrInvalidOption {
+		t.Errorf("expect invalid cli option")
+	}
+
+	//没有检查选项时服务扩大缓冲区,连接正常处理
+	_, address := startTestService(t, option)
+	cli, err := NewCli(context.Background(), address, 1, testCliOption(), testParseHash())
+	if err != nil {
+		t.Fatalf("new cli error:%+v", err)
+	}
+	defer cli.Close()
+	outMsg, err := cli.CallWithRetry(context.Background(), &testMsg{cmd: testCmdReq, Text: "small"}, 0)
+	if err != nil || outMsg.(*testMsg).Text != "small" {
+		t.Errorf("call with small buffer, msg:%+v err:%+v", outMsg, err)
+	}
+}
@@ -0,0 +1,522 @@
+package fast_rpc
+
+import (
+	"context"
+	"github.com/pineal-niwan/busybox/buffer"
+	"github.com/pineal-niwan/busybox/util"
+	"go.uber.org/zap"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//多路复用客户端
+//所有调用共用一个连接,请求连续发送而不等待返回,返回消息按请求编号匹配给调用方,可以乱序返回
+type MuxCli struct {
+	//参数
+	*CliOption
+	//日志
+	logger *zap.Logger
+	//连接器
+	dialer util.ContextDialer
+	//服务地址
+	address string
+	//缓冲池
+	bufferPool *sync.Pool
+	//消息解析
+	msgParseHash map[uint32]MsgParseHandler
+	//请求编号
+	seq uint32
+	//熔断器
+	breaker *circuitBreaker
+	//服务端能解压的算法 -- 从返回的v2消息头中得到
+	peerAccept uint32
+
+	//当前连接
+	conn *muxConn
+	//正在建立连接时不为nil,建立完成后关闭 -- 同一时间只有一个调用建立连接
+	dialing chan struct{}
+	closed  bool
+	sync.Mutex
+}
+
+//多路复用的连接
+type muxConn struct {
+	net.Conn
+	//发送锁
+	writeLock sync.Mutex
+	//等待返回的调用
+	pending map[uint32]chan *_CallRet
+	//打开的流
+	streams map[uint32]*ClientStream
+	//连接出错后的错误
+	err error
+	sync.Mutex
+}
+
+//新建多路复用客户端 -- address的格式同NewCli
+func NewMuxCli(
+	ctx context.Context,
+	address string,
+	option *CliOption,
+	msgParseHash map[uint32]MsgParseHandler) (*MuxCli, error) {
+	//旧版本消息头没有请求编号,不能多路复用
+	if option.LegacyHead {
+		return nil, ErrInvalidOption
+	}
+	logger, err := option.newLogger()
+	if err != nil {
+		return nil, err
+	}
+
+	bufferPool := &sync.Pool{
+		New: func() interface{} {
+			return make([]byte, option.BufferSize)
+		},
+	}
+
+	cli := &MuxCli{
+		CliOption:    option,
+		logger:       logger,
+		dialer:       option.dialer(),
+		address:      address,
+		bufferPool:   bufferPool,
+		msgParseHash: msgParseHash,
+		breaker:      newCircuitBreaker(option.Breaker),
+	}
+	//先建立连接
+	_, err = cli.getConn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return cli, nil
+}
+
+//关闭
+func (cli *MuxCli) Close() error {
+	cli.Lock()
+	conn := cli.conn
+	cli.conn = nil
+	cli.closed = true
+	cli.Unlock()
+
+	if conn != nil {
+		conn.fail(ErrCliClosed)
+	}
+	return nil
+}
+
+//获取连接 -- 连接失效时重新建立
+//建立连接时不持有锁,其他调用等待建立完成或者自己的ctx结束
+func (cli *MuxCli) getConn(ctx context.Context) (*muxConn, error) {
+	for {
+		cli.Lock()
+		if cli.closed {
+			cli.Unlock()
+			return nil, ErrCliClosed
+		}
+		if cli.conn != nil && cli.conn.alive() {
+			conn := cli.conn
+			cli.Unlock()
+			return conn, nil
+		}
+		if cli.dialing != nil {
+			//等待正在建立的连接,建立失败时自己重新建立
+			dialing := cli.dialing
+			cli.Unlock()
+			select {
+			case <-dialing:
+				continue
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+		if cli.conn != nil {
+			//原有连接已失效
+			cli.Metrics.observeReconnect(cli.address)
+		}
+		dialing := make(chan struct{})
+		cli.dialing = dialing
+		cli.Unlock()
+
+		conn, err := cli.dial(ctx)
+
+		cli.Lock()
+		cli.dialing = nil
+		close(dialing)
+		if err == nil && cli.closed {
+			//建立连接期间客户端已关闭
+			err = ErrCliClosed
+		}
+		if err == nil {
+			cli.conn = conn
+			go cli.readLoop(conn)
+		}
+		cli.Unlock()
+		if err != nil {
+			if conn != nil {
+				conn.fail(err)
+			}
+			return nil, err
+		}
+		return conn, nil
+	}
+}
+
+//建立连接 -- 连接、TLS握手与认证
+func (cli *MuxCli) dial(ctx context.Context) (*muxConn, error) {
+	//地址可以是unix socket
+	network, address, err := util.ParseAddress(cli.address)
+	if err != nil {
+		return nil, err
+	}
+	netConn, err := util.DialNetwork(ctx, cli.dialer, network, address)
+	if err != nil {
+		return nil, err
+	}
+	if cli.TLSConfig != nil {
+		netConn, err = util.ClientHandshake(ctx, netConn, address, cli.TLSConfig)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if cli.Authenticator != nil {
+		err = cli.Authenticator.Handshake(ctx, netConn)
+		if err != nil {
+			netConn.Close()
+			return nil, err
+		}
+	}
+	return &muxConn{
+		Conn:    netConn,
+		pending: make(map[uint32]chan *_CallRet),
+		streams: make(map[uint32]*ClientStream),
+	}, nil
+}
+
+//多次调用 -- 经过拦截器后调用
+//只有连接出错时才重试,重试时重新建立连接
+func (cli *MuxCli) CallWithRetry(ctx context.Context, inMsg IMsg, retryTimes int) (outMsg IMsg, err error) {
+	//单向消息不会有返回,不能调用
+	if isOneWayMsg(inMsg) {
+		return nil, ErrOneWayCall
+	}
+	if cli.Metrics != nil {
+		start := time.Now()
+		defer func() {
+			cli.Metrics.observeCall(inMsg, err, time.Since(start))
+		}()
+	}
+	if len(cli.Interceptors) == 0 {
+		return cli.callWithRetry(ctx, inMsg, retryTimes)
+	}
+	invoker := chainClientInterceptors(cli.Interceptors, newCallHead(inMsg),
+		func(ctx context.Context, inMsg IMsg) (IMsg, error) {
+			return cli.callWithRetry(ctx, inMsg, retryTimes)
+		})
+	return invoker(ctx, inMsg)
+}
+
+//调用一次
+func (cli *MuxCli) Call(ctx context.Context, inMsg IMsg) (IMsg, error) {
+	return cli.CallWithRetry(ctx, inMsg, 0)
+}
+
+//发送单向消息 -- 服务端处理后不回复,只有发送失败时返回错误,不重试
+func (cli *MuxCli) Notify(ctx context.Context, inMsg IMsg) (err error) {
+	if cli.Metrics != nil {
+		start := time.Now()
+		defer func() {
+			cli.Metrics.observeCall(inMsg, err, time.Since(start))
+		}()
+	}
+	if len(cli.Interceptors) == 0 {
+		return cli.notify(ctx, inMsg)
+	}
+	//经过拦截器,没有返回的消息
+	_, err = chainClientInterceptors(cli.Interceptors, newCallHead(inMsg),
+		func(ctx context.Context, inMsg IMsg) (IMsg, error) {
+			return nil, cli.notify(ctx, inMsg)
+		})(ctx, inMsg)
+	return err
+}
+
+//发送单向消息
+func (cli *MuxCli) notify(ctx context.Context, inMsg IMsg) error {
+	err := cli.breaker.allow()
+	if err != nil {
+		cli.Metrics.observeBreakerReject(cli.address)
+		return err
+	}
+	conn, err := cli.getConn(ctx)
+	if err != nil {
+		cli.breaker.record(ctx, err, true)
+		return err
+	}
+	callRet := cli.send(ctx, conn, atomic.AddUint32(&cli.seq, 1), inMsg, MsgFlagOneWay)
+	cli.breaker.record(ctx, callRet.err, callRet.needResetConn)
+	if callRet.needResetConn {
+		conn.fail(callRet.err)
+	}
+	return callRet.err
+}
+
+//多次调用
+func (cli *MuxCli) callWithRetry(ctx context.Context, inMsg IMsg, retryTimes int) (IMsg, error) {
+	cli.RetryBudget.deposit()
+	callRet := cli.callWithBreaker(ctx, inMsg)
+	for i := 0; i < retryTimes && callRet.err != nil && callRet.needResetConn && ctx.Err() == nil; i++ {
+		//申请重试预算并退避等待
+		retry, retryErr := cli.beforeRetry(ctx, inMsg, i)
+		if !retry {
+			if retryErr != nil {
+				return nil, retryErr
+			}
+			break
+		}
+		callRet = cli.callWithBreaker(ctx, inMsg)
+	}
+	return callRet.msg, callRet.err
+}
+
+//经过熔断器调用一次
+func (cli *MuxCli) callWithBreaker(ctx context.Context, inMsg IMsg) *_CallRet {
+	err := cli.breaker.allow()
+	if err != nil {
+		cli.Metrics.observeBreakerReject(cli.address)
+		return &_CallRet{err: err}
+	}
+	callRet := cli.call(ctx, inMsg)
+	cli.breaker.record(ctx, callRet.err, callRet.needResetConn)
+	return callRet
+}
+
+//熔断状态 -- 没有设置熔断参数时总是BreakerClosed
+func (cli *MuxCli) BreakerState() BreakerState {
+	return cli.breaker.getState()
+}
+
+//调用RPC - 发送请求后等待读协程分发的返回消息
+func (cli *MuxCli) call(ctx context.Context, inMsg IMsg) *_CallRet {
+	conn, err := cli.getConn(ctx)
+	if err != nil {
+		return &_CallRet{err: err, needResetConn: true}
+	}
+
+	//先登记,防止返回消息先于登记到达
+	seq := atomic.AddUint32(&cli.seq, 1)
+	retChan, err := conn.register(seq)
+	if err != nil {
+		return &_CallRet{err: err, needResetConn: true}
+	}
+
+	callRet := cli.send(ctx, conn, seq, inMsg, 0)
+	if callRet.err != nil {
+		conn.unregister(seq)
+		if callRet.needResetConn {
+			conn.fail(callRet.err)
+		}
+		return callRet
+	}
+
+	select {
+	case callRet = <-retChan:
+		return callRet
+	case <-ctx.Done():
+		//与Cli一样按连接错误计入熔断,共用的连接不重置
+		conn.unregister(seq)
+		return &_CallRet{err: ctx.Err(), needResetConn: true}
+	}
+}
+
+//序列化并发送请求
+func (cli *MuxCli) send(ctx context.Context, conn *muxConn, seq uint32, inMsg IMsg, flags uint8) *_CallRet {
+	callRet := &_CallRet{}
+
+	buf := cli.bufferPool.Get().([]byte)
+	defer func() {
+		//归还可复用的缓冲区
+		if len(buf) <= cli.BufferRecycleSize {
+			cli.bufferPool.Put(buf)
+		}
+	}()
+
+	size, out, err := inMsg.Marshal(buf, cli.Option)
+	if err != nil {
+		return callRet.set(nil, err, false, nil)
+	}
+	buf = out
+	if size > cli.MaxMsgSize {
+		return callRet.set(
+			nil,
+			WrapRPCError(ErrCodeOverflow, ErrMsgTooLarge, "rpc client too long msg size:%+v", size),
+			false,
+			nil)
+	}
+	//写入请求编号与剩余的超时时间
+	timeout, err := timeoutFromContext(ctx)
+	if err != nil {
+		return callRet.set(nil, err, false, nil)
+	}
+	head := newMsgHead(inMsg, size, seq)
+	head.Timeout = timeout
+	head.Flags = flags
+	data, err := cli.encodeRequest(buf, size, head, uint8(atomic.LoadUint32(&cli.peerAccept)))
+	if err != nil {
+		return callRet.set(nil, err, false, nil)
+	}
+	return cli.writeBytes(ctx, conn, data)
+}
+
+//发送数据 -- 连接上的发送互斥
+func (cli *MuxCli) writeBytes(ctx context.Context, conn *muxConn, data []byte) *_CallRet {
+	callRet := &_CallRet{}
+
+	conn.writeLock.Lock()
+	defer conn.writeLock.Unlock()
+	//没有设置超时时deadline为零值,即不超时
+	deadline, _ := ctx.Deadline()
+	err := conn.SetWriteDeadline(deadline)
+	if err != nil {
+		return callRet.set(nil, err, true, nil)
+	}
+	err = util.NetSendBytes(conn, data)
+	if err != nil {
+		return callRet.set(nil, err, true, nil)
+	}
+	return callRet
+}
+
+//读协程 -- 接收返回消息并分发给对应的调用
+func (cli *MuxCli) readLoop(conn *muxConn) {
+	var head MsgHead
+	var size int
+	var err error
+
+	buf := make([]byte, cli.BufferSize)
+	defer func() {
+		//捕获panic
+		panicErr := util.Recover(recover())
+		if panicErr != nil {
+			cli.logger.Error("mux client read panic",
+				zap.Error(panicErr.Err),
+				zap.String("stack", string(panicErr.Stack())))
+			err = panicErr.Err
+		}
+		conn.fail(err)
+	}()
+
+	for {
+		/***********************接收消息头***************/
+		head, err = readMsgHead(conn, buf, cli.Option, false)
+		if err != nil {
+			//客户端关闭或服务端断开连接
+			if isPeerClosed(err) {
+				cli.logger.Debug("mux client connection closed",
+					zap.String("remote", cli.address),
+					zap.Error(err))
+			} else {
+				cli.logger.Error("mux client receive head error",
+					zap.String("remote", cli.address),
+					zap.Error(err))
+			}
+			return
+		}
+		//记录服务端能解压的算法
+		atomic.StoreUint32(&cli.peerAccept, uint32(head.Accept))
+
+		/***********************接收消息体***************/
+		//流的控制消息可以没有消息体
+		size = int(head.Size)
+		if (size == 0 && head.Flags&MsgFlagStream == 0) || size > cli.MaxMsgSize {
+			cli.logger.Error("mux client size of outMsg error",
+				zap.String("remote", cli.address),
+				zap.Uint16("cmd", head.Cmd),
+				zap.Int("msgSize", size))
+			err = WrapRPCError(ErrCodeOverflow, ErrMsgTooLarge, "msg size out of range :%+v", size)
+			return
+		}
+		buf = buffer.BytesExtends(buf, MsgHeadSize+size, 0)
+		if size > 0 {
+			err = util.NetReadBytes(conn, buf[MsgHeadSize:MsgHeadSize+size])
+			if err != nil {
+				return
+			}
+		}
+
+		/***********************解析并分发***************/
+		if head.Flags&MsgFlagStream != 0 {
+			cli.dispatchStream(conn, head, buf[MsgHeadSize:MsgHeadSize+size])
+		} else if retChan := conn.unregister(head.Seq); retChan != nil {
+			//调用方没有放弃等待
+			var outMsg IMsg
+			body, parseErr := decodeBody(head, buf[MsgHeadSize:MsgHeadSize+size], cli.MaxMsgSize, cli.Compression.accept())
+			if parseErr == nil {
+				outMsg, parseErr = parseReply(cli.msgParseHash, head, body, cli.Option)
+			}
+			retChan <- &_CallRet{msg: outMsg, err: parseErr}
+		}
+
+		//缓冲区过大，resize
+		if len(buf) > cli.BufferRecycleSize {
+			buf = make([]byte, cli.BufferSize)
+		}
+	}
+}
+
+//连接是否可用
+func (conn *muxConn) alive() bool {
+	conn.Lock()
+	defer conn.Unlock()
+	return conn.err == nil
+}
+
+//登记等待返回的调用
+func (conn *muxConn) register(seq uint32) (chan *_CallRet, error) {
+	conn.Lock()
+	defer conn.Unlock()
+	if conn.err != nil {
+		return nil, conn.err
+	}
+	retChan := make(chan *_CallRet, 1)
+	conn.pending[seq] = retChan
+	return retChan, nil
+}
+
+//取消登记
+func (conn *muxConn) unregister(seq uint32) chan *_CallRet {
+	conn.Lock()
+	defer conn.Unlock()
+	retChan, ok := conn.pending[seq]
+	if ok {
+		delete(conn.pending, seq)
+	}
+	return retChan
+}
+
+//连接失效 -- 关闭连接并通知所有等待的调用
+func (conn *muxConn) fail(err error) {
+	conn.Lock()
+	if conn.err != nil {
+		conn.Unlock()
+		return
+	}
+	if err == nil {
+		err = ErrUnknown
+	}
+	conn.err = err
+	pending := conn.pending
+	conn.pending = nil
+	streams := conn.streams
+	conn.streams = nil
+	conn.Unlock()
+
+	conn.Close()
+	for _, retChan := range pending {
+		retChan <- &_CallRet{err: err, needResetConn: true}
+	}
+	for _, stream := range streams {
+		stream.finish(err)
+	}
+}
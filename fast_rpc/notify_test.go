@@ -0,0 +1,153 @@
+package fast_rpc
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+var (
+	//单向消息处理后通知收到的文本
+	testNotified = make(chan string, 16)
+)
+
+//单向消息处理 -- 记录文本,没有返回消息
+func testNotifyHandler(inMsg IMsg) (IMsg, error) {
+	testNotified <- inMsg.(*testMsg).Text
+	return nil, nil
+}
+
+func TestNotify(t *testing.T) {
+	//顺序处理与异步分发的服务都支持单向消息
+	for _, async := range []bool{false, true} {
+		option := testOption()
+		option.AsyncDispatch = async
+		option.WorkerNum = 2
+		_, address := startTestService(t, option)
+
+		//只有一个连接,单向消息后的调用收到的必须是自己的返回
+		cli, err := NewCli(context.Background(), address, 1, testCliOption(), testParseHash())
+		if err != nil {
+			t.Fatalf("new cli error:%+v", err)
+		}
+		muxCli, err := NewMuxCli(context.Background(), address, testCliOption(), testParseHash())
+		if err != nil {
+			t.Fatalf("new mux cli error:%+v", err)
+		}
+		for _, notifier := range []Notifier{cli, muxCli} {
+			text := fmt.Sprintf("event %T async:%v", notifier, async)
+			err = notifier.Notify(context.Background(), &testMsg{cmd: testCmdNotify, Text: text})
+			if err != nil {
+				t.Fatalf("notify error:%+v", err)
+			}
+			select {
+			case got := <-testNotified:
+				if got != text {
+					t.Errorf("expect %s got %s", text, got)
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("expect notify handled")
+			}
+			outMsg, err := notifier.(Caller).CallWithRetry(context.Background(), &testMsg{cmd: testCmdReq, Text: "after"}, 0)
+			if err != nil || outMsg.(*testMsg).Text != "after" {
+				t.Errorf("call after notify, msg:%+v err:%+v", outMsg, err)
+			}
+		}
+		cli.Close()
+		muxCli.Close()
+	}
+}
+
+//单向消息 -- 与生成的代码一样实现OneWay
+type testOneWayMsg struct {
+	testMsg
+}
+
+func (msg *testOneWayMsg) OneWay() bool {
+	return true
+}
+
+func TestOneWayMsgCall(t *testing.T) {
+	_, address := startTestService(t, testOption())
+
+	cli, err := NewCli(context.Background(), address, 1, testCliOption(), testParseHash())
+	if err != nil {
+		t.Fatalf("new cli error:%+v", err)
+	}
+	defer cli.Close()
+	muxCli, err := NewMuxCli(context.Background(), address, testCliOption(), testParseHash())
+	if err != nil {
+		t.Fatalf("new mux cli error:%+v", err)
+	}
+	defer muxCli.Close()
+
+	//单向消息不能调用,只能通过Notify发送
+	for _, caller := range []Caller{cli, muxCli} {
+		msg := &testOneWayMsg{testMsg{cmd: testCmdNotify, Text: fmt.Sprintf("one-way %T", caller)}}
+		_, err = caller.CallWithRetry(context.Background(), msg, 0)
+		if err != ErrOneWayCall {
+			t.Errorf("expect one-way call error, got %+v", err)
+		}
+		err = caller.(Notifier).Notify(context.Background(), msg)
+		if err != nil {
+			t.Fatalf("notify error:%+v", err)
+		}
+		select {
+		case got := <-testNotified:
+			if got != msg.Text {
+				t.Errorf("expect %s got %s", msg.Text, got)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("expect notify handled")
+		}
+	}
+}
+
+func TestNotifyInterceptors(t *testing.T) {
+	_, address := startTestService(t, testOption())
+
+	//拦截器记录单向消息,返回的消息为nil
+	var notified []string
+	cliOption := testCliOption()
+	cliOption.Interceptors = []ClientInterceptor{
+		func(ctx context.Context, head MsgHead, inMsg IMsg, invoker Invoker) (IMsg, error) {
+			outMsg, err := invoker(ctx, inMsg)
+			if head.Cmd == testCmdNotify && outMsg == nil && err == nil {
+				notified = append(notified, inMsg.(*testMsg).Text)
+			}
+			return outMsg, err
+		},
+	}
+	cli, err := NewCli(context.Background(), address, 1, cliOption, testParseHash())
+	if err != nil {
+		t.Fatalf("new cli error:%+v", err)
+	}
+	defer cli.Close()
+	muxCli, err := NewMuxCli(context.Background(), address, cliOption, testParseHash())
+	if err != nil {
+		t.Fatalf("new mux cli error:%+v", err)
+	}
+	defer muxCli.Close()
+	balancedCli, err := NewBalancedCli(context.Background(), StaticResolver{address}, 1,
+		cliOption, testBalancerOption(PolicyRoundRobin), testParseHash())
+	if err != nil {
+		t.Fatalf("new balanced cli error:%+v", err)
+	}
+	defer balancedCli.Close()
+
+	var expect []string
+	for _, notifier := range []Notifier{cli, muxCli, balancedCli} {
+		text := fmt.Sprintf("event %T", notifier)
+		expect = append(expect, text)
+		err = notifier.Notify(context.Background(), &testMsg{cmd: testCmdNotify, Text: text})
+		if err != nil {
+			t.Fatalf("notify error:%+v", err)
+		}
+		<-testNotified
+	}
+	if strings.Join(notified, ",") != strings.Join(expect, ",") {
+		t.Errorf("expect intercepted %v, got %v", expect, notified)
+	}
+}
@@ -1,7 +1,11 @@
 package fast_rpc
 
 import (
+	"crypto/tls"
 	"github.com/pineal-niwan/busybox/binary"
+	"github.com/pineal-niwan/busybox/util"
+	"go.uber.org/zap"
+	"net"
 	"time"
 )
 
@@ -21,6 +25,46 @@ type Option struct {
 	MaxMsgSize int
 	//每个连接的buffer回收门槛
 	BufferRecycleSize int
+	//异步分发 -- 同一连接上的消息交给处理协程池并发处理,返回消息通过请求编号与请求匹配
+	//缺省为顺序处理,一个消息处理并返回后才读取下一个消息
+	AsyncDispatch bool
+	//异步分发时处理协程的数量
+	WorkerNum int
+	//异步分发时等待处理的消息队列长度,队列满时暂停读取
+	WorkerQueueSize int
+	//每个连接等待发送的结果消息队列长度,0表示使用缺省长度
+	//队列满时说明对端没有读取,丢弃结果消息并关闭连接
+	WriteQueueSize int
+	//拦截器 -- 排在前面的在外层
+	Interceptors []ServerInterceptor
+	//指标 -- 为nil时不统计
+	Metrics *ServiceMetrics
+	//TLS配置 -- 不为nil时监听端口接收TLS连接,要求客户端证书时设置ClientAuth与ClientCAs
+	TLSConfig *tls.Config
+	//认证 -- 不为nil时连接建立后先完成认证,失败的连接在读取任何消息前被关闭
+	Authenticator Authenticator
+	//TLS握手与认证的超时时间,0表示使用IdleTimeout
+	//设置了TLSConfig或Authenticator时两者不能都为0,避免不发送数据的连接一直占用
+	HandshakeTimeout time.Duration
+	//连接空闲(等待下一个消息头)的超时时间,0表示不限制
+	IdleTimeout time.Duration
+	//收到消息头的第一个字节后读完消息头的超时时间,0表示不限制
+	HeadReadTimeout time.Duration
+	//读完消息头后读完消息体的超时时间,0表示不限制
+	BodyReadTimeout time.Duration
+	//发送一个结果消息的超时时间,0表示不限制
+	WriteTimeout time.Duration
+	//压缩 -- 为nil时不压缩结果消息,也不接收压缩的请求消息
+	Compression *CompressOption
+	//结果消息带上消息体的CRC32校验值 -- 请求消息带有校验值时总是检查
+	BodyChecksum bool
+	//兼容模式 -- 接收没有魔数与校验的旧版本消息头,并以旧版本消息头回复
+	//旧版本消息头没有请求编号,这样的连接总是顺序处理
+	LegacyHead bool
+	//限流 -- 为nil时不限制,负载仍然可以通过Service.Load查询
+	Limits *LimitOption
+	//不回复服务描述 -- 不希望对外暴露注册的消息时设置
+	DisableDescribe bool
 }
 
 func (option *Option) Validate() error {
@@ -36,9 +80,69 @@ func (option *Option) Validate() error {
 		option.BufferRecycleSize == 0 {
 		return ErrInvalidOption
 	}
+
+	//缓冲区至少能放下消息头
+	if option.BufferSize < MsgHeadSize {
+		return ErrInvalidOption
+	}
+
+	if option.HandshakeTimeout < 0 ||
+		option.IdleTimeout < 0 ||
+		option.HeadReadTimeout < 0 ||
+		option.BodyReadTimeout < 0 ||
+		option.WriteTimeout < 0 {
+		return ErrInvalidOption
+	}
+
+	//握手需要超时
+	if (option.TLSConfig != nil || option.Authenticator != nil) && option.handshakeTimeout() == 0 {
+		return ErrInvalidOption
+	}
+
+	//消息体大小不能与魔数冲突
+	if uint64(option.MaxMsgSize) >= maxMsgSizeLimit {
+		return ErrInvalidOption
+	}
+
+	if option.Compression != nil {
+		err := option.Compression.Validate()
+		if err != nil {
+			return err
+		}
+	}
+
+	if option.AsyncDispatch &&
+		(option.WorkerNum <= 0 ||
+			option.WorkerQueueSize < 0 ||
+			option.WriteQueueSize < 0) {
+		return ErrInvalidOption
+	}
+
+	if option.Limits != nil {
+		return option.Limits.Validate()
+	}
 	return nil
 }
 
+//TLS握手与认证的超时时间 -- 没有设置时使用空闲超时
+func (option *Option) handshakeTimeout() time.Duration {
+	if option.HandshakeTimeout > 0 {
+		return option.HandshakeTimeout
+	}
+	return option.IdleTimeout
+}
+
+//缺省的发送队列长度
+const defaultWriteQueueSize = 16
+
+//每个连接等待发送的结果消息队列长度
+func (option *Option) writeQueueSize() int {
+	if option.WriteQueueSize > 0 {
+		return option.WriteQueueSize
+	}
+	return defaultWriteQueueSize
+}
+
 type CliOption struct {
 	//序列化选项
 	*binary.Option
@@ -49,8 +153,46 @@ type CliOption struct {
 	MaxMsgSize int
 	//每个连接的buffer回收门槛
 	BufferRecycleSize int
-	//退火时间
+	//退火时间 -- 重试前的等待时间按指数增长,并随机抖动
 	RetreatTime time.Duration
+	//退火时间上限,0表示不限制
+	RetreatMaxTime time.Duration
+	//熔断参数 -- 为nil时不熔断
+	Breaker *BreakerOption
+	//重试预算 -- 可以多个客户端共用,为nil时不限制
+	RetryBudget *RetryBudget
+	//连接池最少保持的连接数,0表示连接全部按需建立
+	PoolMinSize int
+	//连接最长使用时间,0表示不限制
+	PoolMaxLifetime time.Duration
+	//连接最长空闲时间,0表示不限制
+	PoolMaxIdleTime time.Duration
+	//后台检查空闲连接的间隔,0表示不检查
+	PoolHealthCheckInterval time.Duration
+	//心跳间隔 -- 连接池中的连接空闲超过此时间后发送心跳,没有返回的连接被替换,0表示不发送
+	PingInterval time.Duration
+	//等待心跳返回的时间,0表示与心跳间隔相同
+	PingTimeout time.Duration
+	//拦截器 -- 排在前面的在外层
+	//作用于Call与Notify(返回的消息为nil),不作用于流
+	Interceptors []ClientInterceptor
+	//指标 -- 为nil时不统计
+	Metrics *CliMetrics
+	//日志 -- 为nil时新建生产环境的日志
+	Logger *zap.Logger
+	//连接器 -- 为nil时建立TCP连接,测试时可以使用util.PipeListener在进程内连接服务
+	Dialer util.ContextDialer
+	//TLS配置 -- 不为nil时建立连接后进行TLS握手,双向TLS时设置客户端证书
+	TLSConfig *tls.Config
+	//认证 -- 不为nil时每次建立连接后(TLS握手之后)进行认证
+	Authenticator ClientAuthenticator
+	//压缩 -- 不为nil时与服务端协商压缩算法,只解压其中列出的压缩算法
+	Compression *CompressOption
+	//请求消息带上消息体的CRC32校验值 -- 结果消息带有校验值时总是检查
+	BodyChecksum bool
+	//兼容模式 -- 使用没有魔数与校验的旧版本消息头,用于访问旧版本的服务
+	//旧版本消息头没有请求编号与超时时间,不能压缩,MuxCli不支持
+	LegacyHead bool
 }
 
 func (cliOption *CliOption) Validate() error {
@@ -63,5 +205,129 @@ func (cliOption *CliOption) Validate() error {
 		cliOption.BufferRecycleSize == 0 {
 		return ErrInvalidOption
 	}
+
+	//缓冲区至少能放下消息头
+	if cliOption.BufferSize < MsgHeadSize {
+		return ErrInvalidOption
+	}
+
+	if cliOption.RetreatTime < 0 || cliOption.RetreatMaxTime < 0 {
+		return ErrInvalidOption
+	}
+
+	if cliOption.PingInterval < 0 || cliOption.PingTimeout < 0 {
+		return ErrInvalidOption
+	}
+
+	if uint64(cliOption.MaxMsgSize) >= maxMsgSizeLimit {
+		return ErrInvalidOption
+	}
+
+	//旧版本的服务不能回复心跳
+	if cliOption.LegacyHead && (cliOption.Compression != nil || cliOption.BodyChecksum || cliOption.PingInterval > 0) {
+		return ErrInvalidOption
+	}
+
+	if cliOption.Compression != nil {
+		err := cliOption.Compression.Validate()
+		if err != nil {
+			return err
+		}
+	}
+
+	if cliOption.Breaker != nil {
+		return cliOption.Breaker.Validate()
+	}
+	return nil
+}
+
+//日志 -- 没有设置时新建生产环境的日志
+func (cliOption *CliOption) newLogger() (*zap.Logger, error) {
+	if cliOption.Logger != nil {
+		return cliOption.Logger, nil
+	}
+	return zap.NewProduction()
+}
+
+//连接器 -- 没有设置时建立TCP连接
+func (cliOption *CliOption) dialer() util.ContextDialer {
+	if cliOption.Dialer != nil {
+		return cliOption.Dialer
+	}
+	return &net.Dialer{
+		KeepAlive: 5 * time.Minute, //5分钟
+	}
+}
+
+//压缩参数
+//双方在消息头中带上自己能解压的算法,发送方按Codecs的顺序选择对方能解压的算法
+type CompressOption struct {
+	//支持的压缩算法编号,按优先顺序
+	Codecs []uint8
+	//消息体达到多少字节时压缩
+	Threshold int
+}
+
+func (option *CompressOption) Validate() error {
+	if len(option.Codecs) == 0 || option.Threshold < 0 {
+		return ErrInvalidOption
+	}
+	for _, id := range option.Codecs {
+		if _, ok := getCodec(id); !ok {
+			return ErrBadCodec
+		}
+	}
+	return nil
+}
+
+//熔断参数
+type BreakerOption struct {
+	//连续失败多少次后熔断
+	FailureThreshold int
+	//熔断多久后进入半开状态
+	OpenTimeout time.Duration
+}
+
+func (option *BreakerOption) Validate() error {
+	if option.FailureThreshold <= 0 ||
+		option.OpenTimeout <= 0 {
+		return ErrInvalidOption
+	}
+	return nil
+}
+
+//负载均衡参数
+type BalancerOption struct {
+	//负载均衡策略
+	Policy BalancePolicy
+	//重新解析服务地址的间隔,0表示只在创建时解析一次
+	ResolveInterval time.Duration
+	//连续失败多少次后摘除服务地址,0表示不摘除
+	EjectThreshold int
+	//探测被摘除服务地址的间隔
+	ProbeInterval time.Duration
+	//探测的超时时间 -- 包括建立连接、TLS握手、认证与心跳
+	ProbeTimeout time.Duration
+	//一致性哈希时每个服务地址的虚拟节点数
+	VirtualNodes int
+}
+
+func (option *BalancerOption) Validate() error {
+	if option.Policy < PolicyRoundRobin ||
+		option.Policy > PolicyConsistentHash ||
+		option.ResolveInterval < 0 ||
+		option.EjectThreshold < 0 {
+		return ErrInvalidOption
+	}
+
+	if option.EjectThreshold > 0 &&
+		(option.ProbeInterval <= 0 ||
+			option.ProbeTimeout <= 0) {
+		return ErrInvalidOption
+	}
+
+	if option.Policy == PolicyConsistentHash && option.VirtualNodes <= 0 {
+		return ErrInvalidOption
+	}
 	return nil
 }
@@ -0,0 +1,98 @@
+package fast_rpc
+
+import (
+	"context"
+	"github.com/pineal-niwan/busybox/binary"
+	"go.uber.org/zap"
+	"net"
+	"time"
+)
+
+//心跳消息 -- 服务端不经过处理函数原样返回
+//连接池定时在空闲连接上发送,没有返回的连接被替换
+type PingMsg struct {
+	//发送时间(UnixNano)
+	Time int64
+}
+
+//获取命令行
+func (msg *PingMsg) GetCmd() uint16 {
+	return CmdPing
+}
+
+//获取版本号
+func (msg *PingMsg) GetVersion() uint16 {
+	return 0
+}
+
+//获取Code
+func (msg *PingMsg) GetCode() uint32 {
+	return uint32(CmdPing)
+}
+
+//序列化
+func (msg *PingMsg) Marshal(buf []byte, option *binary.Option) (int, []byte, error) {
+	writer, err := binary.NewWriteBinaryHandler(buf, option)
+	if err != nil {
+		return 0, nil, err
+	}
+	//先跳过消息头
+	err = writer.MovePos(uint32(MsgHeadSize))
+	if err != nil {
+		return 0, nil, err
+	}
+	err = writer.WriteInt64(msg.Time)
+	if err != nil {
+		return 0, nil, err
+	}
+	size := writer.Len()
+	//消息头由框架回填
+	return size, writer.Data(), nil
+}
+
+//反序列化
+func (msg *PingMsg) Unmarshal(buf []byte, option *binary.Option) error {
+	reader, err := binary.NewReadBinaryHandler(buf, option)
+	if err != nil {
+		return err
+	}
+	msg.Time, err = reader.ReadInt64()
+	return err
+}
+
+//在连接池的空闲连接上发送心跳并等待返回 -- 超时由连接池设置在ctx中
+func (cli *Cli) ping(ctx context.Context, conn net.Conn) error {
+	buf := cli.bufferPool.Get().([]byte)
+	callRet := cli.callWithConn(ctx, conn, &PingMsg{Time: time.Now().UnixNano()}, buf)
+	if len(callRet.buf) <= cli.BufferRecycleSize {
+		cli.bufferPool.Put(callRet.buf)
+	}
+	err := callRet.err
+	if err == nil {
+		if _, ok := callRet.msg.(*PingMsg); !ok {
+			err = ErrNotExpectMsg
+		}
+	}
+	if err != nil {
+		cli.logger.Info("rpc client ping failed",
+			zap.String("address", cli.address),
+			zap.Error(err))
+		return err
+	}
+	//清除心跳设置的超时,之后的调用按各自的context设置
+	return conn.SetDeadline(time.Time{})
+}
+
+//探测服务是否可用 -- 与调用一样从连接池获取连接(建立时完成TLS握手与认证)并发送心跳
+func (cli *Cli) probe(ctx context.Context) error {
+	conn, err := cli.connPool.Get(ctx)
+	if err != nil {
+		return err
+	}
+	err = cli.ping(ctx, conn)
+	if err != nil {
+		conn.Discard()
+		return err
+	}
+	return conn.Close()
+}
@@ -0,0 +1,47 @@
+package fast_rpc
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestPing(t *testing.T) {
+	for _, async := range []bool{false, true} {
+		option := testOption()
+		option.AsyncDispatch = async
+		option.WorkerNum = 2
+		//心跳不受限流限制
+		option.Limits = &LimitOption{MaxInFlight: 1}
+		option.IdleTimeout = 100 * time.Millisecond
+		service, address := startTestService(t, option)
+
+		cliOption := testCliOption()
+		cliOption.PoolMinSize = 1
+		cliOption.PingInterval = 20 * time.Millisecond
+		cli, err := NewCli(context.Background(), address, 1, cliOption, testParseHash())
+		if err != nil {
+			t.Fatalf("new cli error:%+v", err)
+		}
+
+		//心跳使空闲的连接不被服务端关闭
+		time.Sleep(300 * time.Millisecond)
+		conn, err := cli.connPool.Get(context.Background())
+		if err != nil {
+			t.Fatalf("get conn error:%+v", err)
+		}
+		err = cli.ping(context.Background(), conn)
+		if err != nil {
+			t.Errorf("ping error:%+v", err)
+		}
+		conn.Close()
+		_, err = cli.CallWithRetry(context.Background(), &testMsg{cmd: testCmdReq, Text: "hello"}, 0)
+		if err != nil {
+			t.Errorf("call error:%+v", err)
+		}
+		if load := service.Load(); load.TimedOut != 0 || load.Rejected != 0 {
+			t.Errorf("unexpected load:%+v", load)
+		}
+		cli.Close()
+	}
+}
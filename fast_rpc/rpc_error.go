@@ -0,0 +1,152 @@
+package fast_rpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/pineal-niwan/busybox/binary"
+	"github.com/pineal-niwan/busybox/util"
+)
+
+//错误码 -- 随错误消息传输,数值不能改变
+//实现了error接口,可以作为errors.Is的目标: errors.Is(err, ErrCodeNotFound)
+type ErrCode uint16
+
+const (
+	//未知错误
+	ErrCodeUnknown ErrCode = iota
+	//没有对应的消息解析或处理
+	ErrCodeNotFound
+	//请求消息解析出错
+	ErrCodeBadRequest
+	//消息处理出错
+	ErrCodeInternal
+	//处理超时
+	ErrCodeDeadline
+	//消息超过长度限制
+	ErrCodeOverflow
+	//服务不可用 -- 客户端已关闭、熔断或没有可用的服务地址
+	ErrCodeUnavailable
+	//资源耗尽 -- 服务端连接数、正在处理的请求数或请求速率超过限制
+	ErrCodeResourceExhausted
+)
+
+var errCodeNames = map[ErrCode]string{
+	ErrCodeUnknown:           "unknown",
+	ErrCodeNotFound:          "not_found",
+	ErrCodeBadRequest:        "bad_request",
+	ErrCodeInternal:          "internal",
+	ErrCodeDeadline:          "deadline",
+	ErrCodeOverflow:          "overflow",
+	ErrCodeUnavailable:       "unavailable",
+	ErrCodeResourceExhausted: "resource_exhausted",
+}
+
+func (code ErrCode) String() string {
+	name, ok := errCodeNames[code]
+	if ok {
+		return name
+	}
+	return fmt.Sprintf("code(%d)", uint16(code))
+}
+
+func (code ErrCode) Error() string {
+	return "rpc error code:" + code.String()
+}
+
+//本地错误对应的错误码 -- 按顺序匹配
+var errCodeMapping = []struct {
+	err  error
+	code ErrCode
+}{
+	{context.DeadlineExceeded, ErrCodeDeadline},
+	{ErrBadMsgParser, ErrCodeNotFound},
+	{ErrBadMsgHandler, ErrCodeNotFound},
+	{ErrMsgTooLarge, ErrCodeOverflow},
+	{binary.ErrOverflow, ErrCodeOverflow},
+	{binary.ErrStringOverflow, ErrCodeOverflow},
+	{binary.ErrArrayOverflow, ErrCodeOverflow},
+	{ErrBadMagic, ErrCodeBadRequest},
+	{ErrBadHeadChecksum, ErrCodeBadRequest},
+	{ErrBadBodyChecksum, ErrCodeBadRequest},
+	{ErrBadCodec, ErrCodeBadRequest},
+	{ErrCliClosed, ErrCodeUnavailable},
+	{ErrNoEndpoint, ErrCodeUnavailable},
+	{ErrCircuitOpen, ErrCodeUnavailable},
+	{util.ErrPoolClosed, ErrCodeUnavailable},
+}
+
+//带错误码的错误
+//服务端返回时只传输错误码与错误信息,客户端收到错误消息后转化为此错误,连接仍然可用,不会重试
+type RPCError struct {
+	//错误码
+	Code ErrCode
+	//错误信息
+	Message string
+	//原始错误 -- 只在本地有效,不传输
+	Cause error
+}
+
+func NewRPCError(code ErrCode, format string, args ...interface{}) *RPCError {
+	return &RPCError{
+		Code:    code,
+		Message: fmt.Sprintf(format, args...),
+	}
+}
+
+//包装错误 -- errors.Is/As可以匹配到原始错误
+func WrapRPCError(code ErrCode, cause error, format string, args ...interface{}) *RPCError {
+	rpcErr := NewRPCError(code, format, args...)
+	rpcErr.Cause = cause
+	return rpcErr
+}
+
+func (e *RPCError) Error() string {
+	return fmt.Sprintf("rpc error code:%s, msg:%s", e.Code.String(), e.Message)
+}
+
+func (e *RPCError) Unwrap() error {
+	return e.Cause
+}
+
+//错误码相同即匹配 -- 目标可以是ErrCode或*RPCError
+func (e *RPCError) Is(target error) bool {
+	switch t := target.(type) {
+	case ErrCode:
+		return e.Code == t
+	case *RPCError:
+		return e.Code == t.Code && (t.Message == "" || e.Message == t.Message)
+	}
+	return false
+}
+
+//获取错误的错误码 -- 不能识别的错误返回ErrCodeUnknown
+func CodeOf(err error) ErrCode {
+	return codeOf(err, ErrCodeUnknown)
+}
+
+func codeOf(err error, defaultCode ErrCode) ErrCode {
+	var rpcErr *RPCError
+	if errors.As(err, &rpcErr) {
+		return rpcErr.Code
+	}
+	for _, m := range errCodeMapping {
+		if errors.Is(err, m.err) {
+			return m.code
+		}
+	}
+	return defaultCode
+}
+
+//转化为服务端返回的错误 -- 不是RPCError时按错误类型确定错误码,不能识别时使用缺省的错误码
+func toRPCError(err error, defaultCode ErrCode) *RPCError {
+	var rpcErr *RPCError
+	if errors.As(err, &rpcErr) {
+		return rpcErr
+	}
+	return &RPCError{
+		Code:    codeOf(err, defaultCode),
+		Message: err.Error(),
+		Cause:   err,
+	}
+}
@@ -0,0 +1,72 @@
+package fast_rpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/pineal-niwan/busybox/binary"
+	"testing"
+)
+
+func TestCodeOf(t *testing.T) {
+	cases := []struct {
+		err  error
+		code ErrCode
+	}{
+		{NewRPCError(ErrCodeBadRequest, "bad"), ErrCodeBadRequest},
+		{fmt.Errorf("wrapped: %w", NewRPCError(ErrCodeDeadline, "late")), ErrCodeDeadline},
+		{context.DeadlineExceeded, ErrCodeDeadline},
+		{fmt.Errorf("parse: %w", binary.ErrStringOverflow), ErrCodeOverflow},
+		{ErrCircuitOpen, ErrCodeUnavailable},
+		{ErrBadBodyChecksum, ErrCodeBadRequest},
+		{errors.New("other"), ErrCodeUnknown},
+	}
+	for _, c := range cases {
+		if code := CodeOf(c.err); code != c.code {
+			t.Errorf("code of %v, expect %s got %s", c.err, c.code, code)
+		}
+	}
+
+	//本地包装的错误可以匹配到原始错误与错误码
+	err := WrapRPCError(ErrCodeNotFound, ErrBadMsgHandler, "cmd:%d", 1)
+	if !errors.Is(err, ErrBadMsgHandler) || !errors.Is(err, ErrCodeNotFound) || errors.Is(err, ErrCodeInternal) {
+		t.Errorf("unexpected errors.Is result for %v", err)
+	}
+}
+
+func TestRPCErrorText(t *testing.T) {
+	cases := []struct {
+		err  error
+		text string
+	}{
+		{NewRPCError(ErrCodeNotFound, "cmd:%d", 3), "rpc error code:not_found, msg:cmd:3"},
+		{&RPCError{Code: ErrCode(100), Message: "x"}, "rpc error code:code(100), msg:x"},
+		{ErrCodeDeadline, "rpc error code:deadline"},
+	}
+	for _, c := range cases {
+		if c.err.Error() != c.text {
+			t.Errorf("expect %q got %q", c.text, c.err.Error())
+		}
+	}
+}
+
+func TestRPCErrorRoundTrip(t *testing.T) {
+	_, address := startTestService(t, testOption())
+	cli, err := NewCli(context.Background(), address, 1, testCliOption(), testParseHash())
+	if err != nil {
+		t.Fatalf("new cli error:%+v", err)
+	}
+	defer cli.Close()
+
+	//没有处理函数
+	_, err = cli.CallWithRetry(context.Background(), &testMsg{cmd: testCmdRsp, Text: "x"}, 0)
+	var rpcErr *RPCError
+	if !errors.As(err, &rpcErr) || !errors.Is(err, ErrCodeNotFound) {
+		t.Errorf("expect not found error, got %+v", err)
+	}
+	//处理函数返回的普通错误
+	_, err = cli.CallWithRetry(context.Background(), &testMsg{cmd: testCmdReq, Text: "error:boom"}, 0)
+	if !errors.Is(err, &RPCError{Code: ErrCodeInternal, Message: "error:boom"}) {
+		t.Errorf("expect internal error, got %+v", err)
+	}
+}
@@ -1,12 +1,13 @@
 package fast_rpc
 
 import (
-	"fmt"
+	"context"
+	"crypto/tls"
+	"github.com/go-errors/errors"
 	"github.com/pineal-niwan/busybox/binary"
 	"github.com/pineal-niwan/busybox/buffer"
 	"github.com/pineal-niwan/busybox/util"
 	"go.uber.org/zap"
-	"log"
 	"net"
 	"sync"
 	"time"
@@ -18,6 +19,11 @@ type MsgParseHandler func(msgData []byte, option *binary.Option) (IMsg, error)
 //消息处理函数
 type MsgHandler func(inMsg IMsg) (outMsg IMsg, err error)
 
+//带context的消息处理函数
+//ctx带有客户端的超时时间,并可以获取请求的消息头与对端信息
+//异步分发(AsyncDispatch)时连接断开后ctx被取消; 顺序处理时处理期间不读取连接,感知不到断开,只有超时生效
+type MsgHandlerWithContext func(ctx context.Context, inMsg IMsg) (outMsg IMsg, err error)
+
 //服务定义
 type Service struct {
 	//监听端口
@@ -29,9 +35,23 @@ type Service struct {
 	//消息解析
 	msgParseHash map[uint32]MsgParseHandler
 	//消息处理
-	msgHandlerHash map[uint32]MsgHandler
+	msgHandlerHash map[uint32]MsgHandlerWithContext
+	//流处理
+	streamHandlerHash map[uint32]StreamHandler
+	//消息的描述 -- 由生成的代码提供,用于服务描述
+	schemaHash map[uint32]MsgDesc
 	//缓冲池
 	bufferPool *sync.Pool
+	//异步分发的任务队列
+	jobChan chan *asyncJob
+	//处理协程是否已停止
+	workersStopped bool
+	//正在处理的连接
+	conns map[*connState]struct{}
+	//限流与负载统计
+	limiter *limiter
+	//是否在优雅关闭中
+	shuttingDown bool
 
 	closed bool
 	sync.Mutex
@@ -49,18 +69,39 @@ func (s *Service) Init(
 			return make([]byte, option.BufferSize)
 		},
 	}
+	//接收TLS连接,握手在处理连接时完成
+	if option.TLSConfig != nil {
+		ln = tls.NewListener(ln, option.TLSConfig)
+	}
 	s.Lock()
 	s.ln = ln
 	s.logger = logger
 	s.option = option
 	s.msgParseHash = msgParseHash
-	s.msgHandlerHash = make(map[uint32]MsgHandler)
+	s.msgHandlerHash = make(map[uint32]MsgHandlerWithContext)
+	s.streamHandlerHash = make(map[uint32]StreamHandler)
+	s.schemaHash = make(map[uint32]MsgDesc)
 	s.bufferPool = bufferPool
+	s.limiter = newLimiter(option.Limits, option.Metrics)
+	if option.AsyncDispatch {
+		s.startWorkers()
+	}
 	s.Unlock()
 }
 
 //添加消息处理
 func (s *Service) AddMsgHandler(msg IMsg, handler MsgHandler) {
+	if handler == nil {
+		s.msgHandlerHash[msg.GetCode()] = nil
+		return
+	}
+	s.msgHandlerHash[msg.GetCode()] = func(ctx context.Context, inMsg IMsg) (IMsg, error) {
+		return handler(inMsg)
+	}
+}
+
+//添加带context的消息处理
+func (s *Service) AddMsgHandlerWithContext(msg IMsg, handler MsgHandlerWithContext) {
 	s.msgHandlerHash[msg.GetCode()] = handler
 }
 
@@ -96,6 +137,10 @@ func (s *Service) LoopHandle(exitNotify chan<- struct{}) {
 		//监听socket
 		conn, err = s.ln.Accept()
 		if err != nil {
+			if s.isShuttingDown() {
+				//优雅关闭中,监听端口已关闭
+				return
+			}
 			ne, ok := err.(net.Error)
 			if ok {
 				//是网络错误
@@ -142,141 +187,478 @@ func (s *Service) LoopHandle(exitNotify chan<- struct{}) {
 
 //处理连接
 func (s *Service) HandleConnection(conn net.Conn) {
-	var inMsg, outMsg IMsg
+	var inMsg IMsg
 	var err error
 	var head MsgHead
 	var size int
+	var recvTime time.Time
+
+	//登记连接,用于优雅关闭
+	st := s.trackConn(conn)
+	if st == nil {
+		conn.Close()
+		return
+	}
+
+	//先完成TLS握手与认证,得到验证过的对端身份
+	peer, err := s.handshake(conn)
+	if err != nil {
+		//握手期间客户端断开是正常的事件,例如端口探测
+		if isPeerClosed(err) {
+			s.logger.Debug("service connection closed during handshake",
+				remoteField(conn.RemoteAddr()),
+				zap.Error(err))
+		} else {
+			s.logger.Error("service handshake error",
+				remoteField(conn.RemoteAddr()),
+				zap.Error(err))
+		}
+		conn.Close()
+		s.untrackConn(st)
+		return
+	}
+
+	//登记连接数,超过最大连接数时连接上的请求都被拒绝
+	connLimit := s.limiter.openConn()
+
+	//读取消息头时区分空闲超时与消息头超时
+	headConn := &headReadConn{Conn: conn, headTimeout: s.option.HeadReadTimeout}
+
+	//连接的context -- 读循环退出时取消,异步分发时正在处理的消息可以感知连接断开
+	connCtx, connCancel := context.WithCancel(context.Background())
+
+	//流的context -- 连接的读循环退出时取消,优雅关闭时也不等待流
+	streamCtx, streamCancel := context.WithCancel(connCtx)
+
+	//异步分发或者打开了流时,结果消息由连接的发送协程发送 -- 需要时启动
+	var writer *connWriter
+	//连接上的流
+	var streams *streamSet
 
 	buf := s.bufferPool.Get().([]byte)
 
 	defer func() {
 		//panic后防止整个server被panic
-		panicErr := util.Recover(recover())
-		if panicErr != nil {
-			pErr := util.NewPanicError()
-			s.logger.Error("service panic",
-				zap.Error(pErr))
-			s.logger.Error("service panic error",
-				zap.Error(panicErr.Err))
-			s.logger.Error("service panic stack:",
-				zap.String("stack", string(panicErr.Stack())))
+		s.logPanic(util.Recover(recover()))
+		//连接断开时取消正在处理的消息,优雅关闭时等待处理完成
+		if !s.isShuttingDown() {
+			connCancel()
+		}
+		streamCancel()
+		//等待异步处理的结果与流发送完成
+		if writer != nil {
+			writer.close()
 		}
+		connCancel()
 		//关闭连接
 		closeErr := conn.Close()
-		if closeErr != nil {
-			s.logger.Error("service close connection", zap.Error(closeErr))
+		if closeErr != nil && !isPeerClosed(closeErr) {
+			s.logger.Error("service close connection",
+				remoteField(conn.RemoteAddr()),
+				zap.Error(closeErr))
 		}
 		//归还缓存
 		if len(buf) <= s.option.BufferRecycleSize {
 			s.bufferPool.Put(buf)
 		}
-
+		//注销连接
+		connLimit.close()
+		s.untrackConn(st)
 	}()
 
 	for {
 		if len(buf) < MsgHeadSize {
-			//缓存不够，退出
-			s.logger.Error("no enough buffer")
-			s.logger.Sync()
-			log.Fatal("not enough buffer in service")
+			//缓存不够放下消息头，扩大
+			buf = buffer.BytesExtends(buf, MsgHeadSize, 0)
 		}
 
 		/***********************接收消息头***************/
-		//接收消息头字节流
-		err = util.NetReadBytes(conn, buf[:MsgHeadSize])
+		//设置空闲超时 -- 在进入空闲前设置,不会覆盖优雅关闭对读取的中断
+		err = headConn.wait(s.option.IdleTimeout)
 		if err != nil {
-			s.logger.Error("service receive head error",
+			s.logger.Error("service set read deadline error",
+				remoteField(conn.RemoteAddr()),
 				zap.Error(err))
 			return
 		}
-		//解析消息头
-		head, err = UnmarshalMsgHead(buf, s.option.Option)
+		//等待消息头时连接空闲,优雅关闭时可以中断
+		if !st.setIdle() {
+			return
+		}
+		//接收并解析消息头 -- 不以魔数开头或校验失败时立即断开,兼容模式下接收旧版本消息头
+		head, err = readMsgHead(headConn, buf, s.option.Option, s.option.LegacyHead)
+		if err != nil {
+			//客户端断开连接是正常的事件
+			if s.isShuttingDown() || isPeerClosed(err) {
+				s.logger.Debug("service connection closed",
+					remoteField(conn.RemoteAddr()),
+					zap.Error(err))
+			} else if isTimeout(err) {
+				//还有正在处理的请求或者打开的流时连接不算空闲,重新等待
+				if headConn.stage() == timeoutStageIdle && connLimit.busy() {
+					continue
+				}
+				//空闲或者发送了不完整的消息头
+				s.onTimeout(conn, headConn.stage(), err)
+			} else {
+				s.logger.Error("service receive head error",
+					remoteField(conn.RemoteAddr()),
+					zap.Error(err))
+			}
+			return
+		}
+		if !st.setActive() {
+			return
+		}
+		recvTime = time.Now()
+		//消息体的超时,同时清除消息头的超时
+		err = conn.SetReadDeadline(deadlineAfter(s.option.BodyReadTimeout))
 		if err != nil {
-			s.logger.Error("service parse head error",
+			s.logger.Error("service set read deadline error",
+				remoteField(conn.RemoteAddr()),
 				zap.Error(err))
 			return
 		}
 
 		/***********************接收消息体***************/
 		//检查消息体大小
+		//流的控制消息可以没有消息体
 		size = int(head.Size)
-		if size == 0 || size > s.option.MaxMsgSize {
+		if (size == 0 && head.Flags&MsgFlagStream == 0) || size > s.option.MaxMsgSize {
 			s.logger.Error("service size of inMsg error",
+				remoteField(conn.RemoteAddr()),
+				zap.Uint16("cmd", head.Cmd),
+				zap.Uint16("version", head.Version),
 				zap.Int("msgSize", size))
 			return
 		}
 		//如果buf不够，扩大
 		buf = buffer.BytesExtends(buf, MsgHeadSize+size, 0)
-		//接收消息体字节流
-		err = util.NetReadBytes(conn, buf[MsgHeadSize:MsgHeadSize+size])
-		if err != nil {
-			s.logger.Error("service receive content error",
-				zap.Error(err))
+		//接收消息体字节流并解压解析 -- 解析出错时返回错误消息,连接继续可用
+		inMsg, err = nil, nil
+		if size > 0 {
+			err = util.NetReadBytes(conn, buf[MsgHeadSize:MsgHeadSize+size])
+			if isTimeout(err) {
+				s.onTimeout(conn, timeoutStageBody, err)
+				return
+			}
+			if err != nil {
+				s.logger.Error("service receive content error",
+					remoteField(conn.RemoteAddr()),
+					zap.Uint16("cmd", head.Cmd),
+					zap.Uint16("version", head.Version),
+					zap.Error(err))
+				return
+			}
+			inMsg, err = s.decodeAndParseMsg(head, buf[MsgHeadSize:MsgHeadSize+size])
+			if err != nil {
+				s.logger.Error("service parse content error",
+					remoteField(conn.RemoteAddr()),
+					zap.Uint16("cmd", head.Cmd),
+					zap.Uint16("version", head.Version),
+					zap.Error(err))
+			}
+		}
+
+		/***********************处理消息****************/
+		//旧版本消息头没有请求编号,只能顺序处理
+		async := s.option.AsyncDispatch && head.HeadVer == MsgHeadFramed
+		if writer == nil && (async || head.Flags&MsgFlagStream != 0) {
+			writer = s.newConnWriter(conn)
+		}
+		if s.option.AsyncDispatch && writer != nil && head.HeadVer == MsgHeadLegacy {
+			s.logger.Error("service legacy head on async connection",
+				remoteField(conn.RemoteAddr()))
 			return
 		}
-		//解析消息内容
-		inMsg, err = s.ParseMsg(head, buf[MsgHeadSize:MsgHeadSize+size])
-		if err != nil {
-			s.logger.Error("service parse content error",
-				zap.Error(err))
+		//心跳与服务描述由框架直接回复
+		builtin := s.isBuiltin(head) && err == nil
+		//请求与打开流的消息需要准入,流的后续消息与框架的消息不限制
+		var release func()
+		var admitErr error
+		if !builtin && (head.Flags&MsgFlagStream == 0 || head.Flags&MsgFlagStreamOpen != 0) {
+			release, admitErr = connLimit.admit(head)
+		}
+		if builtin {
+			buf, err = s.replyBuiltin(conn, writer, head, inMsg, buf)
+			if err != nil {
+				return
+			}
+		} else if admitErr != nil {
+			//超过限制 -- 回复资源耗尽的错误,单向消息直接丢弃
+			s.logger.Warn("service reject msg",
+				remoteField(conn.RemoteAddr()),
+				zap.Uint16("cmd", head.Cmd),
+				zap.Uint16("version", head.Version),
+				zap.Error(admitErr))
+			if head.Flags&MsgFlagStream != 0 {
+				s.rejectStream(writer, head, admitErr)
+			} else if head.Flags&MsgFlagOneWay == 0 {
+				buf, err = s.handleAndReply(connCtx, conn, writer, head, nil, admitErr, buf)
+				if err != nil {
+					return
+				}
+			}
+			//超过最大连接数的连接回复后断开
+			if connLimit.overConns {
+				return
+			}
+		} else if head.Flags&MsgFlagStream != 0 {
+			//交给对应的流
+			if streams == nil {
+				streams = newStreamSet()
+			}
+			s.handleStreamFrame(streamCtx, writer, streams, head, peer, recvTime, inMsg, err, release)
+		} else if async {
+			//单向消息也由处理协程处理,处理后不回复
+			//异步处理,返回消息带回请求编号,由客户端匹配
+			reqCtx, reqCancel := newRequestContext(connCtx, head, peer, recvTime)
+			s.dispatch(reqCtx, reqCancel, writer, head, inMsg, err, release)
+		} else if head.Flags&MsgFlagOneWay != 0 {
+			//顺序处理单向消息,不回复
+			reqCtx, reqCancel := newRequestContext(connCtx, head, peer, recvTime)
+			s.handleOneWay(reqCtx, head, inMsg, err)
+			reqCancel()
+			release()
+		} else {
+			//顺序处理
+			reqCtx, reqCancel := newRequestContext(connCtx, head, peer, recvTime)
+			buf, err = s.handleAndReply(reqCtx, conn, writer, head, inMsg, err, buf)
+			reqCancel()
+			release()
+			if err != nil {
+				return
+			}
+		}
+
+		//优雅关闭中,当前消息处理完后退出
+		if s.isShuttingDown() {
 			return
 		}
 
-		/***********************处理消息****************/
-		outMsg, err = s.HandleMsg(inMsg)
+		//缓冲区过大，resize
+		if len(buf) > s.option.BufferRecycleSize {
+			buf = make([]byte, s.option.BufferSize)
+		}
+	}
+
+}
+
+//解压并解析消息
+func (s *Service) decodeAndParseMsg(head MsgHead, body []byte) (IMsg, error) {
+	body, err := decodeBody(head, body, s.option.MaxMsgSize, s.option.Compression.accept())
+	if err != nil {
+		return nil, toRPCError(err, ErrCodeBadRequest)
+	}
+	if s.isBuiltin(head) {
+		return parseBuiltinMsg(head, body, s.option.Option)
+	}
+	return s.ParseMsg(head, body)
+}
+
+//处理消息并返回结果消息
+//连接上有发送协程时交给发送协程,避免与流的消息并发写
+func (s *Service) handleAndReply(ctx context.Context, conn net.Conn, writer *connWriter, head MsgHead, inMsg IMsg, parseErr error, buf []byte) ([]byte, error) {
+	data, buf, err := s.handleMsgToBytes(ctx, head, inMsg, parseErr, buf)
+	if err != nil {
+		return buf, err
+	}
+	if writer != nil {
+		s.queueFrame(writer, data, buf)
+		return s.bufferPool.Get().([]byte), nil
+	}
+	return buf, s.sendBytes(conn, data)
+}
+
+//处理消息并将结果消息序列化到buf中
+//解析或处理出错时序列化错误消息
+//返回值 ([]byte -- 要发送的数据 []byte -- 扩展后的缓冲区 error -- 错误)
+func (s *Service) handleMsgToBytes(ctx context.Context, head MsgHead, inMsg IMsg, parseErr error, buf []byte) ([]byte, []byte, error) {
+	var outMsg IMsg
+	var err error
+
+	start := time.Now()
+	if parseErr != nil {
+		outMsg = &ErrorMsg{RPCError: *toRPCError(parseErr, ErrCodeBadRequest)}
+	} else {
+		if ctx.Err() == nil {
+			outMsg, err = s.HandleMsgWithContext(ctx, inMsg)
+		}
+		//等待处理时或处理过程中超时
+		if ctx.Err() == context.DeadlineExceeded {
+			outMsg, err = nil, NewRPCError(ErrCodeDeadline,
+				"deadline exceeded cmd:%+v, version:%+v, timeout:%+vms", head.Cmd, head.Version, head.Timeout)
+		} else if ctx.Err() != nil && err == nil && outMsg == nil {
+			err = ctx.Err()
+		}
+		if err == nil && outMsg == nil {
+			err = ErrNilOutMsg
+		}
 		if err != nil {
 			s.logger.Error("service handle msg error",
-				zap.Error(err))
-			return
+				requestFields(ctx, head,
+					zap.Duration("latency", time.Since(start)),
+					zap.Error(err))...)
+			outMsg = &ErrorMsg{RPCError: *toRPCError(err, ErrCodeInternal)}
 		}
+	}
 
-		/***********************返回结果消息****************/
-		size, buf, err = outMsg.Marshal(buf, s.option.Option)
-		if err != nil {
-			s.logger.Error("service marshal out msg error",
-				zap.Error(err))
-			return
+	s.option.Metrics.observe(head, outMsg, time.Since(start))
+
+	/***********************序列化结果消息****************/
+	data, out, err := s.marshalOutMsg(head, outMsg, 0, buf)
+	if err != nil {
+		s.logger.Error("service marshal out msg error",
+			requestFields(ctx, head, zap.Error(err))...)
+		//结果消息不能序列化,改为返回错误消息
+		outMsg = &ErrorMsg{RPCError: *toRPCError(err, ErrCodeInternal)}
+		data, out, err = s.marshalOutMsg(head, outMsg, 0, buf)
+	}
+	if err != nil {
+		return nil, buf, err
+	}
+	return data, out, nil
+}
+
+//处理单向消息 -- 处理结果和错误只记录,不回复
+func (s *Service) handleOneWay(ctx context.Context, head MsgHead, inMsg IMsg, parseErr error) {
+	var outMsg IMsg
+
+	start := time.Now()
+	if parseErr != nil {
+		outMsg = &ErrorMsg{RPCError: *toRPCError(parseErr, ErrCodeBadRequest)}
+	} else {
+		err := ctx.Err()
+		if err == nil {
+			_, err = s.HandleMsgWithContext(ctx, inMsg)
 		}
-		//发送字节流
-		err = util.NetSendBytes(conn, buf[:size])
 		if err != nil {
-			s.logger.Error("service send out msg error",
-				zap.Error(err))
-			return
+			s.logger.Error("service handle one-way msg error",
+				requestFields(ctx, head,
+					zap.Duration("latency", time.Since(start)),
+					zap.Error(err))...)
+			outMsg = &ErrorMsg{RPCError: *toRPCError(err, ErrCodeInternal)}
 		}
+	}
+	s.option.Metrics.observe(head, outMsg, time.Since(start))
+}
 
-		//缓冲区过大，resize
-		if len(buf) > s.option.BufferRecycleSize {
-			buf = make([]byte, s.option.BufferSize)
+//序列化结果消息并回填消息头,带回请求编号
+//使用与请求相同版本的消息头,按请求方能解压的算法压缩
+func (s *Service) marshalOutMsg(head MsgHead, outMsg IMsg, flags uint8, buf []byte) ([]byte, []byte, error) {
+	size, out, err := outMsg.Marshal(buf, s.option.Option)
+	if err != nil {
+		return nil, nil, err
+	}
+	if size > s.option.MaxMsgSize {
+		return nil, nil, WrapRPCError(ErrCodeOverflow, ErrMsgTooLarge, "service too long out msg size:%+v", size)
+	}
+	outHead := newMsgHead(outMsg, size, head.Seq)
+	outHead.HeadVer = head.HeadVer
+	outHead.Flags = flags
+	var codec uint8
+	if head.HeadVer == MsgHeadFramed {
+		outHead.Accept = s.option.Compression.accept()
+		codec = s.option.Compression.pick(head.Accept, size-MsgHeadSize)
+		if s.option.BodyChecksum {
+			outHead.Flags |= MsgFlagBodyCRC
 		}
 	}
+	data, err := encodeFrame(out, size, outHead, codec, s.option.Option)
+	if err != nil {
+		return nil, nil, err
+	}
+	return data, out, nil
+}
 
+//发送结果消息
+func (s *Service) sendBytes(conn net.Conn, data []byte) error {
+	err := s.writeWithTimeout(conn, data)
+	if err != nil && !isTimeout(err) {
+		s.logger.Error("service send out msg error",
+			remoteField(conn.RemoteAddr()),
+			zap.Error(err))
+	}
+	return err
 }
 
-//解析消息
-func (s *Service) ParseMsg(head MsgHead, buf []byte) (IMsg, error) {
-	if s.msgParseHash == nil {
-		return nil, ErrBadMsgParser
+//TLS握手与认证 -- 不是TLS连接、没有设置认证时跳过对应的步骤
+func (s *Service) handshake(conn net.Conn) (*Peer, error) {
+	peer := &Peer{Addr: conn.RemoteAddr()}
+	ctx := context.Background()
+	if timeout := s.option.handshakeTimeout(); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	tlsConn, ok := conn.(*tls.Conn)
+	if ok {
+		err := tlsConn.HandshakeContext(ctx)
+		if err != nil {
+			return nil, err
+		}
+		state := tlsConn.ConnectionState()
+		peer.TLSState = &state
 	}
 
-	parseHandler, ok := s.msgParseHash[head.GetCode()]
-	if !ok || parseHandler == nil {
-		err := fmt.Errorf("bad msg parser cmd:%+v, version:%+v", head.Cmd, head.Version)
-		return nil, err
+	if s.option.Authenticator != nil {
+		identity, err := s.option.Authenticator.Authenticate(ctx, conn)
+		if err != nil {
+			return nil, err
+		}
+		peer.AuthIdentity = identity
+	}
+	return peer, nil
+}
+
+//记录panic
+func (s *Service) logPanic(panicErr *errors.Error) {
+	if panicErr == nil {
+		return
 	}
-	return parseHandler(buf, s.option.Option)
+	pErr := util.NewPanicError()
+	s.logger.Error("service panic",
+		zap.Error(pErr))
+	s.logger.Error("service panic error",
+		zap.Error(panicErr.Err))
+	s.logger.Error("service panic stack:",
+		zap.String("stack", string(panicErr.Stack())))
+}
+
+//解析消息
+func (s *Service) ParseMsg(head MsgHead, buf []byte) (IMsg, error) {
+	return parseMsgWithHash(s.msgParseHash, head, buf, s.option.Option)
 }
 
 //处理消息
 func (s *Service) HandleMsg(inMsg IMsg) (IMsg, error) {
+	return s.HandleMsgWithContext(context.Background(), inMsg)
+}
+
+//带context处理消息 -- 经过拦截器后调用消息处理函数
+func (s *Service) HandleMsgWithContext(ctx context.Context, inMsg IMsg) (IMsg, error) {
+	if len(s.option.Interceptors) == 0 {
+		return s.callMsgHandler(ctx, inMsg)
+	}
+	head, ok := MsgHeadFromContext(ctx)
+	if !ok {
+		head = newCallHead(inMsg)
+	}
+	handler := chainServerInterceptors(s.option.Interceptors, head, s.callMsgHandler)
+	return handler(ctx, inMsg)
+}
+
+//调用消息处理函数
+func (s *Service) callMsgHandler(ctx context.Context, inMsg IMsg) (IMsg, error) {
 	if s.msgHandlerHash == nil {
 		return nil, ErrBadMsgHandler
 	}
 
 	msgHandler, ok := s.msgHandlerHash[inMsg.GetCode()]
 	if !ok || msgHandler == nil {
-		err := fmt.Errorf("bad msg handler cmd:%+v, version:%+v", inMsg.GetCmd(), inMsg.GetVersion())
-		return nil, err
+		return nil, WrapRPCError(ErrCodeNotFound, ErrBadMsgHandler,
+			"bad msg handler cmd:%+v, version:%+v", inMsg.GetCmd(), inMsg.GetVersion())
 	}
-	return msgHandler(inMsg)
+	return msgHandler(ctx, inMsg)
 }
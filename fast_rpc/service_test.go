@@ -0,0 +1,514 @@
+package fast_rpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/pineal-niwan/busybox/binary"
+	"go.uber.org/zap"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const (
+	testCmdReq    = 1
+	testCmdRsp    = 2
+	testCmdCtx    = 3
+	testCmdPeer   = 4
+	testCmdStream = 5
+	testCmdNotify = 6
+)
+
+var (
+	testBinOption = &binary.Option{
+		DataMaxLen:      1024 * 1024,
+		StringMaxLen:    64 * 1024,
+		ArrayMaxLen:     1024,
+		ExtendExtraSize: 256,
+	}
+)
+
+//测试消息 -- 只有一个字符串字段
+type testMsg struct {
+	cmd  uint16
+	Text string
+}
+
+func (msg *testMsg) GetCmd() uint16 {
+	return msg.cmd
+}
+
+func (msg *testMsg) GetVersion() uint16 {
+	return 0
+}
+
+func (msg *testMsg) GetCode() uint32 {
+	return uint32(msg.cmd)
+}
+
+func (msg *testMsg) Marshal(buf []byte, option *binary.Option) (int, []byte, error) {
+	writer, err := binary.NewWriteBinaryHandler(buf, option)
+	if err != nil {
+		return 0, nil, err
+	}
+	err = writer.MovePos(uint32(MsgHeadSize))
+	if err != nil {
+		return 0, nil, err
+	}
+	err = writer.WriteString(msg.Text)
+	if err != nil {
+		return 0, nil, err
+	}
+	size := writer.ResetPos(0)
+	err = MarshalMsgHead(writer, MsgHead{
+		Size: uint32(size - MsgHeadSize),
+		Cmd:  msg.cmd,
+	})
+	if err != nil {
+		return 0, nil, err
+	}
+	writer.ResetPos(size)
+	return size, writer.Data(), nil
+}
+
+func (msg *testMsg) Unmarshal(buf []byte, option *binary.Option) error {
+	reader, err := binary.NewReadBinaryHandler(buf, option)
+	if err != nil {
+		return err
+	}
+	msg.Text, err = reader.ReadString()
+	return err
+}
+
+func testParseHash() map[uint32]MsgParseHandler {
+	parse := func(cmd uint16) MsgParseHandler {
+		return func(data []byte, option *binary.Option) (IMsg, error) {
+			msg := &testMsg{cmd: cmd}
+			err := msg.Unmarshal(data, option)
+			return msg, err
+		}
+	}
+	return map[uint32]MsgParseHandler{
+		testCmdReq:    parse(testCmdReq),
+		testCmdRsp:    parse(testCmdRsp),
+		testCmdCtx:    parse(testCmdCtx),
+		testCmdPeer:   parse(testCmdPeer),
+		testCmdNotify: parse(testCmdNotify),
+	}
+}
+
+func testOption() *Option {
+	return &Option{
+		Option:            testBinOption,
+		AcceptDelay:       time.Millisecond,
+		AcceptMaxDelay:    time.Second,
+		AcceptMaxRetry:    3,
+		BufferSize:        256,
+		MaxMsgSize:        1024 * 1024,
+		BufferRecycleSize: 4096,
+	}
+}
+
+func testCliOption() *CliOption {
+	return &CliOption{
+		Option:            testBinOption,
+		BufferSize:        256,
+		MaxMsgSize:        1024 * 1024,
+		BufferRecycleSize: 4096,
+		RetreatTime:       time.Millisecond,
+	}
+}
+
+//回显处理 -- 文本以"sleep:"开头时先等待,用于制造乱序返回; 以"error:"开头时返回错误; 以"panic:"开头时panic
+func testEchoHandler(inMsg IMsg) (IMsg, error) {
+	req := inMsg.(*testMsg)
+	var d time.Duration
+	if n, _ := fmt.Sscanf(req.Text, "sleep:%d", &d); n == 1 {
+		time.Sleep(d)
+	}
+	if strings.HasPrefix(req.Text, "error:") {
+		return nil, errors.New(req.Text)
+	}
+	if strings.HasPrefix(req.Text, "panic:") {
+		panic(req.Text)
+	}
+	return &testMsg{cmd: testCmdRsp, Text: req.Text}, nil
+}
+
+//处理函数的ctx被取消时通知
+var testContextCanceled = make(chan struct{}, 1)
+
+//返回context中的超时与请求信息
+//文本为"wait"时等待ctx被取消
+func testContextHandler(ctx context.Context, inMsg IMsg) (IMsg, error) {
+	if inMsg.(*testMsg).Text == "wait" {
+		<-ctx.Done()
+		testContextCanceled <- struct{}{}
+		return nil, ctx.Err()
+	}
+	head, _ := MsgHeadFromContext(ctx)
+	_, hasDeadline := ctx.Deadline()
+	_, hasPeer := PeerFromContext(ctx)
+	text := fmt.Sprintf("deadline:%v timeout:%v peer:%v", hasDeadline, head.Timeout > 0, hasPeer)
+	return &testMsg{cmd: testCmdRsp, Text: text}, nil
+}
+
+//返回对端身份
+func testPeerHandler(ctx context.Context, inMsg IMsg) (IMsg, error) {
+	peer, _ := PeerFromContext(ctx)
+	return &testMsg{cmd: testCmdRsp, Text: peer.Identity()}, nil
+}
+
+//启动测试服务
+func startTestService(t *testing.T, option *Option) (*Service, string) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen error:%+v", err)
+	}
+	return startTestServiceOn(t, ln, option), ln.Addr().String()
+}
+
+//在指定的监听者上启动测试服务
+func startTestServiceOn(t *testing.T, ln net.Listener, option *Option) *Service {
+	service := &Service{}
+	service.Init(ln, zap.NewNop(), option, testParseHash())
+	service.AddMsgHandler(&testMsg{cmd: testCmdReq}, testEchoHandler)
+	service.AddMsgHandlerWithContext(&testMsg{cmd: testCmdCtx}, testContextHandler)
+	service.AddMsgHandlerWithContext(&testMsg{cmd: testCmdPeer}, testPeerHandler)
+	service.AddStreamHandler(&testMsg{cmd: testCmdStream}, testStreamHandler)
+	service.AddMsgHandler(&testMsg{cmd: testCmdNotify}, testNotifyHandler)
+	go service.LoopHandle(make(chan struct{}, 1))
+	t.Cleanup(func() {
+		service.Close()
+	})
+	return service
+}
+
+func TestCliCall(t *testing.T) {
+	_, address := startTestService(t, testOption())
+
+	cli, err := NewCli(context.Background(), address, 2, testCliOption(), testParseHash())
+	if err != nil {
+		t.Fatalf("new cli error:%+v", err)
+	}
+
+	for i := 0; i < 10; i++ {
+		text := fmt.Sprintf("hello %d", i)
+		outMsg, err := cli.CallWithRetry(context.Background(), &testMsg{cmd: testCmdReq, Text: text}, 1)
+		if err != nil {
+			t.Fatalf("call error:%+v", err)
+		}
+		if outMsg.(*testMsg).Text != text {
+			t.Errorf("expect %s got %s", text, outMsg.(*testMsg).Text)
+		}
+	}
+}
+
+func TestMuxCliOutOfOrder(t *testing.T) {
+	option := testOption()
+	option.AsyncDispatch = true
+	option.WorkerNum = 20
+	option.WorkerQueueSize = 20
+	option.WriteQueueSize = 20
+	_, address := startTestService(t, option)
+
+	cli, err := NewMuxCli(context.Background(), address, testCliOption(), testParseHash())
+	if err != nil {
+		t.Fatalf("new mux cli error:%+v", err)
+	}
+	defer cli.Close()
+
+	//先发出的请求处理更慢,返回消息乱序到达
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			text := fmt.Sprintf("sleep:%d", time.Duration(20-i)*time.Millisecond)
+			outMsg, err := cli.Call(context.Background(), &testMsg{cmd: testCmdReq, Text: text})
+			if err != nil {
+				t.Errorf("call error:%+v", err)
+				return
+			}
+			if outMsg.(*testMsg).Text != text {
+				t.Errorf("expect %s got %s", text, outMsg.(*testMsg).Text)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+//测试用的连接器
+type testDialFunc func(ctx context.Context, network, address string) (net.Conn, error)
+
+func (f testDialFunc) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	return f(ctx, network, address)
+}
+
+func TestMuxCliReconnectUnlocked(t *testing.T) {
+	_, address := startTestService(t, testOption())
+
+	//第一次连接之后的连接阻塞,直到release关闭
+	var dials int32
+	release := make(chan struct{})
+	cliOption := testCliOption()
+	cliOption.Dialer = testDialFunc(func(ctx context.Context, network, address string) (net.Conn, error) {
+		if atomic.AddInt32(&dials, 1) > 1 {
+			<-release
+		}
+		return (&net.Dialer{}).DialContext(ctx, network, address)
+	})
+	cli, err := NewMuxCli(context.Background(), address, cliOption, testParseHash())
+	if err != nil {
+		t.Fatalf("new mux cli error:%+v", err)
+	}
+	defer cli.Close()
+	cli.conn.fail(ErrUnknown)
+
+	//一个调用正在重新连接
+	slowErr := make(chan error, 1)
+	go func() {
+		_, err := cli.Call(context.Background(), &testMsg{cmd: testCmdReq, Text: "slow"})
+		slowErr <- err
+	}()
+	for atomic.LoadInt32(&dials) < 2 {
+		time.Sleep(time.Millisecond)
+	}
+
+	//其他调用不被阻塞,在自己的超时后返回
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err = cli.Call(ctx, &testMsg{cmd: testCmdReq, Text: "x"})
+	if err != context.DeadlineExceeded || time.Since(start) > 500*time.Millisecond {
+		t.Errorf("expect deadline exceeded while dialing, got %+v after %v", err, time.Since(start))
+	}
+
+	//连接建立后等待的调用完成,只建立了一次连接
+	close(release)
+	err = <-slowErr
+	if err != nil {
+		t.Errorf("call after reconnect error:%+v", err)
+	}
+	if n := atomic.LoadInt32(&dials); n != 2 {
+		t.Errorf("expect 2 dials, got %d", n)
+	}
+}
+
+func TestCliRemoteError(t *testing.T) {
+	_, address := startTestService(t, testOption())
+
+	cli, err := NewCli(context.Background(), address, 1, testCliOption(), testParseHash())
+	if err != nil {
+		t.Fatalf("new cli error:%+v", err)
+	}
+
+	//没有注册处理的消息
+	_, err = cli.CallWithRetry(context.Background(), &testMsg{cmd: testCmdRsp, Text: "x"}, 3)
+	remoteErr, ok := err.(*RPCError)
+	if !ok || remoteErr.Code != ErrCodeNotFound {
+		t.Errorf("expect not found remote error, got %+v", err)
+	}
+
+	//处理出错
+	_, err = cli.CallWithRetry(context.Background(), &testMsg{cmd: testCmdReq, Text: "error:bad"}, 3)
+	remoteErr, ok = err.(*RPCError)
+	if !ok || remoteErr.Code != ErrCodeInternal || remoteErr.Message != "error:bad" {
+		t.Errorf("expect internal remote error, got %+v", err)
+	}
+
+	//连接仍然可用
+	outMsg, err := cli.CallWithRetry(context.Background(), &testMsg{cmd: testCmdReq, Text: "ok"}, 0)
+	if err != nil || outMsg.(*testMsg).Text != "ok" {
+		t.Errorf("call after remote error, msg:%+v err:%+v", outMsg, err)
+	}
+}
+
+func TestServiceShutdown(t *testing.T) {
+	service, address := startTestService(t, testOption())
+
+	cli, err := NewCli(context.Background(), address, 1, testCliOption(), testParseHash())
+	if err != nil {
+		t.Fatalf("new cli error:%+v", err)
+	}
+	idleConn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatalf("dial error:%+v", err)
+	}
+	defer idleConn.Close()
+
+	//一个连接正在处理慢请求,另一个连接空闲
+	callErr := make(chan error, 1)
+	go func() {
+		_, err := cli.CallWithRetry(context.Background(), &testMsg{cmd: testCmdReq, Text: "sleep:300000000"}, 0)
+		callErr <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	shutdownErr := make(chan error, 1)
+	go func() {
+		shutdownErr <- service.Shutdown(ctx)
+	}()
+	//等待处理完成期间空闲连接被关闭
+	expectConnClosed(t, idleConn)
+	select {
+	case err = <-callErr:
+		t.Fatalf("in-flight call finished before idle connection closed, err:%+v", err)
+	default:
+	}
+	//正在处理的请求正常完成
+	err = <-callErr
+	if err != nil {
+		t.Errorf("in-flight call error:%+v", err)
+	}
+	err = <-shutdownErr
+	if err != nil {
+		t.Errorf("shutdown error:%+v", err)
+	}
+}
+
+func TestServiceShutdownTimeout(t *testing.T) {
+	service, address := startTestService(t, testOption())
+
+	cli, err := NewCli(context.Background(), address, 1, testCliOption(), testParseHash())
+	if err != nil {
+		t.Fatalf("new cli error:%+v", err)
+	}
+	callErr := make(chan error, 1)
+	go func() {
+		_, err := cli.CallWithRetry(context.Background(), &testMsg{cmd: testCmdReq, Text: "sleep:500000000"}, 0)
+		callErr <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	//处理完成前ctx超时,返回ctx的错误并强制关闭连接
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err = service.Shutdown(ctx)
+	if err != context.DeadlineExceeded {
+		t.Errorf("expect deadline exceeded, got %+v", err)
+	}
+	err = <-callErr
+	if err == nil {
+		t.Errorf("expect in-flight call error after forced close")
+	}
+}
+
+func TestContextHandler(t *testing.T) {
+	_, address := startTestService(t, testOption())
+
+	cli, err := NewCli(context.Background(), address, 1, testCliOption(), testParseHash())
+	if err != nil {
+		t.Fatalf("new cli error:%+v", err)
+	}
+
+	outMsg, err := cli.CallWithRetry(context.Background(), &testMsg{cmd: testCmdCtx}, 0)
+	if err != nil || outMsg.(*testMsg).Text != "deadline:false timeout:false peer:true" {
+		t.Errorf("call without deadline, msg:%+v err:%+v", outMsg, err)
+	}
+
+	//客户端的超时时间带到服务端
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	outMsg, err = cli.CallWithRetry(ctx, &testMsg{cmd: testCmdCtx}, 0)
+	if err != nil || outMsg.(*testMsg).Text != "deadline:true timeout:true peer:true" {
+		t.Errorf("call with deadline, msg:%+v err:%+v", outMsg, err)
+	}
+}
+
+func TestExpiredDeadline(t *testing.T) {
+	var handled int32
+	option := testOption()
+	option.AsyncDispatch = true
+	option.WorkerNum = 1
+	option.Interceptors = []ServerInterceptor{
+		func(ctx context.Context, head MsgHead, inMsg IMsg, handler MsgHandlerWithContext) (IMsg, error) {
+			if head.Cmd == testCmdCtx {
+				atomic.AddInt32(&handled, 1)
+			}
+			return handler(ctx, inMsg)
+		},
+	}
+	_, address := startTestService(t, option)
+
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatalf("dial error:%+v", err)
+	}
+	defer conn.Close()
+
+	//请求在队列中等待慢请求时超过了客户端的超时,不调用处理函数,直接返回超时错误
+	writeTestFrame(t, conn, &testMsg{cmd: testCmdReq, Text: fmt.Sprintf("sleep:%d", 100*time.Millisecond)}, 1)
+	writeTestFrameWithTimeout(t, conn, &testMsg{cmd: testCmdCtx}, 2, 10)
+	var expired error
+	for i := 0; i < 2; i++ {
+		head, _, err := readTestFrame(t, conn)
+		if head.Seq == 2 {
+			expired = err
+		}
+	}
+	if CodeOf(expired) != ErrCodeDeadline {
+		t.Errorf("expect deadline error, got %+v", expired)
+	}
+	if n := atomic.LoadInt32(&handled); n != 0 {
+		t.Errorf("expect handler not called, called %d times", n)
+	}
+}
+
+func TestInterceptors(t *testing.T) {
+	var order []string
+	var lock sync.Mutex
+	record := func(name string) {
+		lock.Lock()
+		order = append(order, name)
+		lock.Unlock()
+	}
+
+	option := testOption()
+	option.Interceptors = []ServerInterceptor{
+		NewServerRecoveryInterceptor(zap.NewNop()),
+		func(ctx context.Context, head MsgHead, inMsg IMsg, handler MsgHandlerWithContext) (IMsg, error) {
+			record(fmt.Sprintf("server cmd:%d", head.Cmd))
+			return handler(ctx, inMsg)
+		},
+	}
+	_, address := startTestService(t, option)
+
+	cliOption := testCliOption()
+	cliOption.Interceptors = []ClientInterceptor{
+		func(ctx context.Context, head MsgHead, inMsg IMsg, invoker Invoker) (IMsg, error) {
+			record("client outer")
+			return invoker(ctx, inMsg)
+		},
+		func(ctx context.Context, head MsgHead, inMsg IMsg, invoker Invoker) (IMsg, error) {
+			record("client inner")
+			return invoker(ctx, inMsg)
+		},
+	}
+	cli, err := NewCli(context.Background(), address, 1, cliOption, testParseHash())
+	if err != nil {
+		t.Fatalf("new cli error:%+v", err)
+	}
+
+	_, err = cli.CallWithRetry(context.Background(), &testMsg{cmd: testCmdReq, Text: "hi"}, 0)
+	if err != nil {
+		t.Fatalf("call error:%+v", err)
+	}
+	expect := "client outer,client inner,server cmd:1"
+	if strings.Join(order, ",") != expect {
+		t.Errorf("expect order %s got %s", expect, strings.Join(order, ","))
+	}
+
+	//panic被恢复为错误消息
+	_, err = cli.CallWithRetry(context.Background(), &testMsg{cmd: testCmdReq, Text: "panic:boom"}, 0)
+	remoteErr, ok := err.(*RPCError)
+	if !ok || remoteErr.Code != ErrCodeInternal {
+		t.Errorf("expect internal remote error, got %+v", err)
+	}
+}
@@ -0,0 +1,136 @@
+package fast_rpc
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	//优雅关闭时检查连接的间隔
+	shutdownPollInterval = 50 * time.Millisecond
+)
+
+//连接状态 -- 用于优雅关闭
+type connState struct {
+	conn net.Conn
+	//是否空闲 -- 正在等待下一个消息头
+	idle bool
+	//是否已被中断读取
+	interrupted bool
+	sync.Mutex
+}
+
+//登记连接 -- 已经在关闭中时返回nil
+func (s *Service) trackConn(conn net.Conn) *connState {
+	s.Lock()
+	defer s.Unlock()
+	if s.shuttingDown {
+		return nil
+	}
+	if s.conns == nil {
+		s.conns = make(map[*connState]struct{})
+	}
+	st := &connState{conn: conn}
+	s.conns[st] = struct{}{}
+	return st
+}
+
+//注销连接
+func (s *Service) untrackConn(st *connState) {
+	s.Lock()
+	delete(s.conns, st)
+	s.Unlock()
+}
+
+//是否在关闭中
+func (s *Service) isShuttingDown() bool {
+	s.Lock()
+	defer s.Unlock()
+	return s.shuttingDown
+}
+
+//进入空闲 -- 返回false表示服务在关闭中,连接应当退出
+func (st *connState) setIdle() bool {
+	st.Lock()
+	defer st.Unlock()
+	if st.interrupted {
+		return false
+	}
+	st.idle = true
+	return true
+}
+
+//开始处理消息 -- 返回false表示读取已被关闭中断,消息应当丢弃
+func (st *connState) setActive() bool {
+	st.Lock()
+	defer st.Unlock()
+	if st.interrupted {
+		return false
+	}
+	st.idle = false
+	return true
+}
+
+//中断空闲连接的读取,正在处理消息的连接处理完当前消息后自行退出
+func (st *connState) interruptIfIdle() {
+	st.Lock()
+	defer st.Unlock()
+	if st.idle && !st.interrupted {
+		st.interrupted = true
+		st.conn.SetReadDeadline(time.Now())
+	}
+}
+
+//优雅关闭
+//停止监听,空闲的连接立即关闭,正在处理的连接处理完当前消息后关闭
+//所有连接都关闭后返回nil,ctx结束时强制关闭剩余连接并返回ctx的错误
+func (s *Service) Shutdown(ctx context.Context) error {
+	s.Lock()
+	s.shuttingDown = true
+	s.Unlock()
+
+	err := s.Close()
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for {
+		if s.closeIdleConns() {
+			s.stopWorkers()
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			s.closeAllConns()
+			go func() {
+				//剩余的连接退出后再停止处理协程
+				for !s.closeIdleConns() {
+					time.Sleep(shutdownPollInterval)
+				}
+				s.stopWorkers()
+			}()
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+//中断空闲连接,返回是否所有连接都已退出
+func (s *Service) closeIdleConns() bool {
+	s.Lock()
+	defer s.Unlock()
+	for st := range s.conns {
+		st.interruptIfIdle()
+	}
+	return len(s.conns) == 0
+}
+
+//强制关闭所有连接
+func (s *Service) closeAllConns() {
+	s.Lock()
+	defer s.Unlock()
+	for st := range s.conns {
+		st.conn.Close()
+	}
+}
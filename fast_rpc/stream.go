@@ -0,0 +1,529 @@
+package fast_rpc
+
+import (
+	"context"
+	"github.com/pineal-niwan/busybox/buffer"
+	"github.com/pineal-niwan/busybox/util"
+	"go.uber.org/zap"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	//每个流等待读取的消息数 -- 队列满时重置流,不阻塞连接上的其他消息
+	streamRecvQueueSize = 16
+)
+
+//流处理函数 -- 返回后流结束,返回错误时客户端的Recv得到该错误
+//stream.Context()带有客户端的超时时间,客户端放弃、连接断开或接收队列满被重置时取消
+//拦截器只作用于普通的请求,不作用于流
+type StreamHandler func(stream *ServerStream) error
+
+//可以打开流的客户端 -- 目前只有MuxCli,Cli与BalancedCli不支持流
+type StreamCaller interface {
+	//以msg的Cmd与Version打开流,msg本身不发送
+	OpenStream(ctx context.Context, msg IMsg) (*ClientStream, error)
+}
+
+//服务端的流
+type ServerStream struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	//所属服务
+	service *Service
+	//所属连接的发送者
+	writer *connWriter
+	//打开流的消息头
+	head MsgHead
+	//收到的消息 -- 客户端结束发送时关闭
+	recvChan chan *_CallRet
+	//recvChan是否已关闭 -- 只在连接的读协程中访问
+	recvClosed bool
+	//是否已被重置 -- 重置后不再发送流结束的消息
+	reset int32
+	//流结束后释放准入
+	release func()
+}
+
+//连接上的流
+type streamSet struct {
+	streams map[uint32]*ServerStream
+	sync.Mutex
+}
+
+func newStreamSet() *streamSet {
+	return &streamSet{
+		streams: make(map[uint32]*ServerStream),
+	}
+}
+
+//登记流 -- 流编号已存在时返回false
+func (set *streamSet) add(seq uint32, stream *ServerStream) bool {
+	set.Lock()
+	defer set.Unlock()
+	_, ok := set.streams[seq]
+	if ok {
+		return false
+	}
+	set.streams[seq] = stream
+	return true
+}
+
+func (set *streamSet) get(seq uint32) *ServerStream {
+	set.Lock()
+	defer set.Unlock()
+	return set.streams[seq]
+}
+
+func (set *streamSet) remove(seq uint32) {
+	set.Lock()
+	delete(set.streams, seq)
+	set.Unlock()
+}
+
+//添加流处理 -- 客户端以msg的Cmd与Version打开流
+func (s *Service) AddStreamHandler(msg IMsg, handler StreamHandler) {
+	s.streamHandlerHash[msg.GetCode()] = handler
+}
+
+//处理流的消息 -- 在连接的读协程中调用
+//release是打开流时得到的准入,其他消息为nil
+func (s *Service) handleStreamFrame(
+	ctx context.Context,
+	writer *connWriter,
+	streams *streamSet,
+	head MsgHead,
+	peer *Peer,
+	recvTime time.Time,
+	inMsg IMsg,
+	parseErr error,
+	release func()) {
+
+	if head.Flags&MsgFlagStreamOpen != 0 {
+		s.openStream(ctx, writer, streams, head, peer, recvTime, release)
+	}
+	stream := streams.get(head.Seq)
+	if stream == nil {
+		//流已经结束
+		return
+	}
+	if head.Flags&MsgFlagStreamReset != 0 {
+		stream.cancel()
+		return
+	}
+	if stream.recvClosed {
+		//客户端已经结束发送
+		return
+	}
+	if inMsg != nil || parseErr != nil {
+		//流处理函数读取太慢时重置流,不阻塞读协程
+		select {
+		case stream.recvChan <- &_CallRet{msg: inMsg, err: parseErr}:
+		default:
+			s.resetStream(writer, streams, stream)
+			return
+		}
+	}
+	if head.Flags&MsgFlagStreamEnd != 0 {
+		stream.recvClosed = true
+		close(stream.recvChan)
+	}
+}
+
+//重置流 -- 取消流处理函数并通知客户端,流的后续消息被丢弃
+func (s *Service) resetStream(writer *connWriter, streams *streamSet, stream *ServerStream) {
+	if !atomic.CompareAndSwapInt32(&stream.reset, 0, 1) {
+		return
+	}
+	streams.remove(stream.head.Seq)
+	stream.cancel()
+	data, buf, err := s.marshalStreamMsg(stream.head, nil, MsgFlagStream|MsgFlagStreamReset)
+	if err != nil {
+		s.logger.Error("service marshal stream reset error",
+			remoteField(writer.conn.RemoteAddr()),
+			zap.Error(err))
+		return
+	}
+	s.queueFrame(writer, data, buf)
+}
+
+//打开流并启动流处理协程
+func (s *Service) openStream(ctx context.Context, writer *connWriter, streams *streamSet, head MsgHead, peer *Peer, recvTime time.Time, release func()) {
+	streamCtx, cancel := newRequestContext(ctx, head, peer, recvTime)
+	stream := &ServerStream{
+		ctx:      streamCtx,
+		cancel:   cancel,
+		service:  s,
+		writer:   writer,
+		head:     head,
+		recvChan: make(chan *_CallRet, streamRecvQueueSize),
+		release:  release,
+	}
+	if !streams.add(head.Seq, stream) {
+		s.logger.Error("service stream seq conflict",
+			remoteField(writer.conn.RemoteAddr()),
+			zap.Uint16("cmd", head.Cmd),
+			zap.Uint32("seq", head.Seq))
+		cancel()
+		release()
+		return
+	}
+	writer.pending.Add(1)
+	go s.runStream(stream, streams, s.streamHandlerHash[head.GetCode()])
+}
+
+//流处理协程 -- 处理函数返回后发送流结束的消息
+func (s *Service) runStream(stream *ServerStream, streams *streamSet, handler StreamHandler) {
+	var err error
+
+	defer func() {
+		panicErr := util.Recover(recover())
+		if panicErr != nil {
+			s.logPanic(panicErr)
+			err = panicErr.Err
+		}
+		streams.remove(stream.head.Seq)
+		stream.end(err)
+		stream.cancel()
+		stream.release()
+		stream.writer.pending.Done()
+	}()
+
+	if handler == nil {
+		err = WrapRPCError(ErrCodeNotFound, ErrBadMsgHandler,
+			"bad stream handler cmd:%+v, version:%+v", stream.head.Cmd, stream.head.Version)
+		return
+	}
+	err = handler(stream)
+}
+
+//流的context -- 可以获取打开流的消息头与对端信息
+func (stream *ServerStream) Context() context.Context {
+	return stream.ctx
+}
+
+//接收客户端发送的消息,客户端结束发送后返回io.EOF
+func (stream *ServerStream) Recv() (IMsg, error) {
+	select {
+	case ret, ok := <-stream.recvChan:
+		if !ok {
+			return nil, io.EOF
+		}
+		return ret.msg, ret.err
+	case <-stream.ctx.Done():
+		return nil, stream.ctx.Err()
+	}
+}
+
+//向客户端发送消息 -- 可以并发调用
+func (stream *ServerStream) Send(outMsg IMsg) error {
+	err := stream.ctx.Err()
+	if err != nil {
+		return err
+	}
+	data, buf, err := stream.service.marshalStreamMsg(stream.head, outMsg, MsgFlagStream)
+	if err != nil {
+		return err
+	}
+	select {
+	case stream.writer.outChan <- outFrame{data: data, buf: buf}:
+		return nil
+	case <-stream.ctx.Done():
+		return stream.ctx.Err()
+	}
+}
+
+//发送流结束的消息,err不为nil时带上错误消息
+func (stream *ServerStream) end(err error) {
+	var outMsg IMsg
+
+	if atomic.LoadInt32(&stream.reset) != 0 {
+		//已经通知客户端重置
+		return
+	}
+	if err != nil {
+		outMsg = &ErrorMsg{RPCError: *toRPCError(err, ErrCodeInternal)}
+	}
+	data, buf, err := stream.service.marshalStreamMsg(stream.head, outMsg, MsgFlagStream|MsgFlagStreamEnd)
+	if err != nil {
+		stream.service.logger.Error("service marshal stream end error",
+			zap.Error(err))
+		return
+	}
+	//发送协程在连接上所有的流结束后才退出,队列满时关闭连接
+	stream.service.queueFrame(stream.writer, data, buf)
+}
+
+//拒绝打开流 -- 直接发送带错误消息的流结束消息,流的后续消息被丢弃
+func (s *Service) rejectStream(writer *connWriter, head MsgHead, err error) {
+	outMsg := &ErrorMsg{RPCError: *toRPCError(err, ErrCodeInternal)}
+	s.option.Metrics.observe(head, outMsg, 0)
+	data, buf, err := s.marshalStreamMsg(head, outMsg, MsgFlagStream|MsgFlagStreamEnd)
+	if err != nil {
+		s.logger.Error("service marshal stream reject error",
+			remoteField(writer.conn.RemoteAddr()),
+			zap.Error(err))
+		return
+	}
+	s.queueFrame(writer, data, buf)
+}
+
+//序列化流的消息 -- outMsg为nil时只有消息头
+func (s *Service) marshalStreamMsg(head MsgHead, outMsg IMsg, flags uint8) ([]byte, []byte, error) {
+	buf := s.bufferPool.Get().([]byte)
+	if outMsg != nil {
+		return s.marshalOutMsg(head, outMsg, flags, buf)
+	}
+	buf = buffer.BytesExtends(buf, MsgHeadSize, 0)
+	outHead := newControlHead(head, flags)
+	outHead.Accept = s.option.Compression.accept()
+	if s.option.BodyChecksum {
+		outHead.Flags |= MsgFlagBodyCRC
+	}
+	data, err := encodeFrame(buf, MsgHeadSize, outHead, CodecNone, s.option.Option)
+	return data, buf, err
+}
+
+//只有消息头的流控制消息
+func newControlHead(head MsgHead, flags uint8) MsgHead {
+	return MsgHead{
+		HeadVer: MsgHeadFramed,
+		Flags:   flags,
+		Cmd:     head.Cmd,
+		Version: head.Version,
+		Seq:     head.Seq,
+		Timeout: head.Timeout,
+	}
+}
+
+//客户端的流
+type ClientStream struct {
+	ctx context.Context
+	//所属客户端
+	cli *MuxCli
+	//所属连接
+	conn *muxConn
+	//打开流的消息头
+	head MsgHead
+	//收到的消息
+	recvChan chan *_CallRet
+	//流结束时关闭
+	end chan struct{}
+	//流结束的原因 -- 服务端正常结束时为io.EOF
+	err error
+	//是否已结束
+	finished int32
+	//是否已结束发送
+	sendClosed int32
+}
+
+//打开流
+//msg只用于确定服务端的流处理函数,不发送; ctx结束时流被放弃,流不经过拦截器
+func (cli *MuxCli) OpenStream(ctx context.Context, msg IMsg) (*ClientStream, error) {
+	conn, err := cli.getConn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	timeout, err := timeoutFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	seq := atomic.AddUint32(&cli.seq, 1)
+	stream := &ClientStream{
+		ctx:  ctx,
+		cli:  cli,
+		conn: conn,
+		head: MsgHead{
+			Cmd:     msg.GetCmd(),
+			Version: msg.GetVersion(),
+			Seq:     seq,
+			Timeout: timeout,
+		},
+		recvChan: make(chan *_CallRet, streamRecvQueueSize),
+		end:      make(chan struct{}),
+	}
+	//先登记,防止服务端的消息先于登记到达
+	err = conn.registerStream(seq, stream)
+	if err != nil {
+		return nil, err
+	}
+	callRet := cli.sendControl(ctx, conn, newControlHead(stream.head, MsgFlagStream|MsgFlagStreamOpen))
+	if callRet.err != nil {
+		stream.finish(callRet.err)
+		if callRet.needResetConn {
+			conn.fail(callRet.err)
+		}
+		return nil, callRet.err
+	}
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			stream.closeWithErr(ctx.Err())
+		case <-stream.end:
+		}
+	}()
+	return stream, nil
+}
+
+//发送消息 -- 可以并发调用
+func (stream *ClientStream) Send(inMsg IMsg) error {
+	if atomic.LoadInt32(&stream.finished) != 0 || atomic.LoadInt32(&stream.sendClosed) != 0 {
+		return ErrStreamClosed
+	}
+	callRet := stream.cli.send(stream.ctx, stream.conn, stream.head.Seq, inMsg, MsgFlagStream)
+	if callRet.needResetConn {
+		stream.conn.fail(callRet.err)
+	}
+	return callRet.err
+}
+
+//结束发送 -- 服务端的Recv随之返回io.EOF,仍然可以继续接收
+func (stream *ClientStream) CloseSend() error {
+	if !atomic.CompareAndSwapInt32(&stream.sendClosed, 0, 1) {
+		return nil
+	}
+	if atomic.LoadInt32(&stream.finished) != 0 {
+		return nil
+	}
+	callRet := stream.cli.sendControl(stream.ctx, stream.conn, newControlHead(stream.head, MsgFlagStream|MsgFlagStreamEnd))
+	if callRet.needResetConn {
+		stream.conn.fail(callRet.err)
+	}
+	return callRet.err
+}
+
+//接收服务端发送的消息
+//服务端正常结束时返回io.EOF,出错结束时返回服务端的错误
+func (stream *ClientStream) Recv() (IMsg, error) {
+	select {
+	case ret := <-stream.recvChan:
+		return ret.msg, ret.err
+	case <-stream.end:
+		//结束前收到的消息先读完
+		select {
+		case ret := <-stream.recvChan:
+			return ret.msg, ret.err
+		default:
+		}
+		return nil, stream.err
+	case <-stream.ctx.Done():
+		return nil, stream.ctx.Err()
+	}
+}
+
+//放弃流 -- 流还没有结束时通知服务端取消
+func (stream *ClientStream) Close() error {
+	return stream.closeWithErr(ErrStreamClosed)
+}
+
+func (stream *ClientStream) closeWithErr(err error) error {
+	if !stream.finish(err) {
+		return nil
+	}
+	return stream.reset()
+}
+
+//通知服务端取消流
+func (stream *ClientStream) reset() error {
+	callRet := stream.cli.sendControl(context.Background(), stream.conn, newControlHead(stream.head, MsgFlagStream|MsgFlagStreamReset))
+	if callRet.needResetConn {
+		stream.conn.fail(callRet.err)
+	}
+	return callRet.err
+}
+
+//结束流 -- 返回是否由本次调用结束
+func (stream *ClientStream) finish(err error) bool {
+	if !atomic.CompareAndSwapInt32(&stream.finished, 0, 1) {
+		return false
+	}
+	stream.err = err
+	close(stream.end)
+	stream.conn.unregisterStream(stream.head.Seq)
+	return true
+}
+
+//分发流的消息 -- 在读协程中调用
+func (cli *MuxCli) dispatchStream(conn *muxConn, head MsgHead, body []byte) {
+	stream := conn.getStream(head.Seq)
+	if stream == nil {
+		//流已经结束
+		return
+	}
+
+	var outMsg IMsg
+	var err error
+	if len(body) > 0 {
+		body, err = decodeBody(head, body, cli.MaxMsgSize, cli.Compression.accept())
+		if err == nil {
+			outMsg, err = parseReply(cli.msgParseHash, head, body, cli.Option)
+		}
+	}
+	if head.Flags&MsgFlagStreamReset != 0 {
+		//服务端的接收队列已满
+		stream.finish(ErrStreamReset)
+		return
+	}
+	if head.Flags&MsgFlagStreamEnd != 0 {
+		//结束消息带的错误作为流结束的原因
+		if err == nil {
+			err = io.EOF
+			if outMsg != nil {
+				stream.push(&_CallRet{msg: outMsg})
+			}
+		}
+		stream.finish(err)
+		return
+	}
+	if outMsg != nil || err != nil {
+		stream.push(&_CallRet{msg: outMsg, err: err})
+	}
+}
+
+//交给调用方读取 -- 调用方读取太慢时重置流,不阻塞读协程
+func (stream *ClientStream) push(ret *_CallRet) {
+	select {
+	case stream.recvChan <- ret:
+	default:
+		if stream.finish(ErrStreamReset) {
+			//发送可能阻塞,不在读协程中发送
+			go stream.reset()
+		}
+	}
+}
+
+//发送只有消息头的流控制消息
+func (cli *MuxCli) sendControl(ctx context.Context, conn *muxConn, head MsgHead) *_CallRet {
+	data, err := cli.encodeRequest(make([]byte, MsgHeadSize), MsgHeadSize, head, 0)
+	if err != nil {
+		return &_CallRet{err: err}
+	}
+	return cli.writeBytes(ctx, conn, data)
+}
+
+//登记流
+func (conn *muxConn) registerStream(seq uint32, stream *ClientStream) error {
+	conn.Lock()
+	defer conn.Unlock()
+	if conn.err != nil {
+		return conn.err
+	}
+	conn.streams[seq] = stream
+	return nil
+}
+
+func (conn *muxConn) getStream(seq uint32) *ClientStream {
+	conn.Lock()
+	defer conn.Unlock()
+	return conn.streams[seq]
+}
+
+func (conn *muxConn) unregisterStream(seq uint32) {
+	conn.Lock()
+	delete(conn.streams, seq)
+	conn.Unlock()
+}
@@ -0,0 +1,214 @@
+package fast_rpc
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+var (
+	//流处理函数因客户端放弃而结束时通知
+	testStreamCanceled = make(chan struct{}, 1)
+)
+
+//流处理 -- 每收到一个消息回显一次,客户端结束发送后返回收到的消息数
+//文本以"error:"开头时出错结束; 为"block"时回显后等待客户端放弃
+//文本为"push:N"时连续发送N个消息后等待客户端放弃
+func testStreamHandler(stream *ServerStream) error {
+	var count int
+	for {
+		inMsg, err := stream.Recv()
+		if err == io.EOF {
+			return stream.Send(&testMsg{cmd: testCmdRsp, Text: fmt.Sprintf("count:%d", count)})
+		}
+		if err != nil {
+			return err
+		}
+		req := inMsg.(*testMsg)
+		if strings.HasPrefix(req.Text, "error:") {
+			return NewRPCError(ErrCodeBadRequest, "%s", req.Text)
+		}
+		var n int
+		if _, err = fmt.Sscanf(req.Text, "push:%d", &n); err == nil {
+			for i := 0; i < n && err == nil; i++ {
+				err = stream.Send(&testMsg{cmd: testCmdRsp, Text: fmt.Sprintf("msg %d", i)})
+			}
+			<-stream.Context().Done()
+			return stream.Context().Err()
+		}
+		if req.Text == "block" {
+			stream.Send(&testMsg{cmd: testCmdRsp, Text: req.Text})
+			<-stream.Context().Done()
+			testStreamCanceled <- struct{}{}
+			return stream.Context().Err()
+		}
+		count++
+		err = stream.Send(&testMsg{cmd: testCmdRsp, Text: req.Text})
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func TestStream(t *testing.T) {
+	//顺序处理与异步分发的服务都支持流
+	for _, async := range []bool{false, true} {
+		option := testOption()
+		option.AsyncDispatch = async
+		option.WorkerNum = 2
+		_, address := startTestService(t, option)
+		testStreamCall(t, address)
+	}
+}
+
+func testStreamCall(t *testing.T, address string) {
+	cli, err := NewMuxCli(context.Background(), address, testCliOption(), testParseHash())
+	if err != nil {
+		t.Fatalf("new mux cli error:%+v", err)
+	}
+	defer cli.Close()
+
+	stream, err := cli.OpenStream(context.Background(), &testMsg{cmd: testCmdStream})
+	if err != nil {
+		t.Fatalf("open stream error:%+v", err)
+	}
+	for i := 0; i < 3; i++ {
+		err = stream.Send(&testMsg{cmd: testCmdReq, Text: fmt.Sprintf("msg %d", i)})
+		if err != nil {
+			t.Fatalf("stream send error:%+v", err)
+		}
+		//流打开期间普通的调用不受影响
+		outMsg, err := cli.Call(context.Background(), &testMsg{cmd: testCmdReq, Text: "unary"})
+		if err != nil || outMsg.(*testMsg).Text != "unary" {
+			t.Fatalf("unary call, msg:%+v err:%+v", outMsg, err)
+		}
+	}
+	err = stream.CloseSend()
+	if err != nil {
+		t.Fatalf("close send error:%+v", err)
+	}
+	var texts []string
+	for {
+		outMsg, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("stream recv error:%+v", err)
+		}
+		texts = append(texts, outMsg.(*testMsg).Text)
+	}
+	if strings.Join(texts, ",") != "msg 0,msg 1,msg 2,count:3" {
+		t.Errorf("unexpected stream msgs:%v", texts)
+	}
+	if err = stream.Send(&testMsg{cmd: testCmdReq, Text: "late"}); err != ErrStreamClosed {
+		t.Errorf("expect send after end to fail, got %+v", err)
+	}
+}
+
+func TestStreamError(t *testing.T) {
+	_, address := startTestService(t, testOption())
+	cli, err := NewMuxCli(context.Background(), address, testCliOption(), testParseHash())
+	if err != nil {
+		t.Fatalf("new mux cli error:%+v", err)
+	}
+	defer cli.Close()
+
+	//处理函数返回的错误在Recv时得到
+	stream, err := cli.OpenStream(context.Background(), &testMsg{cmd: testCmdStream})
+	if err != nil {
+		t.Fatalf("open stream error:%+v", err)
+	}
+	stream.Send(&testMsg{cmd: testCmdReq, Text: "error:bad"})
+	_, err = stream.Recv()
+	remoteErr, ok := err.(*RPCError)
+	if !ok || remoteErr.Code != ErrCodeBadRequest {
+		t.Errorf("expect bad request error, got %+v", err)
+	}
+
+	//没有流处理函数
+	stream, err = cli.OpenStream(context.Background(), &testMsg{cmd: testCmdReq})
+	if err != nil {
+		t.Fatalf("open stream error:%+v", err)
+	}
+	_, err = stream.Recv()
+	remoteErr, ok = err.(*RPCError)
+	if !ok || remoteErr.Code != ErrCodeNotFound {
+		t.Errorf("expect not found error, got %+v", err)
+	}
+
+	//客户端放弃时服务端的流被取消
+	ctx, cancel := context.WithCancel(context.Background())
+	stream, err = cli.OpenStream(ctx, &testMsg{cmd: testCmdStream})
+	if err != nil {
+		t.Fatalf("open stream error:%+v", err)
+	}
+	stream.Send(&testMsg{cmd: testCmdReq, Text: "block"})
+	stream.Recv()
+	cancel()
+	select {
+	case <-testStreamCanceled:
+	case <-time.After(time.Second):
+		t.Errorf("expect server stream canceled")
+	}
+	if _, err = stream.Recv(); err != context.Canceled {
+		t.Errorf("expect canceled, got %+v", err)
+	}
+}
+
+func TestStreamReset(t *testing.T) {
+	_, address := startTestService(t, testOption())
+	cli, err := NewMuxCli(context.Background(), address, testCliOption(), testParseHash())
+	if err != nil {
+		t.Fatalf("new mux cli error:%+v", err)
+	}
+	defer cli.Close()
+
+	//服务端的处理函数不再读取,接收队列满后流被重置
+	stream, err := cli.OpenStream(context.Background(), &testMsg{cmd: testCmdStream})
+	if err != nil {
+		t.Fatalf("open stream error:%+v", err)
+	}
+	stream.Send(&testMsg{cmd: testCmdReq, Text: "block"})
+	stream.Recv()
+	for i := 0; i <= streamRecvQueueSize; i++ {
+		stream.Send(&testMsg{cmd: testCmdReq, Text: fmt.Sprintf("msg %d", i)})
+	}
+	select {
+	case <-testStreamCanceled:
+	case <-time.After(time.Second):
+		t.Errorf("expect server stream canceled")
+	}
+	if _, err = stream.Recv(); err != ErrStreamReset {
+		t.Errorf("expect stream reset by service, got %+v", err)
+	}
+
+	//客户端不读取,服务端发送的消息超过接收队列后流被重置,已收到的消息仍然可以读取
+	stream, err = cli.OpenStream(context.Background(), &testMsg{cmd: testCmdStream})
+	if err != nil {
+		t.Fatalf("open stream error:%+v", err)
+	}
+	err = stream.Send(&testMsg{cmd: testCmdReq, Text: fmt.Sprintf("push:%d", streamRecvQueueSize+1)})
+	if err != nil {
+		t.Fatalf("stream send error:%+v", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	for i := 0; i < streamRecvQueueSize; i++ {
+		outMsg, err := stream.Recv()
+		if err != nil || outMsg.(*testMsg).Text != fmt.Sprintf("msg %d", i) {
+			t.Fatalf("expect queued msg %d, got msg:%+v err:%+v", i, outMsg, err)
+		}
+	}
+	if _, err = stream.Recv(); err != ErrStreamReset {
+		t.Errorf("expect stream reset by client, got %+v", err)
+	}
+
+	//重置流不影响连接上的其他调用
+	outMsg, err := cli.Call(context.Background(), &testMsg{cmd: testCmdReq, Text: "unary"})
+	if err != nil || outMsg.(*testMsg).Text != "unary" {
+		t.Errorf("unary call after reset, msg:%+v err:%+v", outMsg, err)
+	}
+}
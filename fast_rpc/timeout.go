@@ -0,0 +1,88 @@
+package fast_rpc
+
+import (
+	"errors"
+	"github.com/pineal-niwan/busybox/util"
+	"go.uber.org/zap"
+	"net"
+	"os"
+	"time"
+)
+
+const (
+	//超时的阶段
+	timeoutStageIdle  = "idle"
+	timeoutStageHead  = "head"
+	timeoutStageBody  = "body"
+	timeoutStageWrite = "write"
+)
+
+//读取消息头的连接 -- 等待消息头时使用空闲超时,收到第一个字节后改为消息头超时
+type headReadConn struct {
+	net.Conn
+	headTimeout time.Duration
+	//还没有收到消息头的字节
+	waiting bool
+}
+
+func (c *headReadConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if c.waiting && n > 0 {
+		c.waiting = false
+		if c.headTimeout > 0 {
+			c.Conn.SetReadDeadline(time.Now().Add(c.headTimeout))
+		}
+	}
+	return n, err
+}
+
+//开始等待下一个消息头 -- 设置空闲超时
+func (c *headReadConn) wait(idleTimeout time.Duration) error {
+	c.waiting = true
+	return c.Conn.SetReadDeadline(deadlineAfter(idleTimeout))
+}
+
+//读取消息头出错时所处的阶段
+func (c *headReadConn) stage() string {
+	if c.waiting {
+		return timeoutStageIdle
+	}
+	return timeoutStageHead
+}
+
+//超时时间对应的deadline,0表示不限制
+func deadlineAfter(timeout time.Duration) time.Time {
+	if timeout <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(timeout)
+}
+
+//是否是读写超时的错误
+func isTimeout(err error) bool {
+	return errors.Is(err, os.ErrDeadlineExceeded)
+}
+
+//发送消息,设置了发送超时时限制发送时间
+func (s *Service) writeWithTimeout(conn net.Conn, data []byte) error {
+	if s.option.WriteTimeout > 0 {
+		err := conn.SetWriteDeadline(time.Now().Add(s.option.WriteTimeout))
+		if err != nil {
+			return err
+		}
+	}
+	err := util.NetSendBytes(conn, data)
+	if isTimeout(err) {
+		s.onTimeout(conn, timeoutStageWrite, err)
+	}
+	return err
+}
+
+//记录因超时关闭的连接
+func (s *Service) onTimeout(conn net.Conn, stage string, err error) {
+	s.limiter.timeout(stage)
+	s.logger.Info("service connection timeout",
+		remoteField(conn.RemoteAddr()),
+		zap.String("stage", stage),
+		zap.Error(err))
+}
@@ -0,0 +1,137 @@
+package fast_rpc
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+//等待连接被服务端关闭
+func expectConnClosed(t *testing.T, conn net.Conn) {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err := conn.Read(make([]byte, 16))
+	if ne, ok := err.(net.Error); err == nil || (ok && ne.Timeout()) {
+		t.Errorf("expect connection closed, got %+v", err)
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	option := testOption()
+	option.IdleTimeout = 50 * time.Millisecond
+	option.AsyncDispatch = true
+	option.WorkerNum = 2
+	service, address := startTestService(t, option)
+
+	//空闲的连接被关闭
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatalf("dial error:%+v", err)
+	}
+	defer conn.Close()
+	expectConnClosed(t, conn)
+	if load := service.Load(); load.TimedOut != 1 {
+		t.Errorf("unexpected load:%+v", load)
+	}
+
+	//有正在处理的请求时连接不算空闲
+	cli, err := NewMuxCli(context.Background(), address, testCliOption(), testParseHash())
+	if err != nil {
+		t.Fatalf("new mux cli error:%+v", err)
+	}
+	defer cli.Close()
+	outMsg, err := cli.Call(context.Background(), &testMsg{cmd: testCmdReq, Text: "sleep:200000000"})
+	if err != nil || outMsg.(*testMsg).Text != "sleep:200000000" {
+		t.Errorf("slow call, msg:%+v err:%+v", outMsg, err)
+	}
+}
+
+func TestHeadReadTimeout(t *testing.T) {
+	option := testOption()
+	option.HeadReadTimeout = 50 * time.Millisecond
+	option.BodyReadTimeout = 50 * time.Millisecond
+	service, address := startTestService(t, option)
+
+	//只发送了魔数,消息头不完整
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatalf("dial error:%+v", err)
+	}
+	defer conn.Close()
+	buf := make([]byte, MsgHeadSize)
+	err = PutMsgHead(buf, MsgHead{HeadVer: MsgHeadFramed, Cmd: testCmdReq, Size: 16}, testBinOption)
+	if err != nil {
+		t.Fatalf("put head error:%+v", err)
+	}
+	conn.Write(buf[:4])
+	expectConnClosed(t, conn)
+
+	//消息头完整,消息体不完整
+	conn, err = net.Dial("tcp", address)
+	if err != nil {
+		t.Fatalf("dial error:%+v", err)
+	}
+	defer conn.Close()
+	conn.Write(append(buf, 1, 2))
+	expectConnClosed(t, conn)
+	if load := service.Load(); load.TimedOut != 2 {
+		t.Errorf("unexpected load:%+v", load)
+	}
+
+	//没有设置空闲超时,消息之间的等待不受消息头超时限制
+	cli, err := NewCli(context.Background(), address, 1, testCliOption(), testParseHash())
+	if err != nil {
+		t.Fatalf("new cli error:%+v", err)
+	}
+	defer cli.Close()
+	for i := 0; i < 2; i++ {
+		_, err = cli.CallWithRetry(context.Background(), &testMsg{cmd: testCmdReq, Text: "hello"}, 0)
+		if err != nil {
+			t.Fatalf("call error:%+v", err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func TestBodyReadTimeout(t *testing.T) {
+	option := testOption()
+	option.BodyReadTimeout = 50 * time.Millisecond
+	service, address := startTestService(t, option)
+
+	//消息头完整,发送部分消息体后停止发送
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatalf("dial error:%+v", err)
+	}
+	defer conn.Close()
+	buf := make([]byte, MsgHeadSize)
+	err = PutMsgHead(buf, MsgHead{HeadVer: MsgHeadFramed, Cmd: testCmdReq, Size: 16}, testBinOption)
+	if err != nil {
+		t.Fatalf("put head error:%+v", err)
+	}
+	conn.Write(buf)
+	time.Sleep(20 * time.Millisecond)
+	conn.Write([]byte{1, 2})
+	expectConnClosed(t, conn)
+	if load := service.Load(); load.TimedOut != 1 {
+		t.Errorf("unexpected load:%+v", load)
+	}
+}
+
+func TestWriteTimeout(t *testing.T) {
+	option := testOption()
+	option.WriteTimeout = 50 * time.Millisecond
+	service, address := startTestService(t, option)
+
+	//客户端只发送不读取,返回消息写满缓冲区后发送超时,连接被关闭
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatalf("dial error:%+v", err)
+	}
+	defer conn.Close()
+	writeUntilClosed(t, conn)
+	if load := service.Load(); load.TimedOut != 1 {
+		t.Errorf("unexpected load:%+v", load)
+	}
+}
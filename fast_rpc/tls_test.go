@@ -0,0 +1,170 @@
+package fast_rpc
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"github.com/pineal-niwan/busybox/util"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+//测试证书文件
+type testCertFiles struct {
+	caFile         string
+	serverCertFile string
+	serverKeyFile  string
+	clientCertFile string
+	clientKeyFile  string
+}
+
+//生成自签名CA以及由它签发的服务端与客户端证书
+func genTestCerts(t *testing.T) *testCertFiles {
+	dir := t.TempDir()
+	writePem := func(name, typ string, der []byte) string {
+		file := filepath.Join(dir, name)
+		err := ioutil.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), 0600)
+		if err != nil {
+			t.Fatalf("write %s error:%+v", name, err)
+		}
+		return file
+	}
+	newKey := func() *ecdsa.PrivateKey {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatalf("generate key error:%+v", err)
+		}
+		return key
+	}
+	writeKey := func(name string, key *ecdsa.PrivateKey) string {
+		der, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			t.Fatalf("marshal key error:%+v", err)
+		}
+		return writePem(name, "EC PRIVATE KEY", der)
+	}
+
+	caKey := newKey()
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test-ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	caDer, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatalf("create ca error:%+v", err)
+	}
+	caCert, err := x509.ParseCertificate(caDer)
+	if err != nil {
+		t.Fatalf("parse ca error:%+v", err)
+	}
+
+	issue := func(serial int64, cn string, usage x509.ExtKeyUsage, ips []net.IP) ([]byte, *ecdsa.PrivateKey) {
+		key := newKey()
+		template := &x509.Certificate{
+			SerialNumber: big.NewInt(serial),
+			Subject:      pkix.Name{CommonName: cn},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+			IPAddresses:  ips,
+		}
+		der, err := x509.CreateCertificate(rand.Reader, template, caCert, &key.PublicKey, caKey)
+		if err != nil {
+			t.Fatalf("create cert error:%+v", err)
+		}
+		return der, key
+	}
+	serverDer, serverKey := issue(2, "test-server", x509.ExtKeyUsageServerAuth, []net.IP{net.ParseIP("127.0.0.1")})
+	clientDer, clientKey := issue(3, "test-client", x509.ExtKeyUsageClientAuth, nil)
+
+	return &testCertFiles{
+		caFile:         writePem("ca.pem", "CERTIFICATE", caDer),
+		serverCertFile: writePem("server.pem", "CERTIFICATE", serverDer),
+		serverKeyFile:  writeKey("server.key", serverKey),
+		clientCertFile: writePem("client.pem", "CERTIFICATE", clientDer),
+		clientKeyFile:  writeKey("client.key", clientKey),
+	}
+}
+
+func TestMutualTLS(t *testing.T) {
+	files := genTestCerts(t)
+
+	serverTLS, err := (&util.TLSOption{
+		CertFile:          files.serverCertFile,
+		KeyFile:           files.serverKeyFile,
+		CAFile:            files.caFile,
+		RequireClientCert: true,
+	}).ServerConfig()
+	if err != nil {
+		t.Fatalf("server tls config error:%+v", err)
+	}
+	option := testOption()
+	option.TLSConfig = serverTLS
+	option.HandshakeTimeout = time.Second
+	_, address := startTestService(t, option)
+
+	clientTLS, err := (&util.TLSOption{
+		CertFile: files.clientCertFile,
+		KeyFile:  files.clientKeyFile,
+		CAFile:   files.caFile,
+	}).ClientConfig()
+	if err != nil {
+		t.Fatalf("client tls config error:%+v", err)
+	}
+	cliOption := testCliOption()
+	cliOption.TLSConfig = clientTLS
+	cli, err := NewCli(context.Background(), address, 1, cliOption, testParseHash())
+	if err != nil {
+		t.Fatalf("new cli error:%+v", err)
+	}
+	defer cli.Close()
+
+	//服务端能取得验证过的客户端身份
+	outMsg, err := cli.CallWithRetry(context.Background(), &testMsg{cmd: testCmdPeer}, 0)
+	if err != nil || outMsg.(*testMsg).Text != "test-client" {
+		t.Errorf("call with client cert, msg:%+v err:%+v", outMsg, err)
+	}
+
+	muxCli, err := NewMuxCli(context.Background(), address, cliOption, testParseHash())
+	if err != nil {
+		t.Fatalf("new mux cli error:%+v", err)
+	}
+	defer muxCli.Close()
+	outMsg, err = muxCli.Call(context.Background(), &testMsg{cmd: testCmdPeer})
+	if err != nil || outMsg.(*testMsg).Text != "test-client" {
+		t.Errorf("mux call with client cert, msg:%+v err:%+v", outMsg, err)
+	}
+
+	//没有客户端证书时握手失败
+	noCertTLS, err := (&util.TLSOption{
+		CAFile: files.caFile,
+	}).ClientConfig()
+	if err != nil {
+		t.Fatalf("client tls config error:%+v", err)
+	}
+	noCertOption := testCliOption()
+	noCertOption.TLSConfig = noCertTLS
+	noCertCli, err := NewCli(context.Background(), address, 1, noCertOption, testParseHash())
+	if err != nil {
+		t.Fatalf("new cli error:%+v", err)
+	}
+	defer noCertCli.Close()
+	_, err = noCertCli.CallWithRetry(context.Background(), &testMsg{cmd: testCmdPeer}, 0)
+	if err == nil {
+		t.Errorf("expect call without client cert to fail")
+	}
+}
@@ -0,0 +1,44 @@
+package fast_rpc
+
+import (
+	"context"
+	"github.com/pineal-niwan/busybox/util"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestUnixSocket(t *testing.T) {
+	for _, network := range []string{"unix", "unixpacket"} {
+		address := network + "://" + filepath.Join(t.TempDir(), "rpc.sock")
+		ln, err := util.Listen(address, nil)
+		if err != nil {
+			t.Fatalf("listen %s error:%+v", network, err)
+		}
+		option := testOption()
+		option.AsyncDispatch = true
+		option.WorkerNum = 2
+		startTestServiceOn(t, ln, option)
+
+		cli, err := NewCli(context.Background(), address, 1, testCliOption(), testParseHash())
+		if err != nil {
+			t.Fatalf("new cli error:%+v", err)
+		}
+		defer cli.Close()
+		muxCli, err := NewMuxCli(context.Background(), address, testCliOption(), testParseHash())
+		if err != nil {
+			t.Fatalf("new mux cli error:%+v", err)
+		}
+		defer muxCli.Close()
+
+		//超过一个包大小的消息在unixpacket上也能完整传输
+		for _, text := range []string{"hello", strings.Repeat("large message ", 4000)} {
+			for _, caller := range []Caller{cli, muxCli} {
+				outMsg, err := caller.CallWithRetry(context.Background(), &testMsg{cmd: testCmdReq, Text: text}, 0)
+				if err != nil || outMsg.(*testMsg).Text != text {
+					t.Errorf("%s call %T, len:%d err:%+v", network, caller, len(text), err)
+				}
+			}
+		}
+	}
+}
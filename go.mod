@@ -1,5 +1,7 @@
 module github.com/pineal-niwan/busybox
 
+go 1.27.1
+
 require (
 	github.com/go-errors/errors v1.0.1
 	github.com/go-yaml/yaml v2.1.0+incompatible
@@ -7,7 +9,10 @@ require (
 	github.com/tealeg/xlsx v1.0.3
 	github.com/uber-go/zap v1.9.1
 	github.com/urfave/cli v1.19.1
+	go.uber.org/zap v1.9.1
+)
+
+require (
 	go.uber.org/atomic v1.3.2 // indirect
 	go.uber.org/multierr v1.1.0 // indirect
-	go.uber.org/zap v1.9.1
 )
@@ -0,0 +1,161 @@
+package metrics
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var (
+	//重复注册
+	ErrDuplicateMetric = errors.New("duplicate metric name")
+	//标签数量不匹配
+	ErrLabelCount = errors.New("label count mismatch")
+
+	//缺省的注册表
+	DefaultRegistry = NewRegistry()
+)
+
+//指标 -- 以Prometheus文本格式输出
+type Collector interface {
+	//指标名称
+	Name() string
+	//输出文本格式
+	WriteText(w io.Writer) error
+}
+
+//注册表
+type Registry struct {
+	collectors map[string]Collector
+	sync.RWMutex
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		collectors: make(map[string]Collector),
+	}
+}
+
+//注册指标
+func (r *Registry) Register(c Collector) error {
+	r.Lock()
+	defer r.Unlock()
+	if _, ok := r.collectors[c.Name()]; ok {
+		return ErrDuplicateMetric
+	}
+	r.collectors[c.Name()] = c
+	return nil
+}
+
+//注册指标 -- 重复注册时panic,用于初始化
+func (r *Registry) MustRegister(cs ...Collector) {
+	for _, c := range cs {
+		err := r.Register(c)
+		if err != nil {
+			panic(err.Error() + ": " + c.Name())
+		}
+	}
+}
+
+//注销指标
+func (r *Registry) Unregister(name string) {
+	r.Lock()
+	delete(r.collectors, name)
+	r.Unlock()
+}
+
+//按名称顺序输出所有指标
+func (r *Registry) WriteText(w io.Writer) error {
+	r.RLock()
+	names := make([]string, 0, len(r.collectors))
+	for name := range r.collectors {
+		names = append(names, name)
+	}
+	collectors := make([]Collector, 0, len(names))
+	sort.Strings(names)
+	for _, name := range names {
+		collectors = append(collectors, r.collectors[name])
+	}
+	r.RUnlock()
+
+	for _, c := range collectors {
+		err := c.WriteText(w)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//http输出
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	var buf bytes.Buffer
+	err := r.WriteText(&buf)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write(buf.Bytes())
+}
+
+//输出HELP与TYPE
+func writeHeader(w io.Writer, name, help, typ string) error {
+	_, err := io.WriteString(w, "# HELP "+name+" "+escapeHelp(help)+"\n# TYPE "+name+" "+typ+"\n")
+	return err
+}
+
+//输出一个采样值
+func writeSample(w io.Writer, name string, labelNames, labelValues []string, extraName, extraValue string, value float64) error {
+	var sb strings.Builder
+	sb.WriteString(name)
+	if len(labelNames) > 0 || extraName != "" {
+		sb.WriteByte('{')
+		for i, labelName := range labelNames {
+			if i > 0 {
+				sb.WriteByte(',')
+			}
+			sb.WriteString(labelName)
+			sb.WriteString(`="`)
+			sb.WriteString(escapeLabel(labelValues[i]))
+			sb.WriteByte('"')
+		}
+		if extraName != "" {
+			if len(labelNames) > 0 {
+				sb.WriteByte(',')
+			}
+			sb.WriteString(extraName)
+			sb.WriteString(`="`)
+			sb.WriteString(extraValue)
+			sb.WriteByte('"')
+		}
+		sb.WriteByte('}')
+	}
+	sb.WriteByte(' ')
+	sb.WriteString(formatFloat(value))
+	sb.WriteByte('\n')
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var (
+	helpReplacer  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelReplacer = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escapeHelp(s string) string {
+	return helpReplacer.Replace(s)
+}
+
+func escapeLabel(s string) string {
+	return labelReplacer.Replace(s)
+}
@@ -0,0 +1,45 @@
+package metrics
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestRegistryWriteText(t *testing.T) {
+	registry := NewRegistry()
+	counter := NewCounterVec("test_requests_total", "Total requests.", "cmd")
+	histogram := NewHistogramVec("test_latency_seconds", "Latency.", []float64{0.1, 1}, "cmd")
+	registry.MustRegister(counter, histogram)
+
+	counter.Inc("1")
+	counter.Add(2, "1")
+	counter.Inc(`a"b`)
+	histogram.Observe(0.05, "1")
+	histogram.Observe(0.5, "1")
+	histogram.Observe(5, "1")
+
+	if registry.Register(counter) != ErrDuplicateMetric {
+		t.Errorf("expect duplicate error")
+	}
+
+	var buf bytes.Buffer
+	err := registry.WriteText(&buf)
+	if err != nil {
+		t.Fatalf("write text error:%+v", err)
+	}
+	expect := `# HELP test_latency_seconds Latency.
+# TYPE test_latency_seconds histogram
+test_latency_seconds_bucket{cmd="1",le="0.1"} 1
+test_latency_seconds_bucket{cmd="1",le="1"} 2
+test_latency_seconds_bucket{cmd="1",le="+Inf"} 3
+test_latency_seconds_sum{cmd="1"} 5.55
+test_latency_seconds_count{cmd="1"} 3
+# HELP test_requests_total Total requests.
+# TYPE test_requests_total counter
+test_requests_total{cmd="1"} 3
+test_requests_total{cmd="a\"b"} 1
+`
+	if buf.String() != expect {
+		t.Errorf("expect:\n%s\ngot:\n%s", expect, buf.String())
+	}
+}
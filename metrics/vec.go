@@ -0,0 +1,251 @@
+package metrics
+
+import (
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	//缺省的延时分桶(秒)
+	DefaultLatencyBuckets = []float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+)
+
+//按标签值保存的一组采样
+type vec struct {
+	name       string
+	help       string
+	labelNames []string
+	series     map[string]*series
+	sync.Mutex
+}
+
+//一组标签值对应的采样
+type series struct {
+	labelValues []string
+	//计数器与仪表的值,或直方图的总和
+	value float64
+	//直方图每个分桶的计数(不累加)
+	buckets []uint64
+	//直方图的总次数
+	count uint64
+}
+
+func newVec(name, help string, labelNames []string) vec {
+	return vec{
+		name:       name,
+		help:       help,
+		labelNames: labelNames,
+		series:     make(map[string]*series),
+	}
+}
+
+//指标名称
+func (v *vec) Name() string {
+	return v.name
+}
+
+//获取标签值对应的采样,调用方需要持有锁
+func (v *vec) get(labelValues []string, bucketNum int) *series {
+	if len(labelValues) != len(v.labelNames) {
+		panic(ErrLabelCount.Error() + ": " + v.name)
+	}
+	key := strings.Join(labelValues, "\xff")
+	s, ok := v.series[key]
+	if !ok {
+		s = &series{
+			labelValues: append([]string(nil), labelValues...),
+		}
+		if bucketNum > 0 {
+			s.buckets = make([]uint64, bucketNum)
+		}
+		v.series[key] = s
+	}
+	return s
+}
+
+//按标签值顺序复制所有采样
+func (v *vec) snapshot() []series {
+	v.Lock()
+	list := make([]series, 0, len(v.series))
+	for _, s := range v.series {
+		c := *s
+		c.buckets = append([]uint64(nil), s.buckets...)
+		list = append(list, c)
+	}
+	v.Unlock()
+	sort.Slice(list, func(i, j int) bool {
+		return strings.Join(list[i].labelValues, "\xff") < strings.Join(list[j].labelValues, "\xff")
+	})
+	return list
+}
+
+//计数器 -- 只增不减
+type CounterVec struct {
+	vec
+}
+
+func NewCounterVec(name, help string, labelNames ...string) *CounterVec {
+	return &CounterVec{vec: newVec(name, help, labelNames)}
+}
+
+//加1
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+//增加
+func (c *CounterVec) Add(delta float64, labelValues ...string) {
+	if delta < 0 {
+		return
+	}
+	c.Lock()
+	c.get(labelValues, 0).value += delta
+	c.Unlock()
+}
+
+//获取当前值
+func (c *CounterVec) Value(labelValues ...string) float64 {
+	c.Lock()
+	defer c.Unlock()
+	return c.get(labelValues, 0).value
+}
+
+//输出文本格式
+func (c *CounterVec) WriteText(w io.Writer) error {
+	err := writeHeader(w, c.name, c.help, "counter")
+	if err != nil {
+		return err
+	}
+	for _, s := range c.snapshot() {
+		err = writeSample(w, c.name, c.labelNames, s.labelValues, "", "", s.value)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//仪表 -- 可增可减
+type GaugeVec struct {
+	vec
+}
+
+func NewGaugeVec(name, help string, labelNames ...string) *GaugeVec {
+	return &GaugeVec{vec: newVec(name, help, labelNames)}
+}
+
+//设置
+func (g *GaugeVec) Set(value float64, labelValues ...string) {
+	g.Lock()
+	g.get(labelValues, 0).value = value
+	g.Unlock()
+}
+
+//增加,delta可以为负
+func (g *GaugeVec) Add(delta float64, labelValues ...string) {
+	g.Lock()
+	g.get(labelValues, 0).value += delta
+	g.Unlock()
+}
+
+//获取当前值
+func (g *GaugeVec) Value(labelValues ...string) float64 {
+	g.Lock()
+	defer g.Unlock()
+	return g.get(labelValues, 0).value
+}
+
+//输出文本格式
+func (g *GaugeVec) WriteText(w io.Writer) error {
+	err := writeHeader(w, g.name, g.help, "gauge")
+	if err != nil {
+		return err
+	}
+	for _, s := range g.snapshot() {
+		err = writeSample(w, g.name, g.labelNames, s.labelValues, "", "", s.value)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//直方图
+type HistogramVec struct {
+	vec
+	//分桶上限,升序
+	upperBounds []float64
+}
+
+//buckets为nil时使用DefaultLatencyBuckets
+func NewHistogramVec(name, help string, buckets []float64, labelNames ...string) *HistogramVec {
+	if buckets == nil {
+		buckets = DefaultLatencyBuckets
+	}
+	upperBounds := append([]float64(nil), buckets...)
+	sort.Float64s(upperBounds)
+	return &HistogramVec{
+		vec:         newVec(name, help, labelNames),
+		upperBounds: upperBounds,
+	}
+}
+
+//记录一个值
+func (h *HistogramVec) Observe(value float64, labelValues ...string) {
+	i := sort.SearchFloat64s(h.upperBounds, value)
+	h.Lock()
+	s := h.get(labelValues, len(h.upperBounds))
+	if i < len(h.upperBounds) {
+		s.buckets[i]++
+	}
+	s.value += value
+	s.count++
+	h.Unlock()
+}
+
+//记录一个时长(秒)
+func (h *HistogramVec) ObserveDuration(d time.Duration, labelValues ...string) {
+	h.Observe(d.Seconds(), labelValues...)
+}
+
+//获取总次数与总和
+func (h *HistogramVec) Value(labelValues ...string) (count uint64, sum float64) {
+	h.Lock()
+	defer h.Unlock()
+	s := h.get(labelValues, len(h.upperBounds))
+	return s.count, s.value
+}
+
+//输出文本格式
+func (h *HistogramVec) WriteText(w io.Writer) error {
+	err := writeHeader(w, h.name, h.help, "histogram")
+	if err != nil {
+		return err
+	}
+	for _, s := range h.snapshot() {
+		var cumulative uint64
+		for i, upperBound := range h.upperBounds {
+			cumulative += s.buckets[i]
+			err = writeSample(w, h.name+"_bucket", h.labelNames, s.labelValues, "le", formatFloat(upperBound), float64(cumulative))
+			if err != nil {
+				return err
+			}
+		}
+		err = writeSample(w, h.name+"_bucket", h.labelNames, s.labelValues, "le", "+Inf", float64(s.count))
+		if err != nil {
+			return err
+		}
+		err = writeSample(w, h.name+"_sum", h.labelNames, s.labelValues, "", "", s.value)
+		if err != nil {
+			return err
+		}
+		err = writeSample(w, h.name+"_count", h.labelNames, s.labelValues, "", "", float64(s.count))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
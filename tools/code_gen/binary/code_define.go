@@ -1,10 +1,20 @@
 package binary
 
 import (
+	"fmt"
 	"strings"
 	"text/template"
 )
 
+const (
+	//服务端推送 -- 客户端发送一个输入消息,服务端返回多个输出消息
+	StreamServer = "server"
+	//客户端发送 -- 客户端发送多个输入消息,服务端返回一个输出消息
+	StreamClient = "client"
+	//双向 -- 双方都可以发送多个消息
+	StreamBidi = "bidi"
+)
+
 //消息属性定义
 type Field struct {
 	//属性名
@@ -27,6 +37,8 @@ type Object struct {
 	Comment string `yaml:"comment" json:"comment"`
 	//结构体中的属性列表
 	Fields []Field `yaml:"fields" json:"fields"`
+	//单向消息 -- 只能作为单向函数的输入,客户端发送后不等待返回,服务端处理后不回复
+	OneWay bool `yaml:"oneWay" json:"oneWay"`
 }
 
 //包定义
@@ -41,6 +53,26 @@ type Package struct {
 	Objects []Object `yaml:"objects" json:"objects"`
 }
 
+//检查包定义
+func (pkg *Package) Validate() error {
+	for _, obj := range pkg.Objects {
+		if obj.OneWay && obj.Cmd == 0 {
+			return fmt.Errorf("object %s: one-way object must have cmd", obj.Name)
+		}
+	}
+	return nil
+}
+
+//按名称查找消息
+func (pkg *Package) Object(name string) (*Object, bool) {
+	for i := range pkg.Objects {
+		if pkg.Objects[i].Name == name {
+			return &pkg.Objects[i], true
+		}
+	}
+	return nil, false
+}
+
 //API函数定义
 type APIFunction struct {
 	//函数名
@@ -49,6 +81,10 @@ type APIFunction struct {
 	Input string `yaml:"input" json:"input"`
 	//输出参数
 	Output string `yaml:"output" json:"output"`
+	//流类型 -- server、client或bidi,为空时是普通的请求; 流以输入消息的cmd打开
+	Stream string `yaml:"stream" json:"stream"`
+	//单向消息 -- 只发送输入消息,不等待返回,没有输出参数
+	OneWay bool `yaml:"oneWay" json:"oneWay"`
 	//注释
 	Comment string `yaml:"comment" json:"comment"`
 }
@@ -57,6 +93,55 @@ type APIFunction struct {
 type API struct {
 	Package   string        `yaml:"package" json:"package"`
 	Functions []APIFunction `yaml:"functions" json:"functions"`
+	//消息定义 -- 不为nil时检查函数的输入输出消息与消息定义是否一致
+	Msgs *Package `yaml:"-" json:"-"`
+}
+
+//检查API定义
+func (api *API) Validate() error {
+	for _, function := range api.Functions {
+		switch function.Stream {
+		case "", StreamServer, StreamClient, StreamBidi:
+		default:
+			return fmt.Errorf("function %s: unknown stream type %q", function.Name, function.Stream)
+		}
+		if function.OneWay && function.Stream != "" {
+			return fmt.Errorf("function %s: one-way function can not be stream", function.Name)
+		}
+		if function.OneWay != (function.Output == "") {
+			return fmt.Errorf("function %s: only one-way function has no output", function.Name)
+		}
+		if api.Msgs != nil {
+			err := api.checkMsgs(function)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+//检查函数的输入输出消息 -- 消息要有cmd,单向函数与单向消息一一对应
+func (api *API) checkMsgs(function APIFunction) error {
+	input, ok := api.Msgs.Object(function.Input)
+	if !ok || input.Cmd == 0 {
+		return fmt.Errorf("function %s: input %s is not a msg with cmd", function.Name, function.Input)
+	}
+	if function.OneWay != input.OneWay {
+		return fmt.Errorf("function %s: oneWay %v does not match msg %s oneWay %v",
+			function.Name, function.OneWay, input.Name, input.OneWay)
+	}
+	if function.OneWay {
+		return nil
+	}
+	output, ok := api.Msgs.Object(function.Output)
+	if !ok || output.Cmd == 0 {
+		return fmt.Errorf("function %s: output %s is not a msg with cmd", function.Name, function.Output)
+	}
+	if output.OneWay {
+		return fmt.Errorf("function %s: output %s is a one-way msg", function.Name, output.Name)
+	}
+	return nil
 }
 
 //命令行参数
@@ -34,6 +34,14 @@ func GenCode(c *cli.Context, logger *zap.Logger, val interface{}) error {
 	if err != nil {
 		return err
 	}
+	//定义有检查函数时先检查
+	validator, ok := val.(interface{ Validate() error })
+	if ok {
+		err = validator.Validate()
+		if err != nil {
+			return err
+		}
+	}
 
 	_, err = os.Stat(outFileName)
 	if !os.IsNotExist(err) {
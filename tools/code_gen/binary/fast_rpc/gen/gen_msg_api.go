@@ -1,7 +1,9 @@
 package main
 
 import (
+	"github.com/go-yaml/yaml"
 	"github.com/pineal-niwan/busybox/tools/code_gen/binary"
+	"github.com/pineal-niwan/busybox/util"
 	"github.com/urfave/cli"
 	"go.uber.org/zap"
 	"log"
@@ -36,6 +38,10 @@ func main() {
 				Name:  "out",
 				Usage: "输出文件",
 			},
+			&cli.StringFlag{
+				Name:  "msg",
+				Usage: "消息定义文件,给出时检查函数的输入输出消息与消息定义是否一致",
+			},
 		},
 		Action: runWithLogger,
 	}
@@ -50,6 +56,15 @@ func main() {
 
 func generateMsgAPICode(c *cli.Context, logger *zap.Logger) error {
 	var apiDef binary.API
+	msgFileName := c.String("msg")
+	if msgFileName != "" {
+		var msgDef binary.Package
+		err := util.UnMarshalFile2Object(yaml.Unmarshal, msgFileName, &msgDef)
+		if err != nil {
+			return err
+		}
+		apiDef.Msgs = &msgDef
+	}
 	err := binary.GenCode(c, logger, &apiDef)
 	return err
 }
@@ -1,13 +1,18 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"errors"
+	"github.com/pineal-niwan/busybox/metrics"
 	"github.com/pineal-niwan/busybox/util"
 	"github.com/urfave/cli"
 	"go.uber.org/zap"
-	"net"
+	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
+	"syscall"
 )
 
 var (
@@ -15,22 +20,53 @@ var (
 )
 
 //server_run
-func serverRun(c *cli.Context, logger *zap.Logger) error {
+func serverRun(c *cli.Context, logger *zap.Logger, logLevel zap.AtomicLevel) error {
 	//参数检查
 	address := c.String("address")
 	pprofAddress := c.String("pprofAddress")
+	shutdownTimeout := c.Duration("shutdownTimeout")
+	tlsCert := c.String("tlsCert")
+	tlsKey := c.String("tlsKey")
+	tlsClientCA := c.String("tlsClientCA")
+	socketMode, err := strconv.ParseUint(c.String("socketMode"), 8, 32)
+	if err != nil {
+		return err
+	}
 
 	if address == "" || pprofAddress == "" {
 		return ErrNoAddress
 	}
+	err = logLevel.UnmarshalText([]byte(c.String("logLevel")))
+	if err != nil {
+		return err
+	}
 
-	ln, err := net.Listen("tcp", address)
+	//地址可以是unix:///path/to.sock -- 启动前删除遗留的socket文件,监听关闭时删除socket文件
+	ln, err := util.Listen(address, &util.ListenOption{
+		SocketFileMode:    os.FileMode(socketMode),
+		RemoveStaleSocket: true,
+	})
 	if err != nil {
 		return err
 	}
+	//设置了证书时接收TLS连接,设置了客户端CA时要求客户端证书
+	if tlsCert != "" {
+		tlsOption := &util.TLSOption{
+			CertFile:          tlsCert,
+			KeyFile:           tlsKey,
+			CAFile:            tlsClientCA,
+			RequireClientCert: tlsClientCA != "",
+		}
+		tlsConfig, err := tlsOption.ServerConfig()
+		if err != nil {
+			ln.Close()
+			return err
+		}
+		ln = tls.NewListener(ln, tlsConfig)
+	}
 
-	//rpc notify chan
-	rpcNotify := make(chan struct{})
+	//rpc notify chan -- 优雅关闭后监听协程退出时不阻塞
+	rpcNotify := make(chan struct{}, 1)
 	//启动rpc服务
 	service, err := initServiceHandler(ln, logger)
 	if err != nil {
@@ -40,13 +76,18 @@ func serverRun(c *cli.Context, logger *zap.Logger) error {
 	}
 	go service.LoopHandle(rpcNotify)
 
-	//pprof notify chan
+	//pprof notify chan -- 同一端口上输出指标,查询与修改日志级别
 	pprofNotify := make(chan error)
-	go util.PprofServerStart(pprofAddress, pprofNotify)
+	go util.PprofServerStartWithHandlers(pprofAddress,
+		map[string]http.Handler{
+			"/metrics":   metrics.DefaultRegistry,
+			"/log/level": logLevel,
+		},
+		pprofNotify)
 
 	//等待信号
 	kill := make(chan os.Signal, 1)
-	signal.Notify(kill, os.Interrupt, os.Kill)
+	signal.Notify(kill, os.Interrupt, syscall.SIGTERM)
 
 	select {
 	case <-rpcNotify:
@@ -57,5 +98,13 @@ func serverRun(c *cli.Context, logger *zap.Logger) error {
 		logger.Error("server killed by signal")
 	}
 
+	//优雅关闭 -- 等待正在处理的消息完成
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	err = service.Shutdown(ctx)
+	if err != nil {
+		logger.Error("rpc service shutdown", zap.Error(err))
+	}
+
 	return nil
 }
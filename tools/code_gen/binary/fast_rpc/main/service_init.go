@@ -2,8 +2,10 @@ package main
 
 import (
 	"github.com/pineal-niwan/busybox/fast_rpc"
+	"github.com/pineal-niwan/busybox/metrics"
 	"go.uber.org/zap"
 	"net"
+	"time"
 )
 
 func initServiceHandler(ln net.Listener, logger *zap.Logger) (*fast_rpc.Service, error) {
@@ -13,6 +15,11 @@ func initServiceHandler(ln net.Listener, logger *zap.Logger) (*fast_rpc.Service,
 	service := &fast_rpc.Service{}
 	option := &fast_rpc.Option{
 		//Add you init code here
+
+		//TLS握手与认证的超时时间,不发送数据的连接在超时后关闭
+		HandshakeTimeout: 10 * time.Second,
+		//请求指标,在pprof端口的/metrics输出
+		Metrics: fast_rpc.NewServiceMetrics(metrics.DefaultRegistry),
 	}
 
 	err := option.Validate()
@@ -25,7 +32,11 @@ func initServiceHandler(ln net.Listener, logger *zap.Logger) (*fast_rpc.Service,
 
 	service.Init(ln, logger, option, msgParseHandler)
 
+	// uncomment this code to describe your msgs to fast_rpc.Describe
+	//service.AddMsgSchemas(xxx)
+
 	//add your service handler here
+	//处理出错时返回fast_rpc.NewRPCError(code, format, ...),客户端收到*fast_rpc.RPCError,返回消息不需要错误属性
 	//service.AddMsgHandler()
 
 	return service, err
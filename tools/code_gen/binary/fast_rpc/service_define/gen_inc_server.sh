@@ -8,7 +8,7 @@ mkdir -p ../output/message
 ../gen/gen_msg --template="../msg/msg_pack_unpack.tpml" --in="./inc_server_msg.yaml" --out="../output/message/msg_pack_unpack.go"
 ../gen/gen_msg --template="../msg/msg_parse.tpml" --in="./inc_server_msg.yaml" --out="../output/message/msg_parse.go"
 
-../gen/gen_msg_api --template="../msg/msg_api.tpml" --in="./inc_server_api.yaml" --out="../output/message/msg_api.go"
+../gen/gen_msg_api --template="../msg/msg_api.tpml" --in="./inc_server_api.yaml" --msg="./inc_server_msg.yaml" --out="../output/message/msg_api.go"
 
 go fmt ../output/message/obj_define.go
 go fmt ../output/message/msg_define.go
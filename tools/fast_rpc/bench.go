@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/pineal-niwan/busybox/fast_rpc"
+	"github.com/urfave/cli"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//压测的参数
+var benchFlags = []cli.Flag{
+	&cli.IntFlag{
+		Name:  "concurrency",
+		Usage: "并发调用数,Cli的连接数与此相同",
+		Value: 10,
+	},
+	&cli.DurationFlag{
+		Name:  "duration",
+		Usage: "压测时间",
+		Value: 10 * time.Second,
+	},
+	&cli.StringFlag{
+		Name:  "percentiles",
+		Usage: "统计的延时百分位,逗号分隔",
+		Value: "50,90,99,99.9",
+	},
+}
+
+//一个并发调用的统计
+type benchResult struct {
+	//成功调用的延时
+	latencies []time.Duration
+	//按错误码的失败次数
+	errors map[fast_rpc.ErrCode]int
+}
+
+//并发调用一段时间,统计成功调用的延时百分位与按错误码的失败次数
+func bench(c *cli.Context) error {
+	concurrency := c.Int("concurrency")
+	duration := c.Duration("duration")
+	if concurrency <= 0 || duration <= 0 {
+		return fmt.Errorf("concurrency and duration must be positive")
+	}
+	percentiles, err := parsePercentiles(c.String("percentiles"))
+	if err != nil {
+		return err
+	}
+	req, err := loadRequest(c)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), c.Duration("timeout"))
+	client, err := newClient(ctx, c, concurrency, req.codec.ParseHash())
+	cancel()
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	var wg sync.WaitGroup
+	results := make([]benchResult, concurrency)
+	start := time.Now()
+	end := start.Add(duration)
+	for i := range results {
+		wg.Add(1)
+		go func(result *benchResult) {
+			defer wg.Done()
+			result.errors = make(map[fast_rpc.ErrCode]int)
+			for time.Now().Before(end) {
+				ctx, cancel := context.WithTimeout(context.Background(), c.Duration("timeout"))
+				callStart := time.Now()
+				_, err := req.invoke(ctx, client, 0)
+				latency := time.Since(callStart)
+				cancel()
+				if err != nil {
+					result.errors[fast_rpc.CodeOf(err)]++
+				} else {
+					result.latencies = append(result.latencies, latency)
+				}
+			}
+		}(&results[i])
+	}
+	wg.Wait()
+	printBench(results, time.Since(start), percentiles)
+	return nil
+}
+
+//解析延时百分位
+func parsePercentiles(s string) ([]float64, error) {
+	var percentiles []float64
+	for _, item := range strings.Split(s, ",") {
+		p, err := strconv.ParseFloat(strings.TrimSpace(item), 64)
+		if err != nil || p <= 0 || p > 100 {
+			return nil, fmt.Errorf("bad percentile %q", item)
+		}
+		percentiles = append(percentiles, p)
+	}
+	return percentiles, nil
+}
+
+//延时百分位 -- latencies已排序,取最近的排名
+func percentile(latencies []time.Duration, p float64) time.Duration {
+	rank := int(math.Ceil(p / 100 * float64(len(latencies))))
+	if rank < 1 {
+		rank = 1
+	}
+	return latencies[rank-1]
+}
+
+//合并并打印统计
+func printBench(results []benchResult, elapsed time.Duration, percentiles []float64) {
+	var latencies []time.Duration
+	errors := make(map[fast_rpc.ErrCode]int)
+	var failed int
+	for _, result := range results {
+		latencies = append(latencies, result.latencies...)
+		for code, n := range result.errors {
+			errors[code] += n
+			failed += n
+		}
+	}
+	sort.Slice(latencies, func(i, j int) bool {
+		return latencies[i] < latencies[j]
+	})
+
+	total := len(latencies) + failed
+	fmt.Printf("requests:%d success:%d failed:%d elapsed:%v qps:%.1f\n",
+		total, len(latencies), failed, elapsed.Round(time.Millisecond), float64(total)/elapsed.Seconds())
+	if len(latencies) > 0 {
+		var sum time.Duration
+		for _, latency := range latencies {
+			sum += latency
+		}
+		fmt.Printf("latency min:%v mean:%v max:%v\n",
+			latencies[0], sum/time.Duration(len(latencies)), latencies[len(latencies)-1])
+		for _, p := range percentiles {
+			fmt.Printf("  p%-6s %v\n", strconv.FormatFloat(p, 'f', -1, 64), percentile(latencies, p))
+		}
+	}
+	codes := make([]fast_rpc.ErrCode, 0, len(errors))
+	for code := range errors {
+		codes = append(codes, code)
+	}
+	sort.Slice(codes, func(i, j int) bool {
+		return codes[i] < codes[j]
+	})
+	for _, code := range codes {
+		fmt.Printf("error %s: %d\n", code.String(), errors[code])
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/go-yaml/yaml"
+	"github.com/pineal-niwan/busybox/fast_rpc"
+	codegen "github.com/pineal-niwan/busybox/tools/code_gen/binary"
+	"github.com/pineal-niwan/busybox/tools/fast_rpc/dynamic"
+	"github.com/pineal-niwan/busybox/util"
+	"github.com/urfave/cli"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+//调用的参数
+var callFlags = []cli.Flag{
+	&cli.IntFlag{
+		Name:  "retry",
+		Usage: "失败时的重试次数",
+	},
+}
+
+//请求 -- 由消息定义、API定义与请求的值得到
+type request struct {
+	codec *dynamic.Codec
+	//调用的函数 -- 用--input指定请求消息时为nil
+	function *codegen.APIFunction
+	msg      *dynamic.Msg
+}
+
+//读取定义并解析请求的值
+func loadRequest(c *cli.Context) (*request, error) {
+	msgFile := c.String("msg")
+	if msgFile == "" {
+		return nil, fmt.Errorf("msg define file is required")
+	}
+	codec, err := dynamic.LoadCodec(msgFile)
+	if err != nil {
+		return nil, err
+	}
+	req := &request{codec: codec}
+
+	input := c.String("input")
+	if c.String("func") != "" {
+		req.function, err = loadFunction(c.String("api"), c.String("func"), codec.Package())
+		if err != nil {
+			return nil, err
+		}
+		input = req.function.Input
+	}
+	if input == "" {
+		return nil, fmt.Errorf("func or input is required")
+	}
+
+	data, err := readData(c)
+	if err != nil {
+		return nil, err
+	}
+	value, err := dynamic.ParseValue(data)
+	if err != nil {
+		return nil, err
+	}
+	req.msg, err = codec.NewMsg(input, value)
+	if err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+//读取API定义中的函数,并检查与消息定义是否一致 -- 不支持流
+func loadFunction(apiFile string, name string, msgs *codegen.Package) (*codegen.APIFunction, error) {
+	if apiFile == "" {
+		return nil, fmt.Errorf("api define file is required for func")
+	}
+	var api codegen.API
+	err := util.UnMarshalFile2Object(yaml.Unmarshal, apiFile, &api)
+	if err != nil {
+		return nil, err
+	}
+	api.Msgs = msgs
+	err = api.Validate()
+	if err != nil {
+		return nil, err
+	}
+	for i := range api.Functions {
+		function := &api.Functions[i]
+		if function.Name != name {
+			continue
+		}
+		if function.Stream != "" {
+			return nil, fmt.Errorf("function %s: stream is not supported", name)
+		}
+		return function, nil
+	}
+	return nil, fmt.Errorf("function %s not found in %s", name, apiFile)
+}
+
+//请求的值 -- 没有给出时所有属性都是零值
+func readData(c *cli.Context) ([]byte, error) {
+	if c.String("data") != "" {
+		return []byte(c.String("data")), nil
+	}
+	switch dataFile := c.String("dataFile"); dataFile {
+	case "":
+		return nil, nil
+	case "-":
+		return ioutil.ReadAll(os.Stdin)
+	default:
+		return util.ReadFile2Buffer(dataFile)
+	}
+}
+
+//是否是单向消息
+func (req *request) oneWay() bool {
+	return req.msg.OneWay() || (req.function != nil && req.function.OneWay)
+}
+
+//调用一次 -- 单向消息只发送
+func (req *request) invoke(ctx context.Context, client rpcClient, retryTimes int) (*dynamic.Msg, error) {
+	if req.oneWay() {
+		return nil, client.Notify(ctx, req.msg)
+	}
+	outMsg, err := client.CallWithRetry(ctx, req.msg, retryTimes)
+	if err != nil {
+		return nil, err
+	}
+	//检查是否是期望的消息
+	out, ok := outMsg.(*dynamic.Msg)
+	if !ok || (req.function != nil && out.Name() != req.function.Output) {
+		return nil, fast_rpc.ErrNotExpectMsg
+	}
+	return out, nil
+}
+
+//调用并打印返回的消息 -- 消息的值以json输出到标准输出,消息名与延时输出到标准错误
+func call(c *cli.Context) error {
+	req, err := loadRequest(c)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), c.Duration("timeout"))
+	defer cancel()
+	client, err := newClient(ctx, c, 1, req.codec.ParseHash())
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	start := time.Now()
+	out, err := req.invoke(ctx, client, c.Int("retry"))
+	if err != nil {
+		return err
+	}
+	latency := time.Since(start)
+	if out == nil {
+		fmt.Fprintf(os.Stderr, "notify %s sent, latency:%v\n", req.msg.Name(), latency)
+		return nil
+	}
+	fmt.Fprintf(os.Stderr, "%s cmd:%d ver:%d latency:%v\n", out.Name(), out.GetCmd(), out.GetVersion(), latency)
+	data, err := json.MarshalIndent(out.Value, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(data))
+	return nil
+}
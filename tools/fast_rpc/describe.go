@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/pineal-niwan/busybox/fast_rpc"
+	"github.com/urfave/cli"
+)
+
+//服务描述的参数
+var describeFlags = []cli.Flag{
+	&cli.BoolFlag{
+		Name:  "json",
+		Usage: "以json格式输出",
+	},
+}
+
+//查询并打印服务描述
+func describe(c *cli.Context) error {
+	ctx, cancel := context.WithTimeout(context.Background(), c.Duration("timeout"))
+	defer cancel()
+	client, err := newClient(ctx, c, 1, nil)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	desc, err := fast_rpc.Describe(ctx, client)
+	if err != nil {
+		return err
+	}
+
+	if c.Bool("json") {
+		data, err := json.MarshalIndent(desc.Msgs, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(data))
+		return nil
+	}
+	printDescribe(c.String("address"), desc)
+	return nil
+}
+
+//按cmd逐个打印消息,有描述时打印属性
+func printDescribe(address string, desc *fast_rpc.DescribeMsg) {
+	fmt.Printf("service %s, %d msgs\n", address, len(desc.Msgs))
+	for _, msg := range desc.Msgs {
+		name := msg.Name
+		if name == "" {
+			name = "-"
+		}
+		fmt.Printf("\ncmd:%-5d ver:%-3d %-8s %s", msg.Cmd, msg.Version, msg.Kind, name)
+		if msg.Comment != "" {
+			fmt.Printf("  //%s", msg.Comment)
+		}
+		fmt.Println()
+		for _, field := range msg.Fields {
+			fmt.Printf("    %-16s %-16s", field.Name, field.Type)
+			if field.Comment != "" {
+				fmt.Printf("  //%s", field.Comment)
+			}
+			fmt.Println()
+		}
+	}
+}
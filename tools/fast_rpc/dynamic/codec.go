@@ -0,0 +1,404 @@
+package dynamic
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/go-yaml/yaml"
+	"github.com/pineal-niwan/busybox/binary"
+	codegen "github.com/pineal-niwan/busybox/tools/code_gen/binary"
+	"github.com/pineal-niwan/busybox/util"
+	"math"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	//数组类型的后缀
+	arraySuffix = "Array"
+)
+
+//按消息定义(与代码生成使用的msg yaml相同)动态序列化与反序列化
+//序列化结果与生成的代码一致,值使用json或yaml解析后的map、数组与基本类型
+type Codec struct {
+	//包定义
+	pkg *codegen.Package
+	//按名称的结构体定义
+	objects map[string]*codegen.Object
+}
+
+//按包定义新建 -- 检查包定义与所有属性的类型
+func NewCodec(pkg *codegen.Package) (*Codec, error) {
+	err := pkg.Validate()
+	if err != nil {
+		return nil, err
+	}
+	c := &Codec{
+		pkg:     pkg,
+		objects: make(map[string]*codegen.Object),
+	}
+	for i := range pkg.Objects {
+		obj := &pkg.Objects[i]
+		if _, ok := c.objects[obj.Name]; ok {
+			return nil, fmt.Errorf("duplicate object %s", obj.Name)
+		}
+		c.objects[obj.Name] = obj
+	}
+	for _, obj := range pkg.Objects {
+		for _, field := range obj.Fields {
+			if !c.validType(field.TypeDefine) {
+				return nil, fmt.Errorf("object %s field %s: unknown type %q", obj.Name, field.Name, field.TypeDefine)
+			}
+		}
+	}
+	return c, nil
+}
+
+//读取msg yaml文件
+func LoadCodec(fileName string) (*Codec, error) {
+	var pkg codegen.Package
+	err := util.UnMarshalFile2Object(yaml.Unmarshal, fileName, &pkg)
+	if err != nil {
+		return nil, err
+	}
+	return NewCodec(&pkg)
+}
+
+//包定义
+func (c *Codec) Package() *codegen.Package {
+	return c.pkg
+}
+
+//按名称获取结构体定义
+func (c *Codec) Object(name string) (*codegen.Object, bool) {
+	obj, ok := c.objects[name]
+	return obj, ok
+}
+
+//类型是否有效 -- 基本类型、结构体以及它们的数组
+func (c *Codec) validType(typeDefine string) bool {
+	if isScalar(typeDefine) {
+		return true
+	}
+	if _, ok := c.objects[typeDefine]; ok {
+		return true
+	}
+	elem, ok := elemType(typeDefine)
+	return ok && c.validType(elem) && !strings.HasSuffix(elem, arraySuffix)
+}
+
+//数组的元素类型
+func elemType(typeDefine string) (string, bool) {
+	if !strings.HasSuffix(typeDefine, arraySuffix) || typeDefine == arraySuffix {
+		return "", false
+	}
+	return strings.TrimSuffix(typeDefine, arraySuffix), true
+}
+
+//序列化值
+func (c *Codec) Encode(writer *binary.BinaryHandler, typeDefine string, value interface{}) error {
+	if isScalar(typeDefine) {
+		return encodeScalar(writer, typeDefine, value)
+	}
+	obj, ok := c.objects[typeDefine]
+	if ok {
+		return c.encodeObject(writer, obj, value)
+	}
+	elem, ok := elemType(typeDefine)
+	if !ok {
+		return fmt.Errorf("unknown type %q", typeDefine)
+	}
+	if elem == "byte" || elem == "uint8" {
+		data, err := toBytes(value)
+		if err != nil {
+			return err
+		}
+		return writer.WriteByteArray(data)
+	}
+	var list []interface{}
+	if value != nil {
+		list, ok = value.([]interface{})
+		if !ok {
+			return fmt.Errorf("%s: expect array, got %T", typeDefine, value)
+		}
+	}
+	err := writer.WriteArrayLen(len(list))
+	if err != nil {
+		return err
+	}
+	for i, v := range list {
+		err = c.Encode(writer, elem, v)
+		if err != nil {
+			return fmt.Errorf("[%d]: %w", i, err)
+		}
+	}
+	return nil
+}
+
+//序列化结构体 -- 按定义的顺序写入属性,没有给出的属性写入零值
+func (c *Codec) encodeObject(writer *binary.BinaryHandler, obj *codegen.Object, value interface{}) error {
+	values, err := toMap(value)
+	if err != nil {
+		return fmt.Errorf("%s: %w", obj.Name, err)
+	}
+	for name := range values {
+		if !hasField(obj, name) {
+			return fmt.Errorf("%s: unknown field %s", obj.Name, name)
+		}
+	}
+	for _, field := range obj.Fields {
+		err = c.Encode(writer, field.TypeDefine, values[field.Name])
+		if err != nil {
+			return fmt.Errorf("%s.%s: %w", obj.Name, field.Name, err)
+		}
+	}
+	return nil
+}
+
+//反序列化值 -- 结构体得到Record,字节数组是有效的UTF-8时得到字符串
+func (c *Codec) Decode(reader *binary.BinaryHandler, typeDefine string) (interface{}, error) {
+	if isScalar(typeDefine) {
+		return decodeScalar(reader, typeDefine)
+	}
+	obj, ok := c.objects[typeDefine]
+	if ok {
+		record := make(Record, 0, len(obj.Fields))
+		for _, field := range obj.Fields {
+			v, err := c.Decode(reader, field.TypeDefine)
+			if err != nil {
+				return nil, fmt.Errorf("%s.%s: %w", obj.Name, field.Name, err)
+			}
+			record = append(record, FieldValue{Name: field.Name, Value: v})
+		}
+		return record, nil
+	}
+	elem, ok := elemType(typeDefine)
+	if !ok {
+		return nil, fmt.Errorf("unknown type %q", typeDefine)
+	}
+	if elem == "byte" || elem == "uint8" {
+		data, err := reader.ReadByteArray()
+		if err != nil {
+			return nil, err
+		}
+		if utf8.Valid(data) {
+			return string(data), nil
+		}
+		return data, nil
+	}
+	size, err := reader.ReadArrayLen()
+	if err != nil {
+		return nil, err
+	}
+	list := make([]interface{}, size)
+	for i := range list {
+		list[i], err = c.Decode(reader, elem)
+		if err != nil {
+			return nil, fmt.Errorf("[%d]: %w", i, err)
+		}
+	}
+	return list, nil
+}
+
+//结构体是否有此属性
+func hasField(obj *codegen.Object, name string) bool {
+	for _, field := range obj.Fields {
+		if field.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+//解码后的结构体 -- 按定义的属性顺序输出json
+type Record []FieldValue
+
+//属性值
+type FieldValue struct {
+	Name  string
+	Value interface{}
+}
+
+//按名称获取属性值
+func (r Record) Get(name string) (interface{}, bool) {
+	for _, field := range r {
+		if field.Name == name {
+			return field.Value, true
+		}
+	}
+	return nil, false
+}
+
+func (r Record) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, field := range r {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		name, err := json.Marshal(field.Name)
+		if err != nil {
+			return nil, err
+		}
+		value, err := json.Marshal(field.Value)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(name)
+		buf.WriteByte(':')
+		buf.Write(value)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+//解析json或yaml格式的值
+func ParseValue(data []byte) (interface{}, error) {
+	var value interface{}
+	err := yaml.Unmarshal(data, &value)
+	if err != nil {
+		return nil, err
+	}
+	return normalize(value), nil
+}
+
+//yaml解析出的map的键转为字符串
+func normalize(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			m[fmt.Sprint(key)] = normalize(item)
+		}
+		return m
+	case map[string]interface{}:
+		for key, item := range v {
+			v[key] = normalize(item)
+		}
+		return v
+	case []interface{}:
+		for i, item := range v {
+			v[i] = normalize(item)
+		}
+		return v
+	default:
+		return v
+	}
+}
+
+//结构体的值 -- nil表示所有属性都是零值
+func toMap(value interface{}) (map[string]interface{}, error) {
+	switch v := value.(type) {
+	case nil:
+		return nil, nil
+	case map[string]interface{}:
+		return v, nil
+	case map[interface{}]interface{}:
+		return normalize(v).(map[string]interface{}), nil
+	default:
+		return nil, fmt.Errorf("expect object, got %T", value)
+	}
+}
+
+//字节数组的值 -- 字符串按原样,或者是数字数组
+func toBytes(value interface{}) ([]byte, error) {
+	switch v := value.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return []byte(v), nil
+	case []byte:
+		return v, nil
+	case []interface{}:
+		data := make([]byte, len(v))
+		for i, item := range v {
+			n, err := toUint(item, 8)
+			if err != nil {
+				return nil, fmt.Errorf("[%d]: %w", i, err)
+			}
+			data[i] = byte(n)
+		}
+		return data, nil
+	default:
+		return nil, fmt.Errorf("expect string or byte array, got %T", value)
+	}
+}
+
+//有符号整数 -- 检查范围
+func toInt(value interface{}, bits uint) (int64, error) {
+	var n int64
+	switch v := value.(type) {
+	case nil:
+		return 0, nil
+	case int:
+		n = int64(v)
+	case int64:
+		n = v
+	case uint64:
+		if v > math.MaxInt64 {
+			return 0, fmt.Errorf("%v overflows int%d", v, bits)
+		}
+		n = int64(v)
+	case float64:
+		if v != math.Trunc(v) || v < math.MinInt64 || v > math.MaxInt64 {
+			return 0, fmt.Errorf("%v is not int%d", v, bits)
+		}
+		n = int64(v)
+	default:
+		return 0, fmt.Errorf("expect integer, got %T", value)
+	}
+	if bits < 64 && (n < -(1<<(bits-1)) || n >= 1<<(bits-1)) {
+		return 0, fmt.Errorf("%v overflows int%d", n, bits)
+	}
+	return n, nil
+}
+
+//无符号整数 -- 检查范围
+func toUint(value interface{}, bits uint) (uint64, error) {
+	var n uint64
+	switch v := value.(type) {
+	case nil:
+		return 0, nil
+	case int:
+		if v < 0 {
+			return 0, fmt.Errorf("%v overflows uint%d", v, bits)
+		}
+		n = uint64(v)
+	case int64:
+		if v < 0 {
+			return 0, fmt.Errorf("%v overflows uint%d", v, bits)
+		}
+		n = uint64(v)
+	case uint64:
+		n = v
+	case float64:
+		if v != math.Trunc(v) || v < 0 || v > math.MaxUint64 {
+			return 0, fmt.Errorf("%v is not uint%d", v, bits)
+		}
+		n = uint64(v)
+	default:
+		return 0, fmt.Errorf("expect integer, got %T", value)
+	}
+	if bits < 64 && n >= 1<<bits {
+		return 0, fmt.Errorf("%v overflows uint%d", n, bits)
+	}
+	return n, nil
+}
+
+//浮点数
+func toFloat(value interface{}) (float64, error) {
+	switch v := value.(type) {
+	case nil:
+		return 0, nil
+	case int:
+		return float64(v), nil
+	case int64:
+		return float64(v), nil
+	case uint64:
+		return float64(v), nil
+	case float64:
+		return v, nil
+	default:
+		return 0, fmt.Errorf("expect number, got %T", value)
+	}
+}
@@ -0,0 +1,148 @@
+package dynamic
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/pineal-niwan/busybox/binary"
+	"github.com/pineal-niwan/busybox/fast_rpc"
+	"github.com/pineal-niwan/busybox/fast_rpc/fast_rpctest"
+	"github.com/pineal-niwan/busybox/tools/code_gen/binary/serialization/gen/sample"
+	"testing"
+)
+
+const (
+	sampleDefine = "../../code_gen/binary/serialization/gen/sample/sample.yaml"
+	incDefine    = "../../code_gen/binary/fast_rpc/service_define/inc_server_msg.yaml"
+)
+
+var testOption = &binary.Option{
+	DataMaxLen:      1024 * 1024,
+	StringMaxLen:    256,
+	ArrayMaxLen:     256,
+	ExtendExtraSize: 256,
+}
+
+func TestCodecMatchGenerated(t *testing.T) {
+	codec, err := LoadCodec(sampleDefine)
+	if err != nil {
+		t.Fatalf("load codec error:%+v", err)
+	}
+
+	//生成的代码序列化
+	writer, err := sample.NewWriteSampleHandlerWithOption(make([]byte, 256), testOption)
+	if err != nil {
+		t.Fatalf("new writer error:%+v", err)
+	}
+	err = writer.WriteSample2(sample.Sample2{
+		Id: -3,
+		Sample1List: []sample.Sample1{
+			{Field1: []byte("ab"), Field2: "x", Field3: 1.5},
+			{Field2: "y"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("write sample error:%+v", err)
+	}
+
+	//按定义动态序列化的结果相同
+	value, err := ParseValue([]byte(`{"Id": -3, "Sample1List": [{"Field1": "ab", "Field2": "x", "Field3": 1.5}, {"Field2": "y"}]}`))
+	if err != nil {
+		t.Fatalf("parse value error:%+v", err)
+	}
+	dynWriter, err := binary.NewWriteBinaryHandler(make([]byte, 256), testOption)
+	if err != nil {
+		t.Fatalf("new writer error:%+v", err)
+	}
+	err = codec.Encode(dynWriter, "Sample2", value)
+	if err != nil {
+		t.Fatalf("encode error:%+v", err)
+	}
+	if !bytes.Equal(dynWriter.Data(), writer.Data()) {
+		t.Fatalf("encoded bytes differ, dynamic:%v generated:%v", dynWriter.Data(), writer.Data())
+	}
+
+	//反序列化按定义的属性顺序输出
+	reader, err := binary.NewReadBinaryHandler(writer.Data(), testOption)
+	if err != nil {
+		t.Fatalf("new reader error:%+v", err)
+	}
+	out, err := codec.Decode(reader, "Sample2")
+	if err != nil {
+		t.Fatalf("decode error:%+v", err)
+	}
+	data, err := json.Marshal(out)
+	if err != nil {
+		t.Fatalf("marshal json error:%+v", err)
+	}
+	expect := `{"Id":-3,"Sample1List":[{"Field1":"ab","Field2":"x","Field3":1.5},{"Field1":"","Field2":"y","Field3":0}]}`
+	if string(data) != expect {
+		t.Errorf("unexpected decoded value:%s", data)
+	}
+}
+
+func TestCodecBadValue(t *testing.T) {
+	codec, err := LoadCodec(sampleDefine)
+	if err != nil {
+		t.Fatalf("load codec error:%+v", err)
+	}
+	for _, text := range []string{
+		`{"Id": 1, "Name": "unknown field"}`,
+		`{"Id": 4294967296}`,
+		`{"Id": "1"}`,
+		`{"Sample1List": {"Field2": "not array"}}`,
+		`{"Sample1List": [{"Field1": [1, 256]}]}`,
+	} {
+		value, err := ParseValue([]byte(text))
+		if err != nil {
+			t.Fatalf("parse value error:%+v", err)
+		}
+		writer, _ := binary.NewWriteBinaryHandler(make([]byte, 256), testOption)
+		if err = codec.Encode(writer, "Sample2", value); err == nil {
+			t.Errorf("expect encode error for %s", text)
+		}
+	}
+}
+
+func TestMsgCall(t *testing.T) {
+	codec, err := LoadCodec(incDefine)
+	if err != nil {
+		t.Fatalf("load codec error:%+v", err)
+	}
+	if _, err = codec.NewMsg("KeyIdPair", nil); err == nil {
+		t.Errorf("expect error for object without cmd")
+	}
+
+	//服务端同样使用动态消息,返回key的长度
+	_, cli := fast_rpctest.Start(t, codec.ParseHash(), func(service *fast_rpc.Service) {
+		req, _ := codec.NewMsg("ReqKey", nil)
+		service.AddMsgHandler(req, func(inMsg fast_rpc.IMsg) (fast_rpc.IMsg, error) {
+			key, _ := inMsg.(*Msg).Value.(Record).Get("Key")
+			return codec.NewMsg("RspId", map[string]interface{}{"Id": len(key.(string))})
+		})
+	})
+	value, _ := ParseValue([]byte("Key: hello"))
+	req, err := codec.NewMsg("ReqKey", value)
+	if err != nil {
+		t.Fatalf("new msg error:%+v", err)
+	}
+	outMsg, err := cli.CallWithRetry(context.Background(), req, 0)
+	if err != nil {
+		t.Fatalf("call error:%+v", err)
+	}
+	out := outMsg.(*Msg)
+	id, _ := out.Value.(Record).Get("Id")
+	if out.Name() != "RspId" || id != uint32(5) {
+		t.Errorf("unexpected out msg:%s %+v", out.Name(), out.Value)
+	}
+
+	//定义中的单向消息只能通过Notify发送
+	reset, err := codec.NewMsg("ReqResetKey", value)
+	if err != nil {
+		t.Fatalf("new msg error:%+v", err)
+	}
+	_, err = cli.CallWithRetry(context.Background(), reset, 0)
+	if !reset.OneWay() || err != fast_rpc.ErrOneWayCall {
+		t.Errorf("expect one-way call error, got %+v", err)
+	}
+}
@@ -0,0 +1,101 @@
+package dynamic
+
+import (
+	"fmt"
+	"github.com/pineal-niwan/busybox/binary"
+	"github.com/pineal-niwan/busybox/fast_rpc"
+	codegen "github.com/pineal-niwan/busybox/tools/code_gen/binary"
+)
+
+//按定义动态序列化的消息
+type Msg struct {
+	codec *Codec
+	obj   *codegen.Object
+	//消息的值 -- 请求时是解析后的map,返回时是Record
+	Value interface{}
+}
+
+//新建消息 -- 只有定义了cmd的结构体是消息
+func (c *Codec) NewMsg(name string, value interface{}) (*Msg, error) {
+	obj, ok := c.objects[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown msg %s", name)
+	}
+	if obj.Cmd == 0 {
+		return nil, fmt.Errorf("%s is not a msg, no cmd defined", name)
+	}
+	return &Msg{codec: c, obj: obj, Value: value}, nil
+}
+
+//消息解析表 -- 与生成的InitMsgParseHandlerHash相同
+func (c *Codec) ParseHash() map[uint32]fast_rpc.MsgParseHandler {
+	hash := make(map[uint32]fast_rpc.MsgParseHandler)
+	for _, obj := range c.objects {
+		if obj.Cmd == 0 {
+			continue
+		}
+		obj := obj
+		hash[uint32(obj.Cmd)|(uint32(obj.Version)<<16)] = func(data []byte, option *binary.Option) (fast_rpc.IMsg, error) {
+			msg := &Msg{codec: c, obj: obj}
+			err := msg.Unmarshal(data, option)
+			return msg, err
+		}
+	}
+	return hash
+}
+
+//消息名称
+func (msg *Msg) Name() string {
+	return msg.obj.Name
+}
+
+//获取命令行
+func (msg *Msg) GetCmd() uint16 {
+	return msg.obj.Cmd
+}
+
+//获取版本号
+func (msg *Msg) GetVersion() uint16 {
+	return msg.obj.Version
+}
+
+//获取Code
+func (msg *Msg) GetCode() uint32 {
+	return uint32(msg.obj.Cmd) | (uint32(msg.obj.Version) << 16)
+}
+
+//是否是单向消息
+func (msg *Msg) OneWay() bool {
+	return msg.obj.OneWay
+}
+
+//序列化
+func (msg *Msg) Marshal(buf []byte, option *binary.Option) (int, []byte, error) {
+	writer, err := binary.NewWriteBinaryHandler(buf, option)
+	if err != nil {
+		return 0, nil, err
+	}
+	//先跳过消息头
+	err = writer.MovePos(uint32(fast_rpc.MsgHeadSize))
+	if err != nil {
+		return 0, nil, err
+	}
+	//写消息内容
+	err = msg.codec.encodeObject(writer, msg.obj, msg.Value)
+	if err != nil {
+		return 0, nil, err
+	}
+	size := writer.Len()
+	//消息头由框架回填
+	return size, writer.Data(), nil
+}
+
+//反序列化
+func (msg *Msg) Unmarshal(buf []byte, option *binary.Option) error {
+	reader, err := binary.NewReadBinaryHandler(buf, option)
+	if err != nil {
+		return err
+	}
+	msg.Value, err = msg.codec.Decode(reader, msg.obj.Name)
+	return err
+}
@@ -0,0 +1,152 @@
+package dynamic
+
+import (
+	"fmt"
+	"github.com/pineal-niwan/busybox/binary"
+)
+
+//基本类型 -- 与binary.BinaryHandler的读写函数对应
+var scalarTypes = map[string]bool{
+	"bool":    true,
+	"byte":    true,
+	"int8":    true,
+	"uint8":   true,
+	"int16":   true,
+	"uint16":  true,
+	"int32":   true,
+	"uint32":  true,
+	"int64":   true,
+	"uint64":  true,
+	"float32": true,
+	"float64": true,
+	"string":  true,
+}
+
+//是否是基本类型
+func isScalar(typeDefine string) bool {
+	return scalarTypes[typeDefine]
+}
+
+//序列化基本类型 -- nil写入零值
+func encodeScalar(writer *binary.BinaryHandler, typeDefine string, value interface{}) error {
+	switch typeDefine {
+	case "bool":
+		b, ok := value.(bool)
+		if !ok && value != nil {
+			return fmt.Errorf("expect bool, got %T", value)
+		}
+		return writer.WriteBool(b)
+	case "string":
+		s, ok := value.(string)
+		if !ok && value != nil {
+			return fmt.Errorf("expect string, got %T", value)
+		}
+		return writer.WriteString(s)
+	case "float32":
+		f, err := toFloat(value)
+		if err != nil {
+			return err
+		}
+		return writer.WriteFloat32(float32(f))
+	case "float64":
+		f, err := toFloat(value)
+		if err != nil {
+			return err
+		}
+		return writer.WriteFloat64(f)
+	case "int8", "int16", "int32", "int64":
+		return encodeInt(writer, typeDefine, value)
+	default:
+		return encodeUint(writer, typeDefine, value)
+	}
+}
+
+//序列化有符号整数
+func encodeInt(writer *binary.BinaryHandler, typeDefine string, value interface{}) error {
+	switch typeDefine {
+	case "int8":
+		n, err := toInt(value, 8)
+		if err != nil {
+			return err
+		}
+		return writer.WriteInt8(int8(n))
+	case "int16":
+		n, err := toInt(value, 16)
+		if err != nil {
+			return err
+		}
+		return writer.WriteInt16(int16(n))
+	case "int32":
+		n, err := toInt(value, 32)
+		if err != nil {
+			return err
+		}
+		return writer.WriteInt32(int32(n))
+	default:
+		n, err := toInt(value, 64)
+		if err != nil {
+			return err
+		}
+		return writer.WriteInt64(n)
+	}
+}
+
+//序列化无符号整数 -- uint8使用WriteByte,字节相同
+func encodeUint(writer *binary.BinaryHandler, typeDefine string, value interface{}) error {
+	switch typeDefine {
+	case "byte", "uint8":
+		n, err := toUint(value, 8)
+		if err != nil {
+			return err
+		}
+		return writer.WriteByte(byte(n))
+	case "uint16":
+		n, err := toUint(value, 16)
+		if err != nil {
+			return err
+		}
+		return writer.WriteUint16(uint16(n))
+	case "uint32":
+		n, err := toUint(value, 32)
+		if err != nil {
+			return err
+		}
+		return writer.WriteUint32(uint32(n))
+	default:
+		n, err := toUint(value, 64)
+		if err != nil {
+			return err
+		}
+		return writer.WriteUint64(n)
+	}
+}
+
+//反序列化基本类型
+func decodeScalar(reader *binary.BinaryHandler, typeDefine string) (interface{}, error) {
+	switch typeDefine {
+	case "bool":
+		return reader.ReadBool()
+	case "byte", "uint8":
+		return reader.ReadByte()
+	case "int8":
+		return reader.ReadInt8()
+	case "int16":
+		return reader.ReadInt16()
+	case "uint16":
+		return reader.ReadUint16()
+	case "int32":
+		return reader.ReadInt32()
+	case "uint32":
+		return reader.ReadUint32()
+	case "int64":
+		return reader.ReadInt64()
+	case "uint64":
+		return reader.ReadUint64()
+	case "float32":
+		return reader.ReadFloat32()
+	case "float64":
+		return reader.ReadFloat64()
+	default:
+		return reader.ReadString()
+	}
+}
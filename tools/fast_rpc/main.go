@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/pineal-niwan/busybox/binary"
+	"github.com/pineal-niwan/busybox/fast_rpc"
+	"github.com/urfave/cli"
+	"go.uber.org/zap"
+	"log"
+	"os"
+	"time"
+)
+
+//客户端 -- Cli与MuxCli
+type rpcClient interface {
+	fast_rpc.Caller
+	fast_rpc.Notifier
+	Close() error
+}
+
+//连接服务的参数
+var connFlags = []cli.Flag{
+	&cli.StringFlag{
+		Name:  "address",
+		Usage: "服务地址,host:port或unix:///path/to.sock",
+	},
+	&cli.DurationFlag{
+		Name:  "timeout",
+		Usage: "调用超时时间",
+		Value: 5 * time.Second,
+	},
+	&cli.IntFlag{
+		Name:  "maxMsgSize",
+		Usage: "最大的消息体长度",
+		Value: 4 * 1024 * 1024,
+	},
+	&cli.BoolFlag{
+		Name:  "mux",
+		Usage: "使用多路复用客户端,服务需要异步分发",
+	},
+}
+
+//消息定义与请求的参数
+var msgFlags = []cli.Flag{
+	&cli.StringFlag{
+		Name:  "msg",
+		Usage: "消息定义文件,与代码生成使用的msg yaml相同",
+	},
+	&cli.StringFlag{
+		Name:  "api",
+		Usage: "API定义文件,与代码生成使用的api yaml相同,用--func指定函数时需要",
+	},
+	&cli.StringFlag{
+		Name:  "func",
+		Usage: "调用的函数名",
+	},
+	&cli.StringFlag{
+		Name:  "input",
+		Usage: "请求消息名,没有API定义时使用",
+	},
+	&cli.StringFlag{
+		Name:  "data",
+		Usage: "请求消息的值,json或yaml格式",
+	},
+	&cli.StringFlag{
+		Name:  "dataFile",
+		Usage: "从文件读取请求消息的值,-表示标准输入",
+	},
+}
+
+func main() {
+	app := cli.App{
+		Name:    "fast_rpc",
+		Usage:   "按消息定义调用fast_rpc服务",
+		Version: "1.0",
+		Commands: []cli.Command{
+			{
+				Name:   "call",
+				Usage:  "调用一次并打印返回的消息",
+				Flags:  joinFlags(connFlags, msgFlags, callFlags),
+				Action: call,
+			},
+			{
+				Name:   "bench",
+				Usage:  "并发调用一段时间并统计延时",
+				Flags:  joinFlags(connFlags, msgFlags, benchFlags),
+				Action: bench,
+			},
+			{
+				Name:   "describe",
+				Usage:  "打印服务注册的消息",
+				Flags:  joinFlags(connFlags, describeFlags),
+				Action: describe,
+			},
+		},
+	}
+	err := app.Run(os.Args)
+	if err != nil {
+		log.Fatalf("运行失败:%+v", err)
+	}
+}
+
+//合并命令的参数
+func joinFlags(groups ...[]cli.Flag) []cli.Flag {
+	var flags []cli.Flag
+	for _, group := range groups {
+		flags = append(flags, group...)
+	}
+	return flags
+}
+
+//客户端参数
+func newCliOption(c *cli.Context) (*fast_rpc.CliOption, error) {
+	maxMsgSize := c.Int("maxMsgSize")
+	option := &fast_rpc.CliOption{
+		Option: &binary.Option{
+			DataMaxLen:      maxMsgSize,
+			StringMaxLen:    maxMsgSize,
+			ArrayMaxLen:     64 * 1024,
+			ExtendExtraSize: 256,
+		},
+		BufferSize:        1024,
+		MaxMsgSize:        maxMsgSize,
+		BufferRecycleSize: 64 * 1024,
+		RetreatTime:       time.Millisecond,
+		Logger:            zap.NewNop(),
+	}
+	err := option.Validate()
+	if err != nil {
+		return nil, err
+	}
+	return option, nil
+}
+
+//连接服务 -- poolSize是Cli的连接数,MuxCli只有一个连接
+func newClient(ctx context.Context, c *cli.Context, poolSize int, msgParseHash map[uint32]fast_rpc.MsgParseHandler) (rpcClient, error) {
+	address := c.String("address")
+	if address == "" {
+		return nil, fmt.Errorf("address is required")
+	}
+	option, err := newCliOption(c)
+	if err != nil {
+		return nil, err
+	}
+	if c.Bool("mux") {
+		return fast_rpc.NewMuxCli(ctx, address, option, msgParseHash)
+	}
+	return fast_rpc.NewCli(ctx, address, poolSize, option, msgParseHash)
+}
@@ -0,0 +1,192 @@
+package util
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+var (
+	ErrInvalidAddress = errors.New("invalid address")
+	ErrNotSocket      = errors.New("file exists and is not a socket")
+	ErrSocketInUse    = errors.New("socket is in use")
+)
+
+const (
+	//unixpacket连接上每个包的最大字节数 -- 要小于socket的发送缓冲区
+	unixPacketSize = 32 * 1024
+	//检查遗留socket文件时的连接超时
+	staleSocketDialTimeout = time.Second
+)
+
+//支持的网络类型
+var supportedNetworks = map[string]bool{
+	"tcp":        true,
+	"tcp4":       true,
+	"tcp6":       true,
+	"unix":       true,
+	"unixpacket": true,
+}
+
+//是否是支持的网络类型
+func IsSupportedNetwork(network string) bool {
+	return supportedNetworks[network]
+}
+
+//解析地址 -- 返回网络类型与连接地址
+//支持 host:port、tcp://host:port、unix:///run/x.sock、unixpacket:///run/x.sock
+func ParseAddress(address string) (string, string, error) {
+	index := strings.Index(address, "://")
+	if index < 0 {
+		if address == "" {
+			return "", "", ErrInvalidAddress
+		}
+		return "tcp", address, nil
+	}
+	network, addr := address[:index], address[index+len("://"):]
+	if !IsSupportedNetwork(network) || addr == "" {
+		return "", "", ErrInvalidAddress
+	}
+	return network, addr, nil
+}
+
+//建立连接 -- unixpacket连接包装为字节流
+func DialNetwork(ctx context.Context, dialer ContextDialer, network string, address string) (net.Conn, error) {
+	conn, err := dialer.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	return NewStreamConn(network, conn), nil
+}
+
+//监听参数
+type ListenOption struct {
+	//unix socket文件的权限,0表示由umask决定
+	SocketFileMode os.FileMode
+	//监听前删除遗留的unix socket文件 -- 文件不是socket或仍有进程在监听时返回错误
+	RemoveStaleSocket bool
+}
+
+//按地址监听 -- 地址格式同ParseAddress,option可以为nil
+//unix socket的文件在监听者关闭时删除,unixpacket的连接包装为字节流
+func Listen(address string, option *ListenOption) (net.Listener, error) {
+	network, addr, err := ParseAddress(address)
+	if err != nil {
+		return nil, err
+	}
+	if option == nil {
+		option = &ListenOption{}
+	}
+	isUnix := network == "unix" || network == "unixpacket"
+	//以@开头的是抽象地址,没有文件
+	hasFile := isUnix && !strings.HasPrefix(addr, "@")
+	if hasFile && option.RemoveStaleSocket {
+		err = removeStaleSocket(network, addr)
+		if err != nil {
+			return nil, err
+		}
+	}
+	ln, err := net.Listen(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	if hasFile && option.SocketFileMode != 0 {
+		err = os.Chmod(addr, option.SocketFileMode)
+		if err != nil {
+			ln.Close()
+			return nil, err
+		}
+	}
+	if network == "unixpacket" {
+		return &streamListener{Listener: ln}, nil
+	}
+	return ln, nil
+}
+
+//删除遗留的unix socket文件
+func removeStaleSocket(network string, path string) error {
+	info, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return ErrNotSocket
+	}
+	//能连接上表示还有进程在监听
+	conn, err := net.DialTimeout(network, path, staleSocketDialTimeout)
+	if err == nil {
+		conn.Close()
+		return ErrSocketInUse
+	}
+	return os.Remove(path)
+}
+
+//把unixpacket连接包装为字节流,其他连接原样返回
+func NewStreamConn(network string, conn net.Conn) net.Conn {
+	if network != "unixpacket" {
+		return conn
+	}
+	return &packetStreamConn{Conn: conn}
+}
+
+//unixpacket上的字节流 -- 写入按包大小拆分,读取时缓存整个包
+//unixpacket每次读取一个完整的包,读取的长度不够时包的剩余部分被丢弃
+type packetStreamConn struct {
+	net.Conn
+	//读缓冲区
+	buf []byte
+	//还未读取的数据
+	data []byte
+}
+
+func (c *packetStreamConn) Read(b []byte) (int, error) {
+	if len(c.data) == 0 {
+		if c.buf == nil {
+			c.buf = make([]byte, unixPacketSize)
+		}
+		n, err := c.Conn.Read(c.buf)
+		if n == 0 {
+			return 0, err
+		}
+		c.data = c.buf[:n]
+	}
+	n := copy(b, c.data)
+	c.data = c.data[n:]
+	return n, nil
+}
+
+func (c *packetStreamConn) Write(b []byte) (int, error) {
+	var written int
+	for len(b) > 0 {
+		size := len(b)
+		if size > unixPacketSize {
+			size = unixPacketSize
+		}
+		n, err := c.Conn.Write(b[:size])
+		written += n
+		if err != nil {
+			return written, err
+		}
+		b = b[size:]
+	}
+	return written, nil
+}
+
+//unixpacket的监听者 -- 接收的连接包装为字节流
+type streamListener struct {
+	net.Listener
+}
+
+func (l *streamListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &packetStreamConn{Conn: conn}, nil
+}
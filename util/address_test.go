@@ -0,0 +1,80 @@
+package util
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseAddress(t *testing.T) {
+	cases := []struct {
+		address string
+		network string
+		addr    string
+	}{
+		{"127.0.0.1:8080", "tcp", "127.0.0.1:8080"},
+		{"tcp://127.0.0.1:8080", "tcp", "127.0.0.1:8080"},
+		{"unix:///run/keysrv.sock", "unix", "/run/keysrv.sock"},
+		{"unixpacket://keysrv.sock", "unixpacket", "keysrv.sock"},
+	}
+	for _, c := range cases {
+		network, addr, err := ParseAddress(c.address)
+		if err != nil || network != c.network || addr != c.addr {
+			t.Errorf("parse %s, network:%s addr:%s err:%+v", c.address, network, addr, err)
+		}
+	}
+	for _, address := range []string{"", "udp://127.0.0.1:53", "unix://"} {
+		_, _, err := ParseAddress(address)
+		if err != ErrInvalidAddress {
+			t.Errorf("parse %s, expect invalid address, got %+v", address, err)
+		}
+	}
+}
+
+func TestListenUnix(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.sock")
+	address := "unix://" + path
+	option := &ListenOption{SocketFileMode: 0600, RemoveStaleSocket: true}
+
+	ln, err := Listen(address, option)
+	if err != nil {
+		t.Fatalf("listen error:%+v", err)
+	}
+	info, err := os.Stat(path)
+	if err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("expect socket file mode 0600, info:%+v err:%+v", info, err)
+	}
+	//还在监听时不删除socket文件
+	_, err = Listen(address, option)
+	if err != ErrSocketInUse {
+		t.Errorf("expect socket in use, got %+v", err)
+	}
+	ln.Close()
+	if _, err = os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("expect socket file removed on close, got %+v", err)
+	}
+
+	//遗留的socket文件被删除
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("listen error:%+v", err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+	ln, err = Listen(address, option)
+	if err != nil {
+		t.Fatalf("listen with stale socket error:%+v", err)
+	}
+	ln.Close()
+
+	//不是socket的文件不删除
+	err = os.WriteFile(path, []byte("data"), 0600)
+	if err != nil {
+		t.Fatalf("write file error:%+v", err)
+	}
+	_, err = Listen(address, option)
+	if err != ErrNotSocket {
+		t.Errorf("expect not socket, got %+v", err)
+	}
+}
@@ -0,0 +1,22 @@
+package util
+
+import (
+	"go.uber.org/zap"
+)
+
+//新建生产环境的日志 -- level为debug、info、warn或error
+//返回的日志级别可以在运行时修改,它实现了http.Handler,可以挂到pprof端口上查询与修改
+func NewLogger(level string) (*zap.Logger, zap.AtomicLevel, error) {
+	atomicLevel := zap.NewAtomicLevel()
+	err := atomicLevel.UnmarshalText([]byte(level))
+	if err != nil {
+		return nil, atomicLevel, err
+	}
+	config := zap.NewProductionConfig()
+	config.Level = atomicLevel
+	logger, err := config.Build()
+	if err != nil {
+		return nil, atomicLevel, err
+	}
+	return logger, atomicLevel, nil
+}
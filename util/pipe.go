@@ -0,0 +1,82 @@
+package util
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+)
+
+var (
+	ErrPipeClosed = errors.New("pipe listener is closed")
+)
+
+//进程内的监听者 -- 基于net.Pipe,同时作为连接器使用,不占用端口
+//Dial建立的连接由Accept返回,用于测试时服务端与客户端在同一进程内通信
+type PipeListener struct {
+	addr pipeAddr
+	//等待Accept的连接
+	conns chan net.Conn
+	//关闭通知
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+//进程内的地址
+type pipeAddr string
+
+func (addr pipeAddr) Network() string {
+	return "pipe"
+}
+
+func (addr pipeAddr) String() string {
+	return string(addr)
+}
+
+//新建进程内的监听者 -- address只用于Addr返回
+func NewPipeListener(address string) *PipeListener {
+	return &PipeListener{
+		addr:   pipeAddr(address),
+		conns:  make(chan net.Conn),
+		closed: make(chan struct{}),
+	}
+}
+
+//等待连接
+func (l *PipeListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, ErrPipeClosed
+	}
+}
+
+//关闭 -- 之后Accept与Dial都返回ErrPipeClosed,已建立的连接不受影响
+func (l *PipeListener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.closed)
+	})
+	return nil
+}
+
+func (l *PipeListener) Addr() net.Addr {
+	return l.addr
+}
+
+//建立连接 -- 忽略network与address,等待Accept接收后返回
+func (l *PipeListener) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	client, server := net.Pipe()
+	select {
+	case l.conns <- server:
+		return client, nil
+	case <-l.closed:
+	case <-ctx.Done():
+		client.Close()
+		server.Close()
+		return nil, ctx.Err()
+	}
+	client.Close()
+	server.Close()
+	return nil, ErrPipeClosed
+}
@@ -2,9 +2,11 @@ package util
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"net"
 	"sync"
+	"time"
 )
 
 var (
@@ -12,64 +14,187 @@ var (
 	ErrPoolClosed  = errors.New("pool is closed")
 )
 
+const (
+	//缺省的空闲连接检查间隔
+	DefaultHealthCheckInterval = 30 * time.Second
+	//健康检查时读取的等待时间
+	healthCheckReadTimeout = time.Millisecond
+)
+
+//连接器 -- *net.Dialer与PipeListener都实现了此接口
+type ContextDialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+//连接建立后的握手 -- 返回错误时连接被关闭
+type HandshakeFunc func(ctx context.Context, conn net.Conn) error
+
+//心跳 -- 在空闲连接上发送心跳并等待返回,返回错误时连接被替换
+type PingFunc func(ctx context.Context, conn net.Conn) error
+
+//连接池参数
+type PoolOption struct {
+	//连接器
+	Dialer ContextDialer
+	//网络类型 -- tcp、unix或unixpacket,为空时按ParseAddress从Address解析
+	Network string
+	//服务地址
+	Address string
+	//TLS配置 -- 不为nil时建立连接后进行TLS握手
+	TLSConfig *tls.Config
+	//握手 -- 不为nil时每次建立连接(包括Renew)后在TLS握手之后调用
+	Handshake HandshakeFunc
+	//最少保持的连接数 -- 创建时尝试建立,后台检查时补足,0表示完全按需建立
+	MinSize int
+	//最多的连接数
+	MaxSize int
+	//连接最长使用时间,超过后不再复用,0表示不限制
+	MaxLifetime time.Duration
+	//连接最长空闲时间,超过后关闭,0表示不限制
+	MaxIdleTime time.Duration
+	//后台检查空闲连接的间隔,0表示不做后台检查
+	HealthCheckInterval time.Duration
+	//心跳 -- 设置了心跳间隔时必须设置
+	Ping PingFunc
+	//心跳间隔 -- 连接空闲超过此时间后发送心跳,0表示不发送
+	PingInterval time.Duration
+	//等待心跳返回的时间,0表示与心跳间隔相同
+	PingTimeout time.Duration
+}
+
+func (option *PoolOption) Validate() error {
+	if option.Network != "" && !IsSupportedNetwork(option.Network) {
+		return ErrInvalidPool
+	}
+	if option.Dialer == nil ||
+		option.MaxSize <= 0 ||
+		option.MinSize < 0 ||
+		option.MinSize > option.MaxSize ||
+		option.MaxLifetime < 0 ||
+		option.MaxIdleTime < 0 ||
+		option.HealthCheckInterval < 0 ||
+		option.PingInterval < 0 ||
+		option.PingTimeout < 0 {
+		return ErrInvalidPool
+	}
+	if option.PingInterval > 0 && option.Ping == nil {
+		return ErrInvalidPool
+	}
+	return nil
+}
+
+//连接池状态
+type PoolStats struct {
+	//已建立的连接数
+	Open int
+	//空闲的连接数
+	Idle int
+}
+
 //封装的net.Conn
 type Conn struct {
 	net.Conn
 	p *NetPool
+	//建立时间
+	createdAt time.Time
 }
 
-//Close
+//Close -- 归还连接池
 func (c *Conn) Close() error {
-	return c.p.put(c.Conn)
+	return c.p.put(c.Conn, c.createdAt)
 }
 
-//Renew
+//Discard -- 连接已不可用,关闭而不归还连接池
+func (c *Conn) Discard() error {
+	return c.p.discard(c.Conn)
+}
+
+//Renew -- 重新建立连接,替换原有连接
 func (c *Conn) Renew(ctx context.Context) error {
-	dialer, addr, connList := c.p.getFactory()
-	if connList == nil {
+	if c.p.isClosed() {
 		return ErrPoolClosed
 	}
-	newConn, err := dialer.DialContext(ctx, `tcp`, addr)
+	newConn, err := c.p.dial(ctx)
 	if err != nil {
 		return err
 	}
 	oldConn := c.Conn
 	c.Conn = newConn
+	c.createdAt = time.Now()
 	oldConn.Close()
 	return nil
 }
 
+//空闲连接
+type idleConn struct {
+	conn net.Conn
+	//建立时间
+	createdAt time.Time
+	//开始空闲的时间
+	idleAt time.Time
+	//上次确认连接可用的时间 -- 开始空闲或心跳返回的时间
+	aliveAt time.Time
+}
+
 //连接池
+//连接按需建立,最多MaxSize个; 空闲连接后进先出复用,过期或检查失败的连接被关闭
+//使用中与正在检查的连接都占用许可,没有空闲连接时拿到许可才建立新连接,保证连接数不超过上限
 type NetPool struct {
-	//conn chan list
-	connList chan net.Conn
-	//连接器
-	dialer *net.Dialer
-	//服务地址
-	address string
+	//参数
+	option PoolOption
+	//空闲连接
+	idle []idleConn
+	//已建立的连接数 -- 空闲与使用中的连接
+	open int
+	//使用许可 -- 获取连接时占用,归还时释放
+	sem chan struct{}
+	//关闭通知
+	exit chan struct{}
+	//是否关闭
+	closed bool
 	//锁
-	sync.RWMutex
+	sync.Mutex
 }
 
+//新建连接池 -- 建立size个连接,并定时检查空闲连接
+//服务暂时不可用时不会失败,连接在使用时按需建立; 地址格式同ParseAddress
 func NewPool(ctx context.Context, size int, dialer *net.Dialer, address string) (*NetPool, error) {
-	if size <= 0 || dialer == nil {
+	return NewPoolWithOption(ctx, &PoolOption{
+		Dialer:              dialer,
+		Address:             address,
+		MinSize:             size,
+		MaxSize:             size,
+		HealthCheckInterval: DefaultHealthCheckInterval,
+	})
+}
+
+//按参数新建连接池
+func NewPoolWithOption(ctx context.Context, option *PoolOption) (*NetPool, error) {
+	if option == nil {
 		return nil, ErrInvalidPool
 	}
+	err := option.Validate()
+	if err != nil {
+		return nil, err
+	}
 
 	pool := &NetPool{
-		connList: make(chan net.Conn, size),
-		dialer:   dialer,
-		address:  address,
+		option: *option,
+		sem:    make(chan struct{}, option.MaxSize),
+		exit:   make(chan struct{}),
 	}
-
-	for i := 0; i < size; i++ {
-		conn, err := dialer.DialContext(ctx, "tcp", address)
+	if option.Network == "" {
+		pool.option.Network, pool.option.Address, err = ParseAddress(option.Address)
 		if err != nil {
-			pool.Close()
 			return nil, err
 		}
+	}
+	//尝试建立最少的连接数,失败时留给后续按需建立
+	pool.fill(ctx)
 
-		pool.connList <- conn
+	interval := pool.maintainInterval()
+	if interval > 0 {
+		go pool.maintainLoop(interval)
 	}
 	return pool, nil
 }
@@ -78,13 +203,19 @@ func (p *NetPool) Close() error {
 	var lastErr error
 
 	p.Lock()
-	connChan := p.connList
-	p.connList = nil
+	if p.closed {
+		p.Unlock()
+		return nil
+	}
+	p.closed = true
+	close(p.exit)
+	idle := p.idle
+	p.idle = nil
+	p.open -= len(idle)
 	p.Unlock()
 
-	close(connChan)
-	for conn := range connChan {
-		err := conn.Close()
+	for _, ic := range idle {
+		err := ic.conn.Close()
 		if err != nil {
 			lastErr = err
 		}
@@ -92,44 +223,340 @@ func (p *NetPool) Close() error {
 	return lastErr
 }
 
-func (p *NetPool) put(conn net.Conn) error {
-	p.RLock()
-	if p.connList == nil {
-		err := conn.Close()
-		p.RUnlock()
-		return err
-	} else {
-		p.connList <- conn
-		p.RUnlock()
-		return nil
+//获取状态
+func (p *NetPool) Stats() PoolStats {
+	p.Lock()
+	defer p.Unlock()
+	return PoolStats{
+		Open: p.open,
+		Idle: len(p.idle),
 	}
 }
 
-func (p *NetPool) getFactory() (*net.Dialer, string, chan net.Conn) {
-	p.RLock()
-	dialer, addr, connList := p.dialer, p.address, p.connList
-	p.RUnlock()
-	return dialer, addr, connList
-}
-
+//获取连接 -- 没有空闲连接且未达到上限时建立新连接,达到上限时等待归还
 func (p *NetPool) Get(ctx context.Context) (*Conn, error) {
-	_, _, connList := p.getFactory()
-
-	if connList == nil {
+	if p.isClosed() {
 		return nil, ErrPoolClosed
 	}
 
+	//占用许可
 	select {
-	case conn := <-connList:
-		if conn == nil {
-			return nil, ErrPoolClosed
-		} else {
-			return &Conn{
-				Conn: conn,
-				p:    p,
-			}, nil
-		}
+	case p.sem <- struct{}{}:
+	case <-p.exit:
+		return nil, ErrPoolClosed
 	case <-ctx.Done():
 		return nil, ctx.Err()
 	}
+
+	now := time.Now()
+	var expired []net.Conn
+	p.Lock()
+	if p.closed {
+		p.Unlock()
+		p.release()
+		return nil, ErrPoolClosed
+	}
+	//取最近归还的空闲连接
+	for len(p.idle) > 0 {
+		ic := p.idle[len(p.idle)-1]
+		p.idle = p.idle[:len(p.idle)-1]
+		if p.expired(ic, now) {
+			expired = append(expired, ic.conn)
+			p.open--
+			continue
+		}
+		p.Unlock()
+		closeConns(expired)
+		return &Conn{
+			Conn:      ic.conn,
+			p:         p,
+			createdAt: ic.createdAt,
+		}, nil
+	}
+	//没有空闲连接,建立新连接 -- 其他未空闲的连接都占用许可,建立后不超过上限
+	p.open++
+	p.Unlock()
+	closeConns(expired)
+
+	conn, err := p.dial(ctx)
+	if err != nil {
+		p.Lock()
+		p.open--
+		p.Unlock()
+		p.release()
+		return nil, err
+	}
+	return &Conn{
+		Conn:      conn,
+		p:         p,
+		createdAt: time.Now(),
+	}, nil
+}
+
+//建立连接 -- 设置了TLS与握手时依次完成
+func (p *NetPool) dial(ctx context.Context) (net.Conn, error) {
+	conn, err := DialNetwork(ctx, p.option.Dialer, p.option.Network, p.option.Address)
+	if err != nil {
+		return nil, err
+	}
+	if p.option.TLSConfig != nil {
+		conn, err = ClientHandshake(ctx, conn, p.option.Address, p.option.TLSConfig)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if p.option.Handshake != nil {
+		err = p.option.Handshake(ctx, conn)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+//归还连接
+func (p *NetPool) put(conn net.Conn, createdAt time.Time) error {
+	defer p.release()
+
+	now := time.Now()
+	ic := idleConn{
+		conn:      conn,
+		createdAt: createdAt,
+		idleAt:    now,
+		aliveAt:   now,
+	}
+	p.Lock()
+	if p.closed || p.expired(ic, now) {
+		p.open--
+		p.Unlock()
+		return conn.Close()
+	}
+	p.idle = append(p.idle, ic)
+	p.Unlock()
+	return nil
+}
+
+//丢弃连接
+func (p *NetPool) discard(conn net.Conn) error {
+	defer p.release()
+
+	p.Lock()
+	p.open--
+	p.Unlock()
+	return conn.Close()
+}
+
+//释放许可
+func (p *NetPool) release() {
+	<-p.sem
+}
+
+func (p *NetPool) isClosed() bool {
+	p.Lock()
+	defer p.Unlock()
+	return p.closed
+}
+
+//空闲连接是否过期
+func (p *NetPool) expired(ic idleConn, now time.Time) bool {
+	if p.option.MaxLifetime > 0 && now.Sub(ic.createdAt) >= p.option.MaxLifetime {
+		return true
+	}
+	if p.option.MaxIdleTime > 0 && now.Sub(ic.idleAt) >= p.option.MaxIdleTime {
+		return true
+	}
+	return false
+}
+
+//后台检查的间隔 -- 检查间隔与心跳间隔中较小的一个,0表示不做后台检查
+func (p *NetPool) maintainInterval() time.Duration {
+	interval := p.option.HealthCheckInterval
+	if p.option.PingInterval > 0 && (interval == 0 || p.option.PingInterval < interval) {
+		interval = p.option.PingInterval
+	}
+	return interval
+}
+
+//后台检查
+func (p *NetPool) maintainLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.exit:
+			return
+		case <-ticker.C:
+			replace := p.checkIdle()
+			ctx, cancel := context.WithTimeout(context.Background(), interval)
+			p.fill(ctx)
+			//替换心跳失败的连接
+			for i := 0; i < replace && p.addIdle(ctx, p.option.MaxSize); i++ {
+			}
+			cancel()
+		}
+	}
+}
+
+//检查空闲连接 -- 关闭过期的与对端已经关闭的连接,空闲较久的连接发送心跳
+//每次只取出一个连接检查并占用一个许可,其余连接仍然可以被获取,连接数不超过上限
+//返回心跳失败的连接数
+func (p *NetPool) checkIdle() int {
+	var pingFailed int
+
+	p.Lock()
+	conns := idleConns(p.idle)
+	p.Unlock()
+
+	for _, conn := range conns {
+		//没有许可时所有连接都在使用中
+		select {
+		case p.sem <- struct{}{}:
+		default:
+			return pingFailed
+		}
+		ic, ok := p.takeIdle(conn)
+		if !ok {
+			//检查过程中已被取走或连接池已关闭
+			p.release()
+			continue
+		}
+		now := time.Now()
+		alive := !p.expired(ic, now) && checkConnAlive(ic.conn)
+		if alive && p.needPing(ic, now) {
+			alive = p.ping(ic.conn)
+			if !alive {
+				pingFailed++
+			}
+			ic.aliveAt = time.Now()
+		}
+		p.returnIdle(ic, alive)
+		p.release()
+	}
+	return pingFailed
+}
+
+//取出指定的空闲连接 -- 连接已不是空闲连接或连接池已关闭时返回false
+func (p *NetPool) takeIdle(conn net.Conn) (idleConn, bool) {
+	p.Lock()
+	defer p.Unlock()
+	if p.closed {
+		return idleConn{}, false
+	}
+	for i, ic := range p.idle {
+		if ic.conn == conn {
+			p.idle = append(p.idle[:i], p.idle[i+1:]...)
+			return ic, true
+		}
+	}
+	return idleConn{}, false
+}
+
+//放回检查过的空闲连接 -- 不可用或连接池已关闭时关闭
+func (p *NetPool) returnIdle(ic idleConn, alive bool) {
+	p.Lock()
+	if !alive || p.closed {
+		p.open--
+		p.Unlock()
+		ic.conn.Close()
+		return
+	}
+	//检查过程中归还的连接更新,检查过的连接放在前面
+	p.idle = append([]idleConn{ic}, p.idle...)
+	p.Unlock()
+}
+
+//空闲连接是否需要发送心跳
+func (p *NetPool) needPing(ic idleConn, now time.Time) bool {
+	return p.option.PingInterval > 0 && now.Sub(ic.aliveAt) >= p.option.PingInterval
+}
+
+//发送心跳 -- 返回连接是否可用
+func (p *NetPool) ping(conn net.Conn) bool {
+	timeout := p.option.PingTimeout
+	if timeout == 0 {
+		timeout = p.option.PingInterval
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return p.option.Ping(ctx, conn) == nil
+}
+
+//补足最少的连接数
+func (p *NetPool) fill(ctx context.Context) {
+	for p.addIdle(ctx, p.option.MinSize) {
+	}
+}
+
+//建立一个空闲连接 -- 连接数已达到limit、没有许可、连接池已关闭或建立失败时返回false
+//建立期间占用许可,与Get建立的连接一起不超过上限
+func (p *NetPool) addIdle(ctx context.Context, limit int) bool {
+	select {
+	case p.sem <- struct{}{}:
+	default:
+		return false
+	}
+	defer p.release()
+
+	p.Lock()
+	if p.closed || p.open >= limit {
+		p.Unlock()
+		return false
+	}
+	p.open++
+	p.Unlock()
+
+	conn, err := p.dial(ctx)
+
+	p.Lock()
+	if err != nil || p.closed {
+		p.open--
+		p.Unlock()
+		if conn != nil {
+			conn.Close()
+		}
+		return false
+	}
+	now := time.Now()
+	p.idle = append(p.idle, idleConn{
+		conn:      conn,
+		createdAt: now,
+		idleAt:    now,
+		aliveAt:   now,
+	})
+	p.Unlock()
+	return true
+}
+
+//检查空闲连接是否可用
+//空闲连接上不应该有数据,读超时表示连接正常; 读到EOF、错误或多余的数据都表示连接不可用
+func checkConnAlive(conn net.Conn) bool {
+	err := conn.SetReadDeadline(time.Now().Add(healthCheckReadTimeout))
+	if err != nil {
+		return false
+	}
+	var b [1]byte
+	n, err := conn.Read(b[:])
+	if n > 0 {
+		return false
+	}
+	ne, ok := err.(net.Error)
+	if !ok || !ne.Timeout() {
+		return false
+	}
+	return conn.SetReadDeadline(time.Time{}) == nil
+}
+
+func idleConns(list []idleConn) []net.Conn {
+	conns := make([]net.Conn, 0, len(list))
+	for _, ic := range list {
+		conns = append(conns, ic.conn)
+	}
+	return conns
+}
+
+func closeConns(conns []net.Conn) {
+	for _, conn := range conns {
+		conn.Close()
+	}
 }
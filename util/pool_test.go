@@ -0,0 +1,270 @@
+package util
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+//启动测试服务 -- closeAfterAccept为true时接收连接后立即关闭
+func startTestListener(t *testing.T, closeAfterAccept bool) (string, *int32) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen error:%+v", err)
+	}
+	t.Cleanup(func() {
+		ln.Close()
+	})
+	var accepted int32
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&accepted, 1)
+			if closeAfterAccept {
+				conn.Close()
+			}
+		}
+	}()
+	return ln.Addr().String(), &accepted
+}
+
+func TestPoolBackendDown(t *testing.T) {
+	//先占用一个端口再关闭,保证没有服务
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen error:%+v", err)
+	}
+	address := ln.Addr().String()
+	ln.Close()
+
+	pool, err := NewPool(context.Background(), 2, &net.Dialer{}, address)
+	if err != nil {
+		t.Fatalf("new pool should not fail when backend is down: %+v", err)
+	}
+	defer pool.Close()
+
+	_, err = pool.Get(context.Background())
+	if err == nil {
+		t.Errorf("expect dial error")
+	}
+	if pool.Stats().Open != 0 {
+		t.Errorf("expect no open conn, got %+v", pool.Stats())
+	}
+}
+
+func TestPoolLazyAndMaxIdle(t *testing.T) {
+	address, accepted := startTestListener(t, false)
+
+	pool, err := NewPoolWithOption(context.Background(), &PoolOption{
+		Dialer:      &net.Dialer{},
+		Address:     address,
+		MaxSize:     2,
+		MaxIdleTime: 20 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("new pool error:%+v", err)
+	}
+	defer pool.Close()
+
+	if pool.Stats().Open != 0 {
+		t.Errorf("expect lazy pool, got %+v", pool.Stats())
+	}
+
+	conn, err := pool.Get(context.Background())
+	if err != nil {
+		t.Fatalf("get error:%+v", err)
+	}
+	conn.Close()
+	//立即获取复用空闲连接
+	conn, err = pool.Get(context.Background())
+	if err != nil {
+		t.Fatalf("get error:%+v", err)
+	}
+	conn.Close()
+	time.Sleep(30 * time.Millisecond)
+	//空闲超时后建立新连接
+	conn, err = pool.Get(context.Background())
+	if err != nil {
+		t.Fatalf("get error:%+v", err)
+	}
+	conn.Close()
+
+	time.Sleep(10 * time.Millisecond)
+	if n := atomic.LoadInt32(accepted); n != 2 {
+		t.Errorf("expect 2 dials, got %d", n)
+	}
+	if stats := pool.Stats(); stats.Open != 1 || stats.Idle != 1 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
+
+func TestPoolMaxSizeWait(t *testing.T) {
+	address, _ := startTestListener(t, false)
+
+	pool, err := NewPoolWithOption(context.Background(), &PoolOption{
+		Dialer:  &net.Dialer{},
+		Address: address,
+		MaxSize: 1,
+	})
+	if err != nil {
+		t.Fatalf("new pool error:%+v", err)
+	}
+	defer pool.Close()
+
+	conn, err := pool.Get(context.Background())
+	if err != nil {
+		t.Fatalf("get error:%+v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err = pool.Get(ctx)
+	if err != context.DeadlineExceeded {
+		t.Errorf("expect deadline exceeded, got %+v", err)
+	}
+	conn.Close()
+}
+
+func TestPoolHealthCheck(t *testing.T) {
+	address, _ := startTestListener(t, true)
+
+	pool, err := NewPoolWithOption(context.Background(), &PoolOption{
+		Dialer:              &net.Dialer{},
+		Address:             address,
+		MinSize:             2,
+		MaxSize:             2,
+		HealthCheckInterval: time.Hour,
+	})
+	if err != nil {
+		t.Fatalf("new pool error:%+v", err)
+	}
+	defer pool.Close()
+	if pool.Stats().Idle != 2 {
+		t.Fatalf("expect 2 idle conns, got %+v", pool.Stats())
+	}
+
+	//对端已关闭的连接被检查出来
+	time.Sleep(20 * time.Millisecond)
+	pool.checkIdle()
+	if stats := pool.Stats(); stats.Open != 0 || stats.Idle != 0 {
+		t.Errorf("expect dead conns evicted, got %+v", stats)
+	}
+}
+
+func TestPoolCheckIdleWithGet(t *testing.T) {
+	address, accepted := startTestListener(t, false)
+
+	//心跳阻塞直到release关闭
+	pinging := make(chan struct{}, 2)
+	release := make(chan struct{})
+	ping := func(ctx context.Context, conn net.Conn) error {
+		pinging <- struct{}{}
+		<-release
+		return nil
+	}
+	pool, err := NewPoolWithOption(context.Background(), &PoolOption{
+		Dialer:       &net.Dialer{},
+		Address:      address,
+		MinSize:      2,
+		MaxSize:      2,
+		Ping:         ping,
+		PingInterval: time.Hour,
+	})
+	if err != nil {
+		t.Fatalf("new pool error:%+v", err)
+	}
+	defer pool.Close()
+
+	//让所有空闲连接都需要心跳
+	pool.Lock()
+	for i := range pool.idle {
+		pool.idle[i].aliveAt = time.Now().Add(-2 * time.Hour)
+	}
+	pool.Unlock()
+	done := make(chan int)
+	go func() {
+		done <- pool.checkIdle()
+	}()
+	<-pinging
+
+	//一个连接在发送心跳时,另一个空闲连接仍然可以获取
+	conn, err := pool.Get(context.Background())
+	if err != nil {
+		t.Fatalf("get conn error:%+v", err)
+	}
+	//正在检查的连接占用许可,不会建立超过上限的连接
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err = pool.Get(ctx)
+	if err != context.DeadlineExceeded {
+		t.Errorf("expect deadline exceeded, got %+v", err)
+	}
+	if stats := pool.Stats(); stats.Open != 2 || atomic.LoadInt32(accepted) != 2 {
+		t.Errorf("expect 2 open conns, got %+v accepted:%d", stats, atomic.LoadInt32(accepted))
+	}
+
+	close(release)
+	if failed := <-done; failed != 0 {
+		t.Errorf("expect no ping failed, got %d", failed)
+	}
+	conn.Close()
+	if stats := pool.Stats(); stats.Open != 2 || stats.Idle != 2 {
+		t.Errorf("unexpected stats:%+v", stats)
+	}
+}
+
+func TestPoolPing(t *testing.T) {
+	address, accepted := startTestListener(t, false)
+
+	//第一次心跳失败
+	var pings int32
+	ping := func(ctx context.Context, conn net.Conn) error {
+		if atomic.AddInt32(&pings, 1) == 1 {
+			return context.DeadlineExceeded
+		}
+		return nil
+	}
+	pool, err := NewPoolWithOption(context.Background(), &PoolOption{
+		Dialer:       &net.Dialer{},
+		Address:      address,
+		MaxSize:      2,
+		Ping:         ping,
+		PingInterval: 20 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("new pool error:%+v", err)
+	}
+	defer pool.Close()
+	conn, err := pool.Get(context.Background())
+	if err != nil {
+		t.Fatalf("get conn error:%+v", err)
+	}
+	conn.Close()
+
+	//心跳失败的连接被替换,之后的心跳成功
+	deadline := time.Now().Add(time.Second)
+	for atomic.LoadInt32(&pings) < 3 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if n := atomic.LoadInt32(accepted); n != 2 {
+		t.Errorf("expect conn replaced once, accepted:%d", n)
+	}
+	if stats := pool.Stats(); stats.Open != 1 || stats.Idle != 1 {
+		t.Errorf("unexpected stats:%+v", stats)
+	}
+
+	//设置了心跳间隔时必须设置心跳
+	_, err = NewPoolWithOption(context.Background(), &PoolOption{
+		Dialer:       &net.Dialer{},
+		Address:      address,
+		MaxSize:      1,
+		PingInterval: time.Second,
+	})
+	if err != ErrInvalidPool {
+		t.Errorf("expect invalid pool, got %+v", err)
+	}
+}
@@ -6,12 +6,21 @@ import (
 )
 
 func PprofServerStart(address string, errNotify chan<- error) {
+	PprofServerStartWithHandlers(address, nil, errNotify)
+}
+
+//启动pprof http服务,同时挂载额外的处理(如指标输出)
+//handlers的key为路径
+func PprofServerStartWithHandlers(address string, handlers map[string]http.Handler, errNotify chan<- error) {
 	serverMux := http.NewServeMux()
 	serverMux.Handle("/debug/pprof/", http.HandlerFunc(pprof.Index))
 	serverMux.Handle("/debug/pprof/cmdline", http.HandlerFunc(pprof.Cmdline))
 	serverMux.Handle("/debug/pprof/profile", http.HandlerFunc(pprof.Profile))
 	serverMux.Handle("/debug/pprof/symbol", http.HandlerFunc(pprof.Symbol))
 	serverMux.Handle("/debug/pprof/trace", http.HandlerFunc(pprof.Trace))
+	for path, handler := range handlers {
+		serverMux.Handle(path, handler)
+	}
 	err := http.ListenAndServe(address, serverMux)
 	errNotify <- err
 }
@@ -0,0 +1,121 @@
+package util
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"net"
+)
+
+var (
+	ErrInvalidTLS = errors.New("invalid tls settings")
+)
+
+//TLS参数 -- 证书与私钥为PEM格式的文件
+type TLSOption struct {
+	//证书文件
+	CertFile string
+	//私钥文件
+	KeyFile string
+	//CA证书文件 -- 服务端用于验证客户端证书,客户端用于验证服务端证书(为空时使用系统CA)
+	CAFile string
+	//服务端名称 -- 客户端验证服务端证书时使用,为空时使用连接地址中的主机名
+	ServerName string
+	//服务端要求并验证客户端证书(双向TLS),需要设置CAFile
+	RequireClientCert bool
+	//客户端不验证服务端证书,只用于测试
+	InsecureSkipVerify bool
+}
+
+//生成服务端TLS配置
+//设置了CAFile而没有要求客户端证书时,客户端提供的证书也会被验证
+func (option *TLSOption) ServerConfig() (*tls.Config, error) {
+	if option.CertFile == "" || option.KeyFile == "" {
+		return nil, ErrInvalidTLS
+	}
+	cert, err := tls.LoadX509KeyPair(option.CertFile, option.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if option.CAFile != "" {
+		config.ClientCAs, err = LoadCertPool(option.CAFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if option.RequireClientCert {
+		if config.ClientCAs == nil {
+			return nil, ErrInvalidTLS
+		}
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	} else if config.ClientCAs != nil {
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return config, nil
+}
+
+//生成客户端TLS配置 -- 设置了证书与私钥时向服务端提供客户端证书
+func (option *TLSOption) ClientConfig() (*tls.Config, error) {
+	config := &tls.Config{
+		ServerName:         option.ServerName,
+		InsecureSkipVerify: option.InsecureSkipVerify,
+		MinVersion:         tls.VersionTLS12,
+	}
+
+	if option.CertFile != "" || option.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(option.CertFile, option.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	if option.CAFile != "" {
+		pool, err := LoadCertPool(option.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = pool
+	}
+	return config, nil
+}
+
+//从PEM格式的文件加载CA证书
+func LoadCertPool(files ...string) (*x509.CertPool, error) {
+	pool := x509.NewCertPool()
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, ErrInvalidTLS
+		}
+	}
+	return pool, nil
+}
+
+//客户端TLS握手 -- config没有设置ServerName时使用address中的主机名
+//握手失败时关闭conn
+func ClientHandshake(ctx context.Context, conn net.Conn, address string, config *tls.Config) (net.Conn, error) {
+	if config.ServerName == "" {
+		host, _, err := net.SplitHostPort(address)
+		if err == nil {
+			config = config.Clone()
+			config.ServerName = host
+		}
+	}
+	tlsConn := tls.Client(conn, config)
+	err := tlsConn.HandshakeContext(ctx)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}